@@ -0,0 +1,153 @@
+package main
+
+// authtoken module provides signed internal tokens of backend requests
+//
+// Copyright (c) 2020 - Valentin Kuznetsov <vkuznet@gmail.com>
+//
+
+/*
+When internal_token.enable is set the server adds JWT signed by the server
+key (scitokens.rsa_key) to every authenticated request passed to backends
+(X-Auth-Token header by default). The token carries user login, name, DN,
+email, CRIC roles and authentication method of the user, its audience is
+name of the ingress rule of the backend. The backends verify the token with
+JWKS published by the server at {base}/.well-known/jwks.json, i.e. with
+standard JWT libraries instead of cmsauth HMAC of Cms-Authn-* headers.
+The internal_token.drop_cms_headers option removes Cms-* headers from
+backend requests such that backends rely on the token only.
+*/
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"log"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+// defaultInternalTokenHeader defines default HTTP header of internal tokens
+const defaultInternalTokenHeader = "X-Auth-Token"
+
+// defaultInternalTokenLifetime defines default lifetime (in sec) of internal tokens
+const defaultInternalTokenLifetime = 60
+
+// InternalClaims represents claims of internal token passed to backends
+type InternalClaims struct {
+	Login  string              `json:"login"`           // user CRIC login
+	Name   string              `json:"name,omitempty"`  // user name
+	DN     string              `json:"dn,omitempty"`    // user DN
+	Email  string              `json:"email,omitempty"` // user email
+	Roles  map[string][]string `json:"roles,omitempty"` // user CRIC roles and their groups and sites
+	Method string              `json:"method"`          // authentication method of the user
+	jwt.StandardClaims
+}
+
+// helper function to get internal token claims from CMS headers of
+// authenticated HTTP request
+func internalClaims(r *http.Request) (InternalClaims, bool) {
+	claims := InternalClaims{
+		Login:  r.Header.Get("Cms-Authn-Login"),
+		Name:   r.Header.Get("Cms-Authn-Name"),
+		DN:     r.Header.Get("Cms-Authn-Dn"),
+		Email:  r.Header.Get("Cms-Email"),
+		Method: r.Header.Get("Cms-Authn-Method"),
+	}
+	if claims.Login == "" {
+		return claims, false
+	}
+	for key, vals := range r.Header {
+		key = strings.ToLower(key)
+		if !strings.HasPrefix(key, "cms-authz-") || len(vals) == 0 {
+			continue
+		}
+		if claims.Roles == nil {
+			claims.Roles = make(map[string][]string)
+		}
+		role := strings.TrimPrefix(key, "cms-authz-")
+		claims.Roles[role] = strings.Fields(vals[0])
+	}
+	return claims, true
+}
+
+// helper function to set signed internal token of authenticated user in
+// backend request, aud defines audience of the token (name of ingress rule)
+func setInternalToken(r *http.Request, aud string) {
+	cfg := Config().InternalToken
+	if !cfg.Enable {
+		return
+	}
+	// never pass token provided by the client
+	r.Header.Del(cfg.Header)
+	claims, ok := internalClaims(r)
+	if cfg.DropCMSHeaders {
+		clearCMSHeaders(r)
+	}
+	if !ok {
+		return
+	}
+	if privateKey == nil {
+		// internal tokens were enabled by configuration reload
+		log.Println("server key is not initialized, internal tokens require server restart")
+		return
+	}
+	now := time.Now()
+	issuer, kid := getIssuer(r)
+	claims.StandardClaims = jwt.StandardClaims{
+		Audience:  aud,
+		ExpiresAt: now.Add(time.Duration(cfg.Lifetime) * time.Second).Unix(),
+		Issuer:    issuer,
+		IssuedAt:  now.Unix(),
+		Id:        genUUID(),
+		Subject:   claims.Login,
+		NotBefore: now.Unix(),
+	}
+	token, err := signClaims(claims, kid)
+	if err != nil {
+		log.Println("unable to sign internal token", err)
+		return
+	}
+	r.Header.Set(cfg.Header, token)
+}
+
+// helper function to get JWKS of server public key
+func serverJWKS(kid string) PublicJWKS {
+	if kid == "" {
+		kid = "key-rs256"
+	}
+	key := PublicJWKSKey{
+		Alg: "RS256",
+		Kid: kid,
+		Kty: "RSA",
+		Use: "sig",
+		N:   base64.RawURLEncoding.EncodeToString(publicKey.N.Bytes()),
+		E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(publicKey.E)).Bytes()),
+	}
+	return PublicJWKS{Keys: []PublicJWKSKey{key}}
+}
+
+// jwks handler publishes JWKS to verify internal tokens
+func jwksHandler(w http.ResponseWriter, r *http.Request) {
+	_, kid := getIssuer(r)
+	data, err := json.Marshal(serverJWKS(kid))
+	if err != nil {
+		http.Error(w, "unable to marshal JWKS", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
+// helper function to setup HTTP handlers of internal and exchanged tokens
+func internalTokenServeMux(mux *http.ServeMux) {
+	if !Config().InternalToken.Enable && !Config().TokenExchange.Enable {
+		return
+	}
+	if err := initScitokensKeys(); err != nil {
+		log.Fatal(err)
+	}
+	mux.HandleFunc(Config().Base+"/.well-known/jwks.json", jwksHandler)
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	jwtgo "github.com/dgrijalva/jwt-go"
+	"github.com/pascaldekloe/jwt"
+	"github.com/stretchr/testify/assert"
+)
+
+// Test_internalToken function
+func Test_internalToken(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.Equal(t, err, nil)
+	privateKey = key
+	publicKey = &privateKey.PublicKey
+	Config().InternalToken = InternalTokenConfig{Enable: true, Header: defaultInternalTokenHeader, Lifetime: defaultInternalTokenLifetime}
+	defer func() {
+		privateKey = nil
+		publicKey = nil
+		Config().InternalToken = InternalTokenConfig{}
+	}()
+
+	// authenticated request gets signed token with user identity
+	r := httptest.NewRequest("GET", "/dbs", nil)
+	r.Header.Set("Cms-Authn-Login", "user")
+	r.Header.Set("Cms-Authn-Dn", "/CN=user")
+	r.Header.Set("Cms-Authn-Method", "X509Cert")
+	r.Header.Set("Cms-Authz-Admin", "group:dbs site:t1_us_fnal")
+	r.Header.Set("X-Auth-Token", "forged")
+	setInternalToken(r, "dbs")
+	token := r.Header.Get("X-Auth-Token")
+	claims := &InternalClaims{}
+	_, err = jwtgo.ParseWithClaims(token, claims, validateToken)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, claims.Login, "user")
+	assert.Equal(t, claims.Subject, "user")
+	assert.Equal(t, claims.Audience, "dbs")
+	assert.Equal(t, claims.Method, "X509Cert")
+	assert.Equal(t, claims.Roles["admin"], []string{"group:dbs", "site:t1_us_fnal"})
+	assert.Equal(t, r.Header.Get("Cms-Authn-Login"), "user")
+
+	// token is verified with published JWKS
+	w := httptest.NewRecorder()
+	jwksHandler(w, httptest.NewRequest("GET", "/.well-known/jwks.json", nil))
+	var keys jwt.KeyRegister
+	_, err = keys.LoadJWK(w.Body.Bytes())
+	assert.Equal(t, err, nil)
+	_, err = keys.Check([]byte(token))
+	assert.Equal(t, err, nil)
+
+	// internal token is not accepted as scitoken, even without audience
+	for _, aud := range []string{"dbs", ""} {
+		setInternalToken(r, aud)
+		req := httptest.NewRequest("GET", "/dbs", nil)
+		req.Header.Set("Authorization", "Bearer "+r.Header.Get("X-Auth-Token"))
+		_, err = validateJWT(httptest.NewRecorder(), req)
+		assert.NotEqual(t, err, nil, aud)
+	}
+
+	// token of the client is not passed to backends and CMS headers are
+	// removed if requested
+	Config().InternalToken.DropCMSHeaders = true
+	r = httptest.NewRequest("GET", "/dbs", nil)
+	r.Header.Set("X-Auth-Token", "forged")
+	setInternalToken(r, "dbs")
+	assert.Equal(t, r.Header.Get("X-Auth-Token"), "")
+	r.Header.Set("Cms-Authn-Login", "user")
+	setInternalToken(r, "dbs")
+	assert.NotEqual(t, r.Header.Get("X-Auth-Token"), "")
+	assert.Equal(t, r.Header.Get("Cms-Authn-Login"), "")
+}
+
+// Test_forgedCMSHeaders function
+func Test_forgedCMSHeaders(t *testing.T) {
+	// CMS headers of the client are removed before server sets them, such
+	// that they are never signed into internal token
+	r := httptest.NewRequest("GET", "/dbs", nil)
+	r.Header.Set("Cms-Authn-Login", "admin")
+	r.Header.Set("Cms-Authz-Admin", "group:injected")
+	r.Header.Set("Cms-Auth-Cert", "/CN=admin")
+	w := httptest.NewRecorder()
+	x509RequestHandler(w, r)
+	assert.Equal(t, w.Code, http.StatusUnauthorized)
+	claims, _ := internalClaims(r)
+	assert.NotEqual(t, claims.Login, "admin")
+	assert.Equal(t, len(claims.Roles), 0)
+	assert.Equal(t, r.Header.Get("Cms-Authz-Admin"), "")
+	assert.Equal(t, r.Header.Get("Cms-Auth-Cert"), "")
+}
@@ -0,0 +1,315 @@
+package main
+
+// balancer module provides load balancing of ingress backends
+//
+// Copyright (c) 2020 - Valentin Kuznetsov <vkuznet@gmail.com>
+//
+
+/*
+Every ingress rule owns a pool of backends built from its (comma separated)
+service_url. The pool picks a backend for every request using one of the
+following strategies:
+- round-robin  (default) cycle through available backends
+- least-conn   pick backend with least number of active connections
+- weighted     smooth weighted round-robin based on ingress weights
+- random       pick random backend
+
+Backends are removed from rotation either by active HTTP health checks
+(see HealthCheck configuration of ingress rule) or passively, after
+max_fails consecutive 5xx responses or connection errors observed by
+reverse proxy, in which case backend is ejected for fail_timeout seconds.
+If all backends of the pool are unavailable we still pick one of them
+since proxying request to a possibly dead backend is better than refusing
+it right away.
+*/
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// default values of backend pool parameters
+const (
+	defaultMaxFails           = 3  // number of consecutive failures to eject backend
+	defaultFailTimeout        = 30 // backend ejection time in seconds
+	defaultHealthInterval     = 10 // health check interval in seconds
+	defaultHealthTimeout      = 5  // health check timeout in seconds
+	defaultHealthyThreshold   = 2  // successful checks to mark backend alive
+	defaultUnhealthyThreshold = 3  // failed checks to mark backend dead
+)
+
+// Backend represents single backend service of ingress rule
+type Backend struct {
+	URL         *url.URL               // backend url
+	Weight      int                    // backend weight used by weighted strategy
+	pool        *BackendPool           // pool backend belongs to
+	proxy       *httputil.ReverseProxy // reverse proxy of the backend
+	alive       int32                  // backend status set by active health checks
+	connections int64                  // number of active connections
+	fails       int64                  // number of consecutive passive failures
+	ejected     int64                  // unix time (nanoseconds) until backend is ejected
+	current     int                    // current weight of smooth weighted round-robin
+	successes   int                    // consecutive successful health checks
+	failures    int                    // consecutive failed health checks
+}
+
+// String provides string representation of backend
+func (b *Backend) String() string {
+	return b.URL.String()
+}
+
+// Alive returns status of the backend, i.e. it is healthy and not ejected
+func (b *Backend) Alive() bool {
+	if atomic.LoadInt32(&b.alive) == 0 {
+		return false
+	}
+	return time.Now().UnixNano() > atomic.LoadInt64(&b.ejected)
+}
+
+// Connections returns number of active connections to the backend
+func (b *Backend) Connections() int64 {
+	return atomic.LoadInt64(&b.connections)
+}
+
+// success records successful response from the backend
+func (b *Backend) success() {
+	atomic.StoreInt64(&b.fails, 0)
+}
+
+// failure records failed response from the backend and ejects the backend
+// once it reaches max fails threshold of the pool
+func (b *Backend) failure() {
+	fails := atomic.AddInt64(&b.fails, 1)
+	if b.pool == nil || fails < int64(b.pool.MaxFails) {
+		return
+	}
+	until := time.Now().Add(b.pool.FailTimeout)
+	atomic.StoreInt64(&b.ejected, until.UnixNano())
+	atomic.StoreInt64(&b.fails, 0)
+	log.Printf("eject backend %s after %d consecutive failures until %v\n", b, fails, until)
+}
+
+// BackendPool represents pool of backends of ingress rule
+type BackendPool struct {
+	Backends    []*Backend    // list of backends
+	Strategy    string        // load balancing strategy
+	MaxFails    int           // consecutive failures to eject backend
+	FailTimeout time.Duration // backend ejection time
+	HealthCheck HealthCheck   // health check configuration
+	counter     uint64        // round-robin counter
+	mu          sync.Mutex    // lock for weighted strategy
+	stop        chan struct{} // channel to stop health checks
+}
+
+// helper function to create new backend pool for given ingress rule,
+// reverse proxies of pool backends use given transport
+func newBackendPool(rec Ingress, transport http.RoundTripper) (*BackendPool, error) {
+	pool := &BackendPool{
+		Strategy:    rec.Strategy,
+		MaxFails:    rec.MaxFails,
+		FailTimeout: time.Duration(rec.FailTimeout) * time.Second,
+		HealthCheck: rec.HealthCheck,
+	}
+	if pool.Strategy == "" {
+		pool.Strategy = "round-robin"
+	}
+	if pool.MaxFails == 0 {
+		pool.MaxFails = defaultMaxFails
+	}
+	if pool.FailTimeout == 0 {
+		pool.FailTimeout = defaultFailTimeout * time.Second
+	}
+	switch pool.Strategy {
+	case "round-robin", "least-conn", "weighted", "random":
+	default:
+		msg := fmt.Sprintf("unsupported load balancing strategy '%s'", pool.Strategy)
+		return nil, errors.New(msg)
+	}
+	var surls []string
+	for _, surl := range strings.Split(rec.ServiceURL, ",") {
+		// remove empty spaces around the string and skip empty entries,
+		// e.g. trailing comma in service_url
+		if surl = strings.Trim(surl, " "); surl != "" {
+			surls = append(surls, surl)
+		}
+	}
+	if len(surls) == 0 {
+		msg := fmt.Sprintf("no service urls in '%s'", rec.ServiceURL)
+		return nil, errors.New(msg)
+	}
+	if len(rec.Weights) > 0 && len(rec.Weights) != len(surls) {
+		msg := fmt.Sprintf("number of weights %d does not match number of service urls %d", len(rec.Weights), len(surls))
+		return nil, errors.New(msg)
+	}
+	for idx, surl := range surls {
+		burl, err := url.Parse(surl)
+		if err != nil {
+			return nil, err
+		}
+		weight := 1
+		if len(rec.Weights) > 0 {
+			weight = rec.Weights[idx]
+		}
+		if weight < 1 {
+			msg := fmt.Sprintf("invalid weight %d of service url %s", weight, surl)
+			return nil, errors.New(msg)
+		}
+		b := &Backend{URL: burl, Weight: weight, pool: pool, alive: 1}
+		b.proxy = newReverseProxy(b, transport)
+		pool.Backends = append(pool.Backends, b)
+	}
+	return pool, nil
+}
+
+// helper function to return list of available backends of the pool
+func (p *BackendPool) available() []*Backend {
+	var backends []*Backend
+	for _, b := range p.Backends {
+		if b.Alive() {
+			backends = append(backends, b)
+		}
+	}
+	return backends
+}
+
+// Next provides next backend of the pool based on pool strategy
+func (p *BackendPool) Next() *Backend {
+	if len(p.Backends) == 0 {
+		return nil
+	}
+	backends := p.available()
+	if len(backends) == 0 {
+		if Config().Verbose > 0 {
+			log.Println("no healthy backends in a pool, use all of them", p.Backends)
+		}
+		backends = p.Backends
+	}
+	if len(backends) == 1 {
+		return backends[0]
+	}
+	switch p.Strategy {
+	case "least-conn":
+		return leastConnections(backends)
+	case "weighted":
+		return p.weighted(backends)
+	case "random":
+		/* #nosec */
+		return backends[rand.Intn(len(backends))]
+	}
+	idx := atomic.AddUint64(&p.counter, 1)
+	return backends[(idx-1)%uint64(len(backends))]
+}
+
+// helper function to find backend with least number of connections
+func leastConnections(backends []*Backend) *Backend {
+	backend := backends[0]
+	for _, b := range backends[1:] {
+		if b.Connections() < backend.Connections() {
+			backend = b
+		}
+	}
+	return backend
+}
+
+// helper function to implement smooth weighted round-robin, see
+// https://github.com/phusion/nginx/commit/27e94984486058d73157038f7950a0a36ecc6e35
+func (p *BackendPool) weighted(backends []*Backend) *Backend {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var best *Backend
+	total := 0
+	for _, b := range backends {
+		b.current += b.Weight
+		total += b.Weight
+		if best == nil || b.current > best.current {
+			best = b
+		}
+	}
+	best.current -= total
+	return best
+}
+
+// Start starts active health checks of the pool backends
+func (p *BackendPool) Start() {
+	if p.HealthCheck.Path == "" || p.stop != nil {
+		return
+	}
+	p.stop = make(chan struct{})
+	go p.healthChecks(p.stop)
+}
+
+// Stop stops active health checks of the pool backends
+func (p *BackendPool) Stop() {
+	if p.stop != nil {
+		close(p.stop)
+		p.stop = nil
+	}
+}
+
+// helper function to periodically check health of pool backends
+// should be run as goroutine
+func (p *BackendPool) healthChecks(stop chan struct{}) {
+	interval := p.HealthCheck.Interval
+	if interval == 0 {
+		interval = defaultHealthInterval
+	}
+	ticker := time.NewTicker(time.Duration(interval) * time.Second)
+	defer ticker.Stop()
+	for {
+		for _, b := range p.Backends {
+			p.check(b)
+		}
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// helper function to perform health check of given backend
+func (p *BackendPool) check(b *Backend) {
+	timeout := p.HealthCheck.Timeout
+	if timeout == 0 {
+		timeout = defaultHealthTimeout
+	}
+	healthy := p.HealthCheck.HealthyThreshold
+	if healthy == 0 {
+		healthy = defaultHealthyThreshold
+	}
+	unhealthy := p.HealthCheck.UnhealthyThreshold
+	if unhealthy == 0 {
+		unhealthy = defaultUnhealthyThreshold
+	}
+	hurl := fmt.Sprintf("%s%s", strings.TrimSuffix(b.URL.String(), "/"), p.HealthCheck.Path)
+	client := http.Client{Timeout: time.Duration(timeout) * time.Second}
+	resp, err := client.Get(hurl)
+	if err == nil {
+		resp.Body.Close()
+		if resp.StatusCode >= http.StatusInternalServerError {
+			err = fmt.Errorf("health check status %s", resp.Status)
+		}
+	}
+	if err != nil {
+		b.successes = 0
+		b.failures++
+		if b.failures >= unhealthy && atomic.CompareAndSwapInt32(&b.alive, 1, 0) {
+			log.Printf("backend %s is down after %d failed health checks, error %v\n", b, b.failures, err)
+		}
+		return
+	}
+	b.failures = 0
+	b.successes++
+	if b.successes >= healthy && atomic.CompareAndSwapInt32(&b.alive, 0, 1) {
+		log.Printf("backend %s is up after %d successful health checks\n", b, b.successes)
+	}
+}
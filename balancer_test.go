@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Test_roundRobin function
+func Test_roundRobin(t *testing.T) {
+	rec := Ingress{Path: "/path", ServiceURL: "http://a:8080, http://b:8080"}
+	pool, err := newBackendPool(rec, nil)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, len(pool.Backends), 2)
+	assert.Equal(t, pool.Next().String(), "http://a:8080")
+	assert.Equal(t, pool.Next().String(), "http://b:8080")
+	assert.Equal(t, pool.Next().String(), "http://a:8080")
+
+	// empty entries of service urls are skipped
+	rec.ServiceURL = "http://a:8080, http://b:8080,"
+	pool, err = newBackendPool(rec, nil)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, len(pool.Backends), 2)
+	rec.ServiceURL = " , "
+	_, err = newBackendPool(rec, nil)
+	assert.NotEqual(t, err, nil)
+}
+
+// Test_weighted function
+func Test_weighted(t *testing.T) {
+	rec := Ingress{Path: "/path", ServiceURL: "http://a,http://b", Strategy: "weighted", Weights: []int{3, 1}}
+	pool, err := newBackendPool(rec, nil)
+	assert.Equal(t, err, nil)
+	counts := make(map[string]int)
+	for i := 0; i < 8; i++ {
+		counts[pool.Next().String()]++
+	}
+	assert.Equal(t, counts["http://a"], 6)
+	assert.Equal(t, counts["http://b"], 2)
+
+	// number of weights should match number of urls
+	rec.Weights = []int{1}
+	_, err = newBackendPool(rec, nil)
+	assert.NotEqual(t, err, nil)
+}
+
+// Test_leastConnections function
+func Test_leastConnections(t *testing.T) {
+	rec := Ingress{Path: "/path", ServiceURL: "http://a,http://b", Strategy: "least-conn"}
+	pool, err := newBackendPool(rec, nil)
+	assert.Equal(t, err, nil)
+	pool.Backends[0].connections = 5
+	assert.Equal(t, pool.Next().String(), "http://b")
+}
+
+// Test_passiveEjection function
+func Test_passiveEjection(t *testing.T) {
+	rec := Ingress{Path: "/path", ServiceURL: "http://a,http://b", MaxFails: 2}
+	pool, err := newBackendPool(rec, nil)
+	assert.Equal(t, err, nil)
+	backend := pool.Backends[0]
+	backend.failure()
+	assert.Equal(t, backend.Alive(), true)
+	backend.failure()
+	assert.Equal(t, backend.Alive(), false)
+	for i := 0; i < 4; i++ {
+		assert.Equal(t, pool.Next().String(), "http://b")
+	}
+
+	// if all backends are ejected we still use them
+	pool.Backends[1].failure()
+	pool.Backends[1].failure()
+	assert.NotEqual(t, pool.Next(), nil)
+}
+
+// Test_cancelledRequest function
+func Test_cancelledRequest(t *testing.T) {
+	rec := Ingress{Path: "/path", ServiceURL: "http://a,http://b", MaxFails: 1}
+	pool, err := newBackendPool(rec, nil)
+	assert.Equal(t, err, nil)
+	backend := pool.Backends[0]
+
+	// request cancelled by client does not eject the backend
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	r := httptest.NewRequest("GET", "/path", nil).WithContext(ctx)
+	backend.proxy.ServeHTTP(httptest.NewRecorder(), r)
+	assert.Equal(t, backend.Alive(), true)
+}
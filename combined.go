@@ -0,0 +1,234 @@
+package main
+
+// combined module provides reverse proxy which accepts either x509
+// certificates or tokens on the same port
+//
+// Copyright (c) 2020 - Valentin Kuznetsov <vkuznet@gmail.com>
+//
+
+/*
+The combined server requests client certificates optionally and
+authenticates every request by trying the following methods in order
+defined by auth_order configuration parameter:
+- x509      client certificate of TLS connection
+- bearer    OAuth access token provided via Authorization header
+- scitokens scitoken issued by this server provided via Authorization header
+The first successful method sets CMS headers of the request and is recorded
+in Cms-Authn-Method header (X509Cert, BearerToken or SciToken) and auth
+protocol of log records. This mimics the behavior of apache frontend.
+*/
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// defaultAuthOrder defines default order of authentication methods
+var defaultAuthOrder = []string{"x509", "bearer", "scitokens"}
+
+// authentication methods reported via Cms-Authn-Method header
+const (
+	x509AuthMethod      = "X509Cert"
+	bearerAuthMethod    = "BearerToken"
+	scitokensAuthMethod = "SciToken"
+)
+
+// helper function to get order of authentication methods
+func authOrder() []string {
+	if len(Config().AuthOrder) > 0 {
+		return Config().AuthOrder
+	}
+	return defaultAuthOrder
+}
+
+// helper function to remove CMS headers from HTTP request, the CMS headers
+// are set by the server and should not be provided by clients
+func clearCMSHeaders(r *http.Request) {
+	for key := range r.Header {
+		if strings.HasPrefix(strings.ToLower(key), "cms-") {
+			r.Header.Del(key)
+		}
+	}
+}
+
+// helper function to authenticate user via client certificate
+func x509Auth(r *http.Request) (map[string]interface{}, error) {
+	userData := getUserData(r)
+	if _, ok := userData["name"]; !ok {
+		return userData, errors.New("no client certificate or user not found in CRIC DB")
+	}
+	CMSAuth().SetCMSHeaders(r, userData, CricRecordsByLogin, Config().Verbose > 3)
+	if r.Header.Get("Cms-Auth-Cert") == "" {
+		if dn, ok := userData["dn"]; ok {
+			r.Header.Set("Cms-Auth-Cert", dn.(string))
+		}
+	}
+	if !CMSAuth().CheckAuthnAuthz(r.Header) {
+		return userData, errors.New("unable to validate CMS headers")
+	}
+	return userData, nil
+}
+
+// helper function to authenticate user via OAuth bearer token
+func bearerAuth(r *http.Request) (map[string]interface{}, error) {
+	userData := make(map[string]interface{})
+	if getToken(r) == "" {
+		return userData, errors.New("no token present in HTTP request")
+	}
+	attrs, err := checkAccessToken(r)
+	if err != nil {
+		return userData, err
+	}
+	userData["email"] = attrs.Email
+	userData["name"] = attrs.UserName
+	userData["exp"] = attrs.Expiration
+	userData["id"] = attrs.ClientID
+	CMSAuth().SetCMSHeadersByKey(r, userData, CricRecordsByID, "id", bearerAuthMethod, Config().Verbose > 3)
+	if r.Header.Get("Cms-Authn-Login") == "" || r.Header.Get("Cms-Auth-Cert") == "" {
+		msg := fmt.Sprintf("user with id '%v' not found in CRIC DB", attrs.ClientID)
+		return userData, errors.New(msg)
+	}
+	cricUserData(userData, CricRecordsByID, attrs.ClientID)
+	return userData, nil
+}
+
+// helper function to authenticate user via scitoken
+func scitokensAuth(w http.ResponseWriter, r *http.Request) (map[string]interface{}, error) {
+	userData := make(map[string]interface{})
+	if getToken(r) == "" {
+		return userData, errors.New("no token present in HTTP request")
+	}
+	if publicKey == nil {
+		return userData, errors.New("scitokens keys are not configured")
+	}
+	jwtClaims, err := validateJWT(w, r)
+	if err != nil {
+		return userData, err
+	}
+	claims, ok := jwtClaims.(*ScitokensClaims)
+	if !ok {
+		return userData, errors.New("invalid scitoken claims")
+	}
+	rec, ok := CricRecordsByLogin[claims.Subject]
+	if !ok {
+		msg := fmt.Sprintf("user '%s' not found in CRIC DB", claims.Subject)
+		return userData, errors.New(msg)
+	}
+	userData["name"] = rec.Name
+	userData["exp"] = claims.ExpiresAt
+	cricUserData(userData, CricRecordsByLogin, claims.Subject)
+	r.Header.Set("scope", claims.Scope)
+	CMSAuth().SetCMSHeadersByKey(r, userData, CricRecordsByLogin, "cern_upn", scitokensAuthMethod, Config().Verbose > 3)
+	return userData, nil
+}
+
+// helper function to authenticate user using authentication methods in
+// configured order, it returns user data and successful method
+func combinedAuth(w http.ResponseWriter, r *http.Request) (map[string]interface{}, string, error) {
+	var msgs []string
+	for _, method := range authOrder() {
+		var userData map[string]interface{}
+		var err error
+		switch method {
+		case "x509":
+			userData, err = x509Auth(r)
+		case "bearer":
+			userData, err = bearerAuth(r)
+		case "scitokens":
+			userData, err = scitokensAuth(w, r)
+		default:
+			err = fmt.Errorf("unsupported authentication method")
+		}
+		if err == nil {
+			return userData, method, nil
+		}
+		if Config().Verbose > 0 {
+			log.Printf("%s authentication failed, %v\n", method, err)
+		}
+		msgs = append(msgs, fmt.Sprintf("%s: %v", method, err))
+		// remove CMS headers of failed authentication method
+		clearCMSHeaders(r)
+	}
+	msg := fmt.Sprintf("unable to authenticate user, %s", strings.Join(msgs, "; "))
+	return nil, "", errors.New(msg)
+}
+
+// combinedRequestHandler handle requests of clients with either x509
+// certificates or tokens
+func combinedRequestHandler(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	defer getRPS(start)
+
+	status := http.StatusOK
+	tstamp := int64(start.UnixNano() / 1000000) // use milliseconds for MONIT
+	clearCMSHeaders(r)
+	// add logRequest after we set cms headers in HTTP request, the
+	// authentication method is taken from Cms-Authn-Method header
+	defer logRequest(w, r, start, "", &status, tstamp)
+
+	userData, method, err := combinedAuth(w, r)
+	if err != nil {
+		log.Printf("unauthorized access to %s, %v\n", r.URL.Path, err)
+		status = http.StatusUnauthorized
+		http.Error(w, err.Error(), status)
+		return
+	}
+	// increment GET/POST counters
+	if method == "x509" {
+		if r.Method == "GET" {
+			atomic.AddUint64(&TotalX509GetRequests, 1)
+		}
+		if r.Method == "POST" {
+			atomic.AddUint64(&TotalX509PostRequests, 1)
+		}
+	} else {
+		if r.Method == "GET" {
+			atomic.AddUint64(&TotalOAuthGetRequests, 1)
+		}
+		if r.Method == "POST" {
+			atomic.AddUint64(&TotalOAuthPostRequests, 1)
+		}
+	}
+	if Config().Verbose > 0 {
+		printHTTPRequest(r, fmt.Sprintf("cms headers of %s authentication", method))
+	}
+
+	// check authorization policy of ingress rule
+	if err := checkIngressPolicy(r, userData); err != nil {
+		log.Printf("forbidden access to %s, %v\n", r.URL.Path, err)
+		status = http.StatusForbidden
+		w.WriteHeader(status)
+		return
+	}
+	redirect(w, r)
+}
+
+// helper function to setup HTTP handlers of combined proxy server
+func combinedServeMux() *http.ServeMux {
+	// scitokens keys are used to validate scitokens issued by this server
+	if InList("scitokens", authOrder()) && Config().Scitokens.PrivateKey != "" {
+		if err := initScitokensKeys(); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	mux := http.NewServeMux()
+
+	// metrics handler
+	mux.HandleFunc(fmt.Sprintf("%s/metrics", Config().Base), metricsHandler)
+
+	// the server settings handler
+	mux.HandleFunc(fmt.Sprintf("%s/server", Config().Base), settingsHandler)
+
+	// JWKS of internal tokens passed to backends
+	internalTokenServeMux(mux)
+
+	// the request handler
+	mux.HandleFunc("/", combinedRequestHandler)
+	return mux
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"fmt"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/dmwm/cmsauth"
+	"github.com/stretchr/testify/assert"
+)
+
+// Test_combinedAuth function
+func Test_combinedAuth(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.Equal(t, err, nil)
+	privateKey = key
+	publicKey = &privateKey.PublicKey
+	defer func() {
+		privateKey = nil
+		publicKey = nil
+		Config().AuthOrder = nil
+	}()
+	rec := cmsauth.CricEntry{Login: "name", Name: "First Last", DN: "/CN=First Last", ID: 1}
+	CricRecordsByLogin = cmsauth.CricRecords{"name": rec}
+
+	// client without certificate and token is not authenticated
+	Config().AuthOrder = []string{"x509", "scitokens"}
+	r := httptest.NewRequest("GET", "/dbs", nil)
+	_, _, err = combinedAuth(httptest.NewRecorder(), r)
+	assert.NotEqual(t, err, nil)
+
+	// client with scitoken is authenticated via scitokens method
+	token, err := getSciToken("issuer", "", "jti", "name", "read:/dbs")
+	assert.Equal(t, err, nil)
+	r = httptest.NewRequest("GET", "/dbs", nil)
+	r.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
+	r.Header.Set("Cms-Authz-Admin", "group:injected")
+	clearCMSHeaders(r)
+	userData, method, err := combinedAuth(httptest.NewRecorder(), r)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, method, "scitokens")
+	assert.Equal(t, userData["cern_upn"], "name")
+	assert.Equal(t, r.Header.Get("Cms-Authn-Method"), scitokensAuthMethod)
+	assert.Equal(t, r.Header.Get("Cms-Authn-Login"), "name")
+	assert.Equal(t, r.Header.Get("Cms-Authz-Admin"), "")
+
+	// scitokens method is not used if it is not listed in auth order
+	Config().AuthOrder = []string{"x509"}
+	_, _, err = combinedAuth(httptest.NewRecorder(), r)
+	assert.NotEqual(t, err, nil)
+}
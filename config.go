@@ -6,45 +6,848 @@ package main
 //
 
 import (
+	"bytes"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io/ioutil"
 	"log"
+	"net/url"
+	"os"
 	"path/filepath"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
 )
 
-// Config variable represents configuration object
-var Config Configuration
+// Config function provides current configuration of the server, the
+// configuration is replaced as a whole on reload and should not be modified
+func Config() *Configuration {
+	return currentState().Config
+}
 
-// helper function to parse server configuration file
-func parseConfig(configFile string) error {
+// helper function to load server configuration from given file
+func loadConfig(configFile string) (Configuration, error) {
+	var cfg Configuration
 	data, err := ioutil.ReadFile(filepath.Clean(configFile))
 	if err != nil {
 		log.Println("Unable to read", err)
-		return err
+		return cfg, err
 	}
-	err = json.Unmarshal(data, &Config)
+	// convert YAML and TOML configuration into JSON
+	data, err = configJSON(configFile, data)
 	if err != nil {
 		log.Println("Unable to parse", err)
-		return err
+		return cfg, err
+	}
+	// decode configuration and reject unknown keys
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	err = decoder.Decode(&cfg)
+	if err != nil {
+		log.Println("Unable to parse", err)
+		return cfg, err
+	}
+	// override configuration from environment and read secret files
+	err = envConfig(&cfg)
+	if err != nil {
+		log.Println("Unable to apply environment", err)
+		return cfg, err
 	}
-	if Config.ClientID == "" {
-		log.Fatal("No ClientID found in configuration file")
+	err = resolveSecrets(&cfg)
+	if err != nil {
+		log.Println("Unable to read secrets", err)
+		return cfg, err
 	}
-	if Config.ClientSecret == "" {
-		log.Fatal("No ClientSecret found in configuration file")
+	err = validateConfig(cfg)
+	if err != nil {
+		return cfg, err
 	}
 	// default values
-	if Config.Port == 0 {
-		Config.Port = 8181
+	if cfg.Port == 0 {
+		cfg.Port = 8181
+	}
+	if cfg.OAuthURL == "" {
+		cfg.OAuthURL = "https://auth.cern.ch/auth/realms/cern"
+	}
+	if cfg.ReadTimeout == 0 {
+		cfg.ReadTimeout = 300
+	}
+	if cfg.WriteTimeout == 0 {
+		cfg.WriteTimeout = 300
+	}
+	if cfg.ShutdownTimeout == 0 {
+		cfg.ShutdownTimeout = cfg.WriteTimeout
+	}
+	if cfg.Session.TTL == 0 {
+		cfg.Session.TTL = defaultSessionTTL
+	}
+	if cfg.Session.Cookie == "" {
+		cfg.Session.Cookie = defaultSessionCookie
+	}
+	if cfg.TokenCache.Size == 0 {
+		cfg.TokenCache.Size = defaultTokenCacheSize
+	}
+	if cfg.TokenCache.NegativeTTL == 0 {
+		cfg.TokenCache.NegativeTTL = defaultTokenCacheNegativeTTL
+	}
+	if cfg.TokenExchange.Lifetime == 0 {
+		cfg.TokenExchange.Lifetime = defaultExchangeLifetime
+	}
+	if cfg.InternalToken.Header == "" {
+		cfg.InternalToken.Header = defaultInternalTokenHeader
+	}
+	if cfg.InternalToken.Lifetime == 0 {
+		cfg.InternalToken.Lifetime = defaultInternalTokenLifetime
+	}
+	if cfg.CricMaxDrop == 0 {
+		cfg.CricMaxDrop = defaultCricMaxDrop
+	}
+	return cfg, nil
+}
+
+// helper function to parse server configuration file
+func parseConfig(configFile string) error {
+	cfg, err := loadConfig(configFile)
+	if err != nil {
+		return err
+	}
+	updateState(func(st *serverState) {
+		st.Config = &cfg
+	})
+	return nil
+}
+
+// helper function to get configuration format from file extension
+func configFormat(configFile string) string {
+	switch strings.ToLower(filepath.Ext(configFile)) {
+	case ".yaml", ".yml":
+		return "yaml"
+	case ".toml":
+		return "toml"
+	}
+	return "json"
+}
+
+// helper function to convert configuration data of given file into JSON,
+// the YAML and TOML configurations use the same keys as JSON one and
+// therefore are mapped onto the same Configuration struct
+func configJSON(configFile string, data []byte) ([]byte, error) {
+	var rec interface{}
+	switch configFormat(configFile) {
+	case "yaml":
+		if err := yaml.Unmarshal(data, &rec); err != nil {
+			return nil, err
+		}
+	case "toml":
+		var m map[string]interface{}
+		if err := toml.Unmarshal(data, &m); err != nil {
+			return nil, err
+		}
+		rec = m
+	default:
+		return data, nil
+	}
+	rec, err := jsonValue(rec)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(rec)
+}
+
+// helper function to convert decoded YAML/TOML value into value which can
+// be encoded to JSON, e.g. YAML maps with non-string keys
+func jsonValue(val interface{}) (interface{}, error) {
+	switch v := val.(type) {
+	case map[string]interface{}:
+		for key, item := range v {
+			item, err := jsonValue(item)
+			if err != nil {
+				return nil, err
+			}
+			v[key] = item
+		}
+		return v, nil
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{})
+		for key, item := range v {
+			item, err := jsonValue(item)
+			if err != nil {
+				return nil, err
+			}
+			m[fmt.Sprintf("%v", key)] = item
+		}
+		return m, nil
+	case []map[string]interface{}:
+		var arr []interface{}
+		for _, item := range v {
+			arr = append(arr, item)
+		}
+		return jsonValue(arr)
+	case []interface{}:
+		for idx, item := range v {
+			item, err := jsonValue(item)
+			if err != nil {
+				return nil, err
+			}
+			v[idx] = item
+		}
+		return v, nil
+	}
+	return val, nil
+}
+
+// redacted represents value of secrets in configuration dump
+const redacted = "***"
+
+// helper function to dump configuration in given format (json, yaml or
+// toml) with secrets redacted
+func dumpConfig(cfg Configuration, format string) ([]byte, error) {
+	if cfg.ClientSecret != "" {
+		cfg.ClientSecret = redacted
+	}
+	if cfg.Scitokens.Secret != "" {
+		cfg.Scitokens.Secret = redacted
+	}
+	if cfg.Session.Secret != "" {
+		cfg.Session.Secret = redacted
+	}
+	// copy login providers and old secrets to not modify secrets of given
+	// configuration
+	var logins []LoginProvider
+	for _, rec := range cfg.LoginProviders {
+		if rec.ClientSecret != "" {
+			rec.ClientSecret = redacted
+		}
+		logins = append(logins, rec)
+	}
+	cfg.LoginProviders = logins
+	var oldSecrets []string
+	for range cfg.Session.OldSecrets {
+		oldSecrets = append(oldSecrets, redacted)
+	}
+	cfg.Session.OldSecrets = oldSecrets
+	data, err := json.Marshal(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if format == "json" {
+		var out bytes.Buffer
+		err = json.Indent(&out, data, "", "    ")
+		return out.Bytes(), err
+	}
+	// decode configuration into generic map to preserve JSON keys
+	var rec map[string]interface{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(&rec); err != nil {
+		return nil, err
+	}
+	switch format {
+	case "yaml":
+		return yaml.Marshal(dumpValue(rec))
+	case "toml":
+		var out bytes.Buffer
+		err = toml.NewEncoder(&out).Encode(dumpValue(rec))
+		return out.Bytes(), err
+	}
+	msg := fmt.Sprintf("unsupported configuration format '%s', should be one of json, yaml, toml", format)
+	return nil, errors.New(msg)
+}
+
+// helper function to convert JSON numbers of generic value into integers
+// or floats and drop null values which are not supported by TOML
+func dumpValue(val interface{}) interface{} {
+	switch v := val.(type) {
+	case map[string]interface{}:
+		for key, item := range v {
+			if item == nil {
+				delete(v, key)
+				continue
+			}
+			v[key] = dumpValue(item)
+		}
+	case []interface{}:
+		for idx, item := range v {
+			v[idx] = dumpValue(item)
+		}
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i
+		}
+		f, _ := v.Float64()
+		return f
+	}
+	return val
+}
+
+// envPrefix defines prefix of environment variables which override
+// configuration parameters
+const envPrefix = "AUTH_PROXY"
+
+// loginNamePattern defines allowed names of login providers
+var loginNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// secretPrefix defines prefix of secret values which refer to a file
+const secretPrefix = "file:"
+
+// helper function to construct environment variable name from json key,
+// e.g. client_secret => AUTH_PROXY_CLIENT_SECRET
+func envName(prefix, key string) string {
+	name := strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			return unicode.ToUpper(r)
+		}
+		return '_'
+	}, key)
+	return fmt.Sprintf("%s_%s", prefix, name)
+}
+
+// helper function to get json key of struct field
+func jsonKey(field reflect.StructField) string {
+	return strings.Split(field.Tag.Get("json"), ",")[0]
+}
+
+// EnvVar represents environment variable which overrides configuration parameter
+type EnvVar struct {
+	Name string // name of environment variable
+	Key  string // configuration key
+	Type string // type of the value
+}
+
+// helper function to list environment variables of given configuration
+// struct type
+func envVars(prefix, keyPrefix string, rtype reflect.Type) []EnvVar {
+	var envs []EnvVar
+	for i := 0; i < rtype.NumField(); i++ {
+		field := rtype.Field(i)
+		key := jsonKey(field)
+		if key == "" || key == "-" {
+			continue
+		}
+		name := envName(prefix, key)
+		if field.Type.Kind() == reflect.Struct {
+			envs = append(envs, envVars(name, keyPrefix+key+".", field.Type)...)
+			continue
+		}
+		vtype := field.Type.Kind().String()
+		switch field.Type.Kind() {
+		case reflect.Slice:
+			if k := field.Type.Elem().Kind(); k == reflect.String || k == reflect.Int {
+				vtype = fmt.Sprintf("comma separated list of %s", k)
+			} else {
+				vtype = "JSON"
+			}
+		case reflect.Map:
+			vtype = "JSON"
+		}
+		envs = append(envs, EnvVar{Name: name, Key: keyPrefix + key, Type: vtype})
+	}
+	return envs
+}
+
+// helper function to set value from given string
+func setValue(val reflect.Value, str string) error {
+	switch val.Kind() {
+	case reflect.String:
+		val.SetString(str)
+	case reflect.Int, reflect.Int64:
+		v, err := strconv.ParseInt(str, 10, 64)
+		if err != nil {
+			return err
+		}
+		val.SetInt(v)
+	case reflect.Bool:
+		v, err := strconv.ParseBool(str)
+		if err != nil {
+			return err
+		}
+		val.SetBool(v)
+	case reflect.Slice:
+		kind := val.Type().Elem().Kind()
+		if kind != reflect.String && kind != reflect.Int {
+			return json.Unmarshal([]byte(str), val.Addr().Interface())
+		}
+		arr := strings.Split(str, ",")
+		slice := reflect.MakeSlice(val.Type(), len(arr), len(arr))
+		for i, s := range arr {
+			if err := setValue(slice.Index(i), strings.Trim(s, " ")); err != nil {
+				return err
+			}
+		}
+		val.Set(slice)
+	default:
+		return json.Unmarshal([]byte(str), val.Addr().Interface())
+	}
+	return nil
+}
+
+// helper function to override configuration struct values from environment
+func envOverride(prefix string, val reflect.Value) error {
+	rtype := val.Type()
+	for i := 0; i < rtype.NumField(); i++ {
+		field := rtype.Field(i)
+		key := jsonKey(field)
+		if key == "" || key == "-" {
+			continue
+		}
+		name := envName(prefix, key)
+		if field.Type.Kind() == reflect.Struct {
+			if err := envOverride(name, val.Field(i)); err != nil {
+				return err
+			}
+			continue
+		}
+		str, ok := os.LookupEnv(name)
+		if !ok {
+			continue
+		}
+		if err := setValue(val.Field(i), str); err != nil {
+			return fmt.Errorf("invalid value of %s, %v", name, err)
+		}
+		if Config().Verbose > 0 {
+			log.Printf("override %s from %s environment variable\n", key, name)
+		}
+	}
+	return nil
+}
+
+// helper function to override configuration from environment variables,
+// every configuration parameter can be set via AUTH_PROXY_<KEY> variable,
+// e.g. AUTH_PROXY_CLIENT_SECRET or AUTH_PROXY_SCITOKENS_SECRET for nested
+// keys, see envVars function for complete list
+func envConfig(cfg *Configuration) error {
+	return envOverride(envPrefix, reflect.ValueOf(cfg).Elem())
+}
+
+// helper function to read secret value, the secret can be either provided
+// as is or as a reference to a file, e.g. file:/etc/secrets/client_secret
+func readSecret(secret string) (string, error) {
+	if !strings.HasPrefix(secret, secretPrefix) {
+		return secret, nil
+	}
+	fname := strings.TrimPrefix(secret, secretPrefix)
+	data, err := ioutil.ReadFile(filepath.Clean(fname))
+	if err != nil {
+		return "", err
 	}
-	if Config.OAuthURL == "" {
-		Config.OAuthURL = "https://auth.cern.ch/auth/realms/cern"
+	return strings.TrimSpace(string(data)), nil
+}
+
+// helper function to resolve secrets of the configuration
+func resolveSecrets(cfg *Configuration) error {
+	var err error
+	cfg.ClientSecret, err = readSecret(cfg.ClientSecret)
+	if err != nil {
+		return fmt.Errorf("client_secret: %v", err)
+	}
+	cfg.Scitokens.Secret, err = readSecret(cfg.Scitokens.Secret)
+	if err != nil {
+		return fmt.Errorf("scitokens.secret: %v", err)
+	}
+	cfg.Session.Secret, err = readSecret(cfg.Session.Secret)
+	if err != nil {
+		return fmt.Errorf("session.secret: %v", err)
+	}
+	for idx := range cfg.LoginProviders {
+		rec := &cfg.LoginProviders[idx]
+		rec.ClientSecret, err = readSecret(rec.ClientSecret)
+		if err != nil {
+			return fmt.Errorf("login_providers[%d].client_secret: %v", idx, err)
+		}
+	}
+	for idx, secret := range cfg.Session.OldSecrets {
+		cfg.Session.OldSecrets[idx], err = readSecret(secret)
+		if err != nil {
+			return fmt.Errorf("session.old_secrets[%d]: %v", idx, err)
+		}
+	}
+	// hmac is already a file which is read by CMSAuth,
+	// therefore we only strip the file prefix
+	cfg.Hmac = strings.TrimPrefix(cfg.Hmac, secretPrefix)
+	return nil
+}
+
+// helper function to convert TLS version string into TLS version
+// see go doc tls.VersionTLS13 for different versions
+func tlsVersion(ver string) (uint16, error) {
+	switch ver {
+	case "":
+		return 0, nil
+	case "tls10":
+		return tls.VersionTLS10, nil
+	case "tls11":
+		return tls.VersionTLS11, nil
+	case "tls12":
+		return tls.VersionTLS12, nil
+	case "tls13":
+		return tls.VersionTLS13, nil
+	}
+	msg := fmt.Sprintf("unsupported TLS version '%s', should be one of tls10, tls11, tls12, tls13", ver)
+	return 0, errors.New(msg)
+}
+
+// helper function to validate given url
+func validateURL(key, rurl string) error {
+	u, err := url.Parse(rurl)
+	if err != nil {
+		return fmt.Errorf("%s: invalid url '%s', %v", key, rurl, err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("%s: url '%s' should have http or https scheme", key, rurl)
+	}
+	if u.Host == "" {
+		return fmt.Errorf("%s: url '%s' has no host", key, rurl)
+	}
+	return nil
+}
+
+// helper function to validate given file or directory path
+func validatePath(key, fname string, dir bool) error {
+	fi, err := os.Stat(filepath.Clean(fname))
+	if err != nil {
+		return fmt.Errorf("%s: %v", key, err)
 	}
-	if Config.ReadTimeout == 0 {
-		Config.ReadTimeout = 300
+	if dir && !fi.IsDir() {
+		return fmt.Errorf("%s: '%s' is not a directory", key, fname)
 	}
-	if Config.WriteTimeout == 0 {
-		Config.WriteTimeout = 300
+	if !dir && fi.IsDir() {
+		return fmt.Errorf("%s: '%s' is a directory", key, fname)
 	}
 	return nil
 }
+
+// helper function to validate ingress rule
+func validateIngress(key string, rec Ingress) []error {
+	var errs []error
+	if rec.Path == "" {
+		errs = append(errs, fmt.Errorf("%s: empty path", key))
+	}
+	if rec.ServiceURL == "" {
+		errs = append(errs, fmt.Errorf("%s: empty service_url", key))
+	}
+	for _, surl := range strings.Split(rec.ServiceURL, ",") {
+		if surl = strings.Trim(surl, " "); surl != "" {
+			if err := validateURL(key+".service_url", surl); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	if rec.PathType == "regex" && rec.OldPath != "" {
+		errs = append(errs, fmt.Errorf("%s: old_path is not used by regex rules, use capture groups in new_path", key))
+	}
+	if rec.MaxFails < 0 || rec.FailTimeout < 0 {
+		errs = append(errs, fmt.Errorf("%s: max_fails and fail_timeout should not be negative", key))
+	}
+	hc := rec.HealthCheck
+	if hc.Interval < 0 || hc.Timeout < 0 || hc.HealthyThreshold < 0 || hc.UnhealthyThreshold < 0 {
+		errs = append(errs, fmt.Errorf("%s: health_check values should not be negative", key))
+	}
+	if hc.Path != "" && !strings.HasPrefix(hc.Path, "/") {
+		errs = append(errs, fmt.Errorf("%s: health_check path '%s' should start with /", key, hc.Path))
+	}
+	if rec.ServiceURL != "" {
+		if _, err := newBackendPool(rec, nil); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %v", key, err))
+		}
+	}
+	if _, err := newIngressRule(rec, nil); err != nil {
+		errs = append(errs, fmt.Errorf("%s: %v", key, err))
+	}
+	return errs
+}
+
+// helper function to validate list of ingress rules with given key prefix
+func validateIngressRules(prefix string, recs []Ingress) []error {
+	var errs []error
+	rules := make(map[string]int)
+	names := make(map[string]int)
+	for idx, rec := range recs {
+		errs = append(errs, validateIngress(fmt.Sprintf("%s[%d]", prefix, idx), rec)...)
+		key := fmt.Sprintf("%s%s", rec.Host, rec.Path)
+		if prev, ok := rules[key]; ok {
+			errs = append(errs, fmt.Errorf("%s[%d]: duplicate of %s[%d] with host '%s' and path '%s'", prefix, idx, prefix, prev, rec.Host, rec.Path))
+		} else {
+			rules[key] = idx
+		}
+		if rec.Name == "" {
+			continue
+		}
+		if !loginNamePattern.MatchString(rec.Name) {
+			errs = append(errs, fmt.Errorf("%s[%d].name: invalid name '%s', should contain letters, digits, - or _", prefix, idx, rec.Name))
+		}
+		if prev, ok := names[rec.Name]; ok {
+			errs = append(errs, fmt.Errorf("%s[%d].name: duplicate name '%s' of %s[%d]", prefix, idx, rec.Name, prefix, prev))
+		} else {
+			names[rec.Name] = idx
+		}
+	}
+	return errs
+}
+
+// helper function to validate server listeners
+func validateListeners(cfg Configuration) []error {
+	var errs []error
+	ports := make(map[int]int)
+	if cfg.MetricsPort > 0 {
+		ports[cfg.MetricsPort] = -1
+	}
+	var oauth int
+	for idx, l := range cfg.Listeners {
+		key := fmt.Sprintf("listeners[%d]", idx)
+		if l.Port <= 0 || l.Port > 65535 {
+			errs = append(errs, fmt.Errorf("%s: invalid port number %d", key, l.Port))
+		} else if prev, ok := ports[l.Port]; ok {
+			if prev < 0 {
+				errs = append(errs, fmt.Errorf("%s: port %d is used by metrics_port", key, l.Port))
+			} else {
+				errs = append(errs, fmt.Errorf("%s: port %d is used by listeners[%d]", key, l.Port, prev))
+			}
+		} else {
+			ports[l.Port] = idx
+		}
+		switch l.Auth {
+		case "oauth":
+			oauth++
+		case "x509", "scitokens", "combined":
+		default:
+			errs = append(errs, fmt.Errorf("%s: unsupported auth '%s', should be one of oauth, x509, scitokens, combined", key, l.Auth))
+		}
+		for _, f := range []struct{ key, fname string }{{"server_cert", l.ServerCrt}, {"server_key", l.ServerKey}} {
+			if f.fname != "" {
+				if err := validatePath(key+"."+f.key, f.fname, false); err != nil {
+					errs = append(errs, err)
+				}
+			}
+		}
+		errs = append(errs, validateIngressRules(key+".ingress", l.Ingress)...)
+	}
+	// OAuth client and its callback are shared by the server
+	if oauth > 1 {
+		errs = append(errs, fmt.Errorf("listeners: only one oauth listener is supported, found %d", oauth))
+	}
+	return errs
+}
+
+// helper function to validate server configuration, it reports all
+// found problems at once
+func validateConfig(cfg Configuration) error {
+	var errs []error
+	if cfg.ClientID == "" {
+		errs = append(errs, errors.New("client_id: no ClientID found in configuration file"))
+	}
+	if cfg.ClientSecret == "" {
+		errs = append(errs, errors.New("client_secret: no ClientSecret found in configuration file"))
+	}
+	if cfg.Port < 0 || cfg.Port > 65535 {
+		errs = append(errs, fmt.Errorf("port: invalid port number %d", cfg.Port))
+	}
+	if cfg.MetricsPort < 0 || cfg.MetricsPort > 65535 {
+		errs = append(errs, fmt.Errorf("metrics_port: invalid port number %d", cfg.MetricsPort))
+	}
+	if cfg.CricMaxDrop < 0 || cfg.CricMaxDrop > 100 {
+		errs = append(errs, fmt.Errorf("cric_max_drop: invalid percentage %v, should be within 0-100", cfg.CricMaxDrop))
+	}
+	if cfg.CricOffline && cfg.CricFile == "" {
+		errs = append(errs, errors.New("cric_offline: offline mode requires cric_file"))
+	}
+	if cfg.ReadTimeout < 0 || cfg.WriteTimeout < 0 || cfg.ShutdownTimeout < 0 {
+		errs = append(errs, errors.New("read_timeout, write_timeout and shutdown_timeout should not be negative"))
+	}
+
+	// check urls
+	urls := map[string]string{
+		"oauth_url":           cfg.OAuthURL,
+		"auth_token_url":      cfg.AuthTokenURL,
+		"redirect_url":        cfg.RedirectURL,
+		"logout_redirect_url": cfg.LogoutRedirectURL,
+		"target_url":          cfg.TargetURL,
+		"cric_url":            cfg.CricURL,
+	}
+	for _, key := range []string{"oauth_url", "auth_token_url", "redirect_url", "logout_redirect_url", "target_url", "cric_url"} {
+		if rurl := urls[key]; rurl != "" {
+			if err := validateURL(key, rurl); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	for idx, purl := range cfg.Providers {
+		if err := validateURL(fmt.Sprintf("providers[%d]", idx), purl); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	rules := make(map[string]bool)
+	for idx, rule := range cfg.ProviderRules {
+		key := fmt.Sprintf("provider_rules[%d]", idx)
+		if !InList(rule.URL, cfg.Providers) {
+			errs = append(errs, fmt.Errorf("%s.url: '%s' is not in providers list", key, rule.URL))
+		}
+		if rules[rule.URL] {
+			errs = append(errs, fmt.Errorf("%s.url: duplicate rule of provider '%s'", key, rule.URL))
+		}
+		rules[rule.URL] = true
+		for _, alg := range rule.Algs {
+			if !InList(alg, defaultTokenAlgs) {
+				errs = append(errs, fmt.Errorf("%s.algs: unsupported algorithm '%s', should be one of %s", key, alg, strings.Join(defaultTokenAlgs, ", ")))
+			}
+		}
+		if rule.Leeway < 0 {
+			errs = append(errs, fmt.Errorf("%s.leeway: clock skew should not be negative", key))
+		}
+	}
+
+	// check files and directories
+	files := []struct {
+		key   string
+		fname string
+		dir   bool
+	}{
+		{"server_cert", cfg.ServerCrt, false},
+		{"server_key", cfg.ServerKey, false},
+		{"rootCAs", cfg.RootCAs, true},
+		{"hmac", cfg.Hmac, false},
+		{"cric_file", cfg.CricFile, false},
+		{"static_page", cfg.StaticPage, false},
+		{"document_root", cfg.DocumentRoot, true},
+		{"well_known", cfg.WellKnown, true},
+		{"scitokens.rsa_key", cfg.Scitokens.PrivateKey, false},
+		{"scitokens.private_jwks", cfg.Scitokens.PrivateJWKS, false},
+		{"scitokens.public_jwks", cfg.Scitokens.PublicJWKS, false},
+	}
+	for _, f := range files {
+		if f.fname != "" {
+			if err := validatePath(f.key, f.fname, f.dir); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	if cfg.LogFile != "" {
+		if err := validatePath("log_file", filepath.Dir(cfg.LogFile), true); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	// check TLS versions
+	minVer, err := tlsVersion(cfg.MinTLSVersion)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("minTLSVersion: %v", err))
+	}
+	maxVer, err := tlsVersion(cfg.MaxTLSVersion)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("maxTLSVersion: %v", err))
+	}
+	if minVer > 0 && maxVer > 0 && minVer > maxVer {
+		errs = append(errs, fmt.Errorf("minTLSVersion %s is greater than maxTLSVersion %s", cfg.MinTLSVersion, cfg.MaxTLSVersion))
+	}
+
+	// check ingress rules
+	errs = append(errs, validateIngressRules("ingress", cfg.Ingress)...)
+
+	// check server listeners
+	errs = append(errs, validateListeners(cfg)...)
+
+	// check authentication methods of combined server
+	methods := make(map[string]bool)
+	for idx, method := range cfg.AuthOrder {
+		switch method {
+		case "x509", "bearer", "scitokens":
+		default:
+			errs = append(errs, fmt.Errorf("auth_order[%d]: unsupported authentication method '%s', should be one of x509, bearer, scitokens", idx, method))
+		}
+		if methods[method] {
+			errs = append(errs, fmt.Errorf("auth_order[%d]: duplicate authentication method '%s'", idx, method))
+		}
+		methods[method] = true
+	}
+
+	// check login providers
+	names := make(map[string]bool)
+	for idx, rec := range cfg.LoginProviders {
+		key := fmt.Sprintf("login_providers[%d]", idx)
+		if !loginNamePattern.MatchString(rec.Name) {
+			errs = append(errs, fmt.Errorf("%s: invalid name '%s', should contain only letters, digits, - or _", key, rec.Name))
+		}
+		if names[rec.Name] {
+			errs = append(errs, fmt.Errorf("%s: duplicate name '%s'", key, rec.Name))
+		}
+		names[rec.Name] = true
+		if rec.OAuthURL == "" {
+			errs = append(errs, fmt.Errorf("%s: empty oauth_url", key))
+		}
+		for _, item := range []struct{ key, rurl string }{
+			{"oauth_url", rec.OAuthURL},
+			{"redirect_url", rec.RedirectURL},
+			{"auth_token_url", rec.AuthTokenURL},
+		} {
+			if item.rurl != "" {
+				if err := validateURL(fmt.Sprintf("%s.%s", key, item.key), item.rurl); err != nil {
+					errs = append(errs, err)
+				}
+			}
+		}
+		if len(rec.Scopes) > 0 && !InList("openid", rec.Scopes) {
+			errs = append(errs, fmt.Errorf("%s.scopes: openid scope is required by OpenID Connect", key))
+		}
+	}
+
+	// check OAuth scopes
+	if len(cfg.Scopes) > 0 && !InList("openid", cfg.Scopes) {
+		errs = append(errs, errors.New("scopes: openid scope is required by OpenID Connect"))
+	}
+
+	// check session store
+	switch cfg.Session.Store {
+	case "", "memory":
+	case "file":
+		if cfg.Session.File == "" {
+			errs = append(errs, errors.New("session.file: file session store requires BoltDB file"))
+		} else if err := validatePath("session.file", filepath.Dir(cfg.Session.File), true); err != nil {
+			errs = append(errs, err)
+		}
+	case "cookie":
+		if cfg.Session.Secret == "" {
+			errs = append(errs, errors.New("session.secret: cookie session store requires secret"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("session.store: unsupported session store '%s', should be one of memory, file, cookie", cfg.Session.Store))
+	}
+	if cfg.Session.TTL < 0 {
+		errs = append(errs, errors.New("session.ttl: session lifetime should not be negative"))
+	}
+	if cfg.InternalToken.Lifetime < 0 {
+		errs = append(errs, errors.New("internal_token.lifetime: lifetime of internal tokens should not be negative"))
+	}
+	if cfg.TokenExchange.Lifetime < 0 {
+		errs = append(errs, errors.New("token_exchange.lifetime: lifetime of exchanged tokens should not be negative"))
+	}
+	if (cfg.TokenExchange.Enable || cfg.InternalToken.Enable) && cfg.Scitokens.PrivateKey == "" {
+		// otherwise every server replica signs tokens by its own random key
+		errs = append(errs, errors.New("scitokens.rsa_key: server key is required by token_exchange and internal_token"))
+	}
+	if cfg.TokenCache.NegativeTTL < 0 {
+		errs = append(errs, errors.New("token_cache.negative_ttl: lifetime of invalid tokens should not be negative"))
+	}
+
+	// check scitokens rules
+	for idx, rule := range cfg.Scitokens.Rules {
+		if !strings.HasPrefix(rule.Match, "fqan:") && !strings.HasPrefix(rule.Match, "dn:") {
+			errs = append(errs, fmt.Errorf("scitokens.rules[%d]: match '%s' should start with fqan: or dn:", idx, rule.Match))
+		}
+	}
+
+	if len(errs) == 0 {
+		return nil
+	}
+	var msgs []string
+	for _, err := range errs {
+		msgs = append(msgs, err.Error())
+	}
+	msg := fmt.Sprintf("invalid configuration, found %d problem(s):\n%s", len(errs), strings.Join(msgs, "\n"))
+	return errors.New(msg)
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// helper function to write configuration into temporary file
+func testConfigFile(t *testing.T, data string) string {
+	file, err := ioutil.TempFile("", "config*.json")
+	assert.Equal(t, err, nil)
+	defer file.Close()
+	_, err = file.WriteString(data)
+	assert.Equal(t, err, nil)
+	return file.Name()
+}
+
+// Test_loadConfig function
+func Test_loadConfig(t *testing.T) {
+	fname := testConfigFile(t, `{"client_id": "id", "client_secret": "secret",
+		"ingress": [{"path": "/dbs", "service_url": "http://dbs:8250"}]}`)
+	defer os.Remove(fname)
+	cfg, err := loadConfig(fname)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, cfg.Port, 8181)
+	assert.Equal(t, len(cfg.Ingress), 1)
+
+	// unknown keys are rejected
+	fname2 := testConfigFile(t, `{"client_id": "id", "client_secret": "secret", "prot": 8080}`)
+	defer os.Remove(fname2)
+	_, err = loadConfig(fname2)
+	assert.NotEqual(t, err, nil)
+}
+
+// Test_configFormats function
+func Test_configFormats(t *testing.T) {
+	yml := `# comments explain ingress rules
+client_id: id
+client_secret: secret
+port: 8443
+ingress:
+  # DBS reader
+  - path: /dbs
+    service_url: http://dbs1:8250,http://dbs2:8250
+    weights: [3, 1]
+    lb_strategy: weighted
+`
+	tml := `# comments explain ingress rules
+client_id = "id"
+client_secret = "secret"
+port = 8443
+
+# DBS reader
+[[ingress]]
+path = "/dbs"
+service_url = "http://dbs1:8250,http://dbs2:8250"
+weights = [3, 1]
+lb_strategy = "weighted"
+`
+	for ext, data := range map[string]string{".yaml": yml, ".toml": tml} {
+		fname := testConfigFile(t, data)
+		defer os.Remove(fname)
+		os.Rename(fname, fname+ext)
+		defer os.Remove(fname + ext)
+		cfg, err := loadConfig(fname + ext)
+		assert.Equal(t, err, nil, ext)
+		assert.Equal(t, cfg.Port, 8443)
+		assert.Equal(t, len(cfg.Ingress), 1)
+		assert.Equal(t, cfg.Ingress[0].Weights, []int{3, 1})
+
+		// dump configuration in every format and load it back
+		for _, format := range []string{"json", "yaml", "toml"} {
+			out, err := dumpConfig(cfg, format)
+			assert.Equal(t, err, nil, format)
+			dname := testConfigFile(t, string(out))
+			os.Rename(dname, dname+"."+format)
+			defer os.Remove(dname + "." + format)
+			dcfg, err := loadConfig(dname + "." + format)
+			assert.Equal(t, err, nil, format)
+			assert.Equal(t, dcfg.ClientSecret, redacted)
+			assert.Equal(t, dcfg.Ingress, cfg.Ingress, format)
+		}
+	}
+
+	// unknown keys are rejected in all formats
+	fname := testConfigFile(t, "client_id: id\nclient_secret: secret\nprot: 8080\n")
+	os.Rename(fname, fname+".yml")
+	defer os.Remove(fname + ".yml")
+	_, err := loadConfig(fname + ".yml")
+	assert.NotEqual(t, err, nil)
+}
+
+// Test_envConfig function
+func Test_envConfig(t *testing.T) {
+	secret := testConfigFile(t, "file-secret\n")
+	defer os.Remove(secret)
+	fname := testConfigFile(t, `{"client_id": "id", "client_secret": "file:`+secret+`", "port": 8080}`)
+	defer os.Remove(fname)
+	os.Setenv("AUTH_PROXY_PORT", "9090")
+	os.Setenv("AUTH_PROXY_PROVIDERS", "https://a.cern.ch, https://b.cern.ch")
+	os.Setenv("AUTH_PROXY_TRANSPORT_HTTP2", "true")
+	os.Setenv("AUTH_PROXY_SCITOKENS_SECRET", "sci-secret")
+	defer func() {
+		for _, key := range []string{"AUTH_PROXY_PORT", "AUTH_PROXY_PROVIDERS", "AUTH_PROXY_TRANSPORT_HTTP2", "AUTH_PROXY_SCITOKENS_SECRET"} {
+			os.Unsetenv(key)
+		}
+	}()
+	cfg, err := loadConfig(fname)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, cfg.Port, 9090)
+	assert.Equal(t, cfg.ClientSecret, "file-secret")
+	assert.Equal(t, cfg.Providers, []string{"https://a.cern.ch", "https://b.cern.ch"})
+	assert.Equal(t, cfg.Transport.HTTP2, true)
+	assert.Equal(t, cfg.Scitokens.Secret, "sci-secret")
+
+	// invalid values are rejected
+	os.Setenv("AUTH_PROXY_PORT", "abc")
+	_, err = loadConfig(fname)
+	assert.NotEqual(t, err, nil)
+}
+
+// Test_validateConfig function
+func Test_validateConfig(t *testing.T) {
+	cfg := Configuration{
+		MinTLSVersion: "tls14",
+		ServerCrt:     "/non/existing/file.crt",
+		Providers:     []string{"auth.cern.ch"},
+		Ingress: []Ingress{
+			{Path: "/dbs", ServiceURL: "http://dbs:8250"},
+			{Path: "/dbs", ServiceURL: "ftp://dbs:8250"},
+			{Path: "^/(", PathType: "regex", ServiceURL: "http://dbs:8250"},
+		},
+		ProviderRules: []ProviderRule{{URL: "https://cms-auth.web.cern.ch", Algs: []string{"HS256"}}},
+		TokenExchange: TokenExchangeConfig{Enable: true},
+	}
+	err := validateConfig(cfg)
+	assert.NotEqual(t, err, nil)
+	msg := err.Error()
+	for _, key := range []string{"client_id", "client_secret", "minTLSVersion", "server_cert", "providers[0]", "ingress[1]: duplicate", "ingress[1].service_url", "ingress[2]", "provider_rules[0].url", "provider_rules[0].algs", "scitokens.rsa_key"} {
+		assert.True(t, strings.Contains(msg, key), "missing problem "+key)
+	}
+}
+
+// Test_reloadConfig function
+func Test_reloadConfig(t *testing.T) {
+	fname := testConfigFile(t, `{"client_id": "id", "client_secret": "secret", "reload_interval": -1,
+		"ingress": [{"path": "/dbs", "service_url": "http://dbs:8250"}]}`)
+	defer os.Remove(fname)
+	err := reloadConfig(fname)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, len(currentIngress().Rules), 1)
+
+	// bad configuration keeps previous one
+	err = ioutil.WriteFile(fname, []byte(`{"client_id": "id", "ingress": []}`), 0600)
+	assert.Equal(t, err, nil)
+	err = reloadConfig(fname)
+	assert.NotEqual(t, err, nil)
+	assert.Equal(t, len(currentIngress().Rules), 1)
+	assert.Equal(t, Config().ClientSecret, "secret")
+}
@@ -1,14 +1,21 @@
 package main
 
-// cric module
+// cric module provides CMS CRIC records of the server
 //
 // Copyright (c) 2020 - Valentin Kuznetsov <vkuznet@gmail.com>
 //
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
+	"net/http"
 	"reflect"
 	"regexp"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -19,99 +26,346 @@ import (
 // CricRecords list to hold CMS CRIC entries
 var CricRecords cmsauth.CricRecords
 
+// CricRecordsByID holds CMS CRIC entries keyed by CERN person id
+var CricRecordsByID cmsauth.CricRecords
+
+// CricRecordsByLogin holds CMS CRIC entries keyed by user login
+var CricRecordsByLogin cmsauth.CricRecords
+
 // cmsRecords holds map of CricRecords for CMS users
 var cmsRecords cmsauth.CricRecords
 
 // cmsRecordsLock keeps lock for cmsRecords updates
 var cmsRecordsLock sync.RWMutex
 
+// cricUpdate channel triggers update of cric records
+var cricUpdate = make(chan struct{}, 1)
+
+// cricStop channel stops updates of cric records
+var cricStop = make(chan struct{})
+
+// cricStopOnce allows to stop updates of cric records only once
+var cricStopOnce sync.Once
+
 // int pattern
 var intPattern = regexp.MustCompile(`^\d+$`)
 
-// helper function to periodically update cric records
-// should be run as goroutine
-func updateCricRecords(key string) {
-	log.Println("update cric records with", key, "as a key")
+// defaultCricMaxDrop defines default percentage of CRIC users which can be
+// dropped by single update of cric records
+const defaultCricMaxDrop = 10
+
+// maxCricChanges defines number of recent updates of cric records kept by
+// the server
+const maxCricChanges = 100
+
+// CricChange represents change of CRIC user record
+type CricChange struct {
+	Login    string              `json:"login"`               // user login
+	Action   string              `json:"action"`              // change action: added, removed, dn, roles
+	OldDNs   []string            `json:"old_dns,omitempty"`   // user DNs before the change
+	NewDNs   []string            `json:"new_dns,omitempty"`   // user DNs after the change
+	OldRoles map[string][]string `json:"old_roles,omitempty"` // user roles before the change
+	NewRoles map[string][]string `json:"new_roles,omitempty"` // user roles after the change
+}
+
+// CricUpdate represents update of cric records and its changes
+type CricUpdate struct {
+	Time    int64        `json:"time"`             // time of the update
+	Source  string       `json:"source"`           // source of cric records (url or file)
+	Users   int          `json:"users"`            // number of users after the update
+	Applied bool         `json:"applied"`          // update was applied
+	Reason  string       `json:"reason,omitempty"` // reason why update was refused or forced
+	Changes []CricChange `json:"changes"`          // changes of user records
+}
+
+// cricUpdates holds recent updates of cric records
+var cricUpdates []CricUpdate
+
+// cricUpdatesLock keeps lock for cricUpdates
+var cricUpdatesLock sync.RWMutex
+
+// cricRefused holds fingerprint of users of refused update of cric records
+// and number of consecutive refreshes which returned them, it is used by
+// cric update goroutine only
+var cricRefused struct {
+	Key   string // fingerprint of refused user logins
+	Count int    // number of consecutive refreshes with the same users
+}
+
+// helper function to obtain cric records either from cric url or cric file,
+// it returns records along with their source, in offline mode the records
+// are read from cric file only
+func getCricRecords(verbose bool) (cmsauth.CricRecords, string, error) {
+	var cricRecords cmsauth.CricRecords
 	var err error
-	cricRecords := make(cmsauth.CricRecords)
-	verbose := false
-	if Config.CricVerbose > 0 {
-		verbose = true
+	var source string
+	if Config().CricURL != "" && !Config().CricOffline {
+		source = Config().CricURL
+		cricRecords, err = cmsauth.GetCricData(Config().CricURL, verbose)
+		log.Printf("obtain CRIC records from %s, %v", Config().CricURL, err)
+	} else if Config().CricFile != "" {
+		source = Config().CricFile
+		cricRecords, err = cmsauth.ParseCric(Config().CricFile, verbose)
+		log.Printf("obtain CRIC records from %s, %v", Config().CricFile, err)
+	} else {
+		err = errors.New("no cric file or cric url was provided")
 	}
-	// if cric file is given read it first, then if we have
-	// cric url we'll update it from there
-	if Config.CricFile != "" {
+	return cricRecords, source, err
+}
+
+// helper function to compare sets of DNs
+func sameDNs(old, dns []string) bool {
+	if len(old) != len(dns) {
+		return false
+	}
+	for _, dn := range dns {
+		if !InList(dn, old) {
+			return false
+		}
+	}
+	return true
+}
+
+// helper function to get changes of user records between old and new cric
+// records keyed by user login
+func cricChanges(old, records cmsauth.CricRecords) []CricChange {
+	var changes []CricChange
+	for login, rec := range records {
+		prev, ok := old[login]
+		if !ok {
+			changes = append(changes, CricChange{Login: login, Action: "added", NewDNs: rec.DNs, NewRoles: rec.Roles})
+			continue
+		}
+		if !sameDNs(prev.DNs, rec.DNs) {
+			changes = append(changes, CricChange{Login: login, Action: "dn", OldDNs: prev.DNs, NewDNs: rec.DNs})
+		}
+		if !reflect.DeepEqual(prev.Roles, rec.Roles) {
+			changes = append(changes, CricChange{Login: login, Action: "roles", OldRoles: prev.Roles, NewRoles: rec.Roles})
+		}
+	}
+	for login, rec := range old {
+		if _, ok := records[login]; !ok {
+			changes = append(changes, CricChange{Login: login, Action: "removed", OldDNs: rec.DNs, OldRoles: rec.Roles})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		if changes[i].Login == changes[j].Login {
+			return changes[i].Action < changes[j].Action
+		}
+		return changes[i].Login < changes[j].Login
+	})
+	return changes
+}
+
+// helper function to check if update of cric records drops too many users,
+// it returns reason to refuse the update
+func cricDropCheck(old, records cmsauth.CricRecords, maxDrop float64) string {
+	if len(old) == 0 || maxDrop >= 100 {
+		return ""
+	}
+	var dropped int
+	for login := range old {
+		if _, ok := records[login]; !ok {
+			dropped++
+		}
+	}
+	percent := 100 * float64(dropped) / float64(len(old))
+	if percent > maxDrop {
+		return fmt.Sprintf("update drops %d of %d users (%.1f%%), more than cric_max_drop %.1f%%", dropped, len(old), percent, maxDrop)
+	}
+	return ""
+}
+
+// helper function to get fingerprint of user logins of cric records
+func cricFingerprint(records cmsauth.CricRecords) string {
+	var logins []string
+	for login := range records {
+		logins = append(logins, login)
+	}
+	sort.Strings(logins)
+	sum := sha256.Sum256([]byte(strings.Join(logins, "\n")))
+	return hex.EncodeToString(sum[:])
+}
+
+// helper function to check if refused update of cric records was confirmed
+// by given number of consecutive refreshes with the same users, zero or
+// negative number disables confirmation, i.e. refused update is applied only
+// by explicit action of the operator
+func cricDropConfirmed(records cmsauth.CricRecords, confirm int) (int, bool) {
+	key := cricFingerprint(records)
+	if key == cricRefused.Key {
+		cricRefused.Count++
+	} else {
+		cricRefused.Key = key
+		cricRefused.Count = 1
+	}
+	return cricRefused.Count, confirm > 0 && cricRefused.Count >= confirm
+}
+
+// helper function to record update of cric records and log its changes
+func recordCricUpdate(update CricUpdate) {
+	for _, change := range update.Changes {
+		if data, err := json.Marshal(change); err == nil {
+			log.Printf("CRIC change applied=%v %s\n", update.Applied, string(data))
+		}
+	}
+	cricUpdatesLock.Lock()
+	defer cricUpdatesLock.Unlock()
+	cricUpdates = append(cricUpdates, update)
+	if len(cricUpdates) > maxCricChanges {
+		cricUpdates = cricUpdates[len(cricUpdates)-maxCricChanges:]
+	}
+}
+
+// helper function to apply cric records obtained from given source, the
+// records are not applied if they drop more than cric_max_drop percent of
+// current users unless the operator enabled cric_drop_confirm and the same
+// users are returned by cric_drop_confirm consecutive refreshes, i.e. the
+// drop is real
+func applyCricRecords(cricRecords cmsauth.CricRecords, source string) error {
+	records := cricRecordsByKey(cricRecords, "login")
+	update := CricUpdate{
+		Time:   time.Now().Unix(),
+		Source: source,
+		Users:  len(records),
+	}
+	// initial load adds all users, we do not report them individually
+	if len(CricRecordsByLogin) > 0 {
+		update.Changes = cricChanges(CricRecordsByLogin, records)
+	}
+	if reason := cricDropCheck(CricRecordsByLogin, records, Config().CricMaxDrop); reason != "" {
+		count, confirmed := cricDropConfirmed(records, Config().CricDropConfirm)
+		if !confirmed {
+			update.Reason = fmt.Sprintf("%s, refused by %d consecutive refreshes", reason, count)
+			recordCricUpdate(update)
+			msg := fmt.Sprintf("refuse CRIC records from %s, %s", source, update.Reason)
+			return errors.New(msg)
+		}
+		update.Reason = fmt.Sprintf("%s, confirmed by %d consecutive refreshes", reason, count)
+		log.Printf("accept CRIC records from %s, %s\n", source, update.Reason)
+	}
+	cricRefused.Key = ""
+	cricRefused.Count = 0
+	update.Applied = true
+	recordCricUpdate(update)
+	log.Printf("CRIC update from %s, %d users, %d changes\n", source, len(records), len(update.Changes))
+	setCricRecords(cricRecords)
+	return nil
+}
+
+// cric changes handler provides recent updates of cric records
+func cricChangesHandler(w http.ResponseWriter, r *http.Request) {
+	cricUpdatesLock.RLock()
+	data, err := json.Marshal(cricUpdates)
+	cricUpdatesLock.RUnlock()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("unable to marshal cric changes, %v", err), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
+// helper function to convert cric records into records keyed by given
+// key (id or login), the DNs of records with the same key are merged together
+func cricRecordsByKey(cricRecords cmsauth.CricRecords, key string) cmsauth.CricRecords {
+	records := make(cmsauth.CricRecords)
+	for _, rec := range cricRecords {
+		k := rec.Login
 		if key == "id" {
-			cricRecords, err = cmsauth.ParseCricByKey(Config.CricFile, "id", verbose)
-		} else {
-			cricRecords, err = cmsauth.ParseCric(Config.CricFile, verbose)
+			k = fmt.Sprintf("%d", rec.ID)
+		}
+		if r, ok := records[k]; ok {
+			for _, dn := range rec.DNs {
+				if !InList(dn, r.DNs) {
+					r.DNs = append(r.DNs, dn)
+				}
+			}
+			rec.DNs = r.DNs
+		}
+		records[k] = rec
+	}
+	return records
+}
+
+// helper function to set cric records of the server, we keep records
+// keyed by DN (or login) used by x509 front-end, records keyed by id used
+// by OAuth front-end, records keyed by login used by scitokens and records
+// keyed by user CN
+func setCricRecords(cricRecords cmsauth.CricRecords) {
+	CricRecords = cricRecords
+	CricRecordsByID = cricRecordsByKey(cricRecords, "id")
+	CricRecordsByLogin = cricRecordsByKey(cricRecords, "login")
+	keys := reflect.ValueOf(CricRecords).MapKeys()
+	log.Println("Updated CRIC records", len(keys))
+	updateCMSRecords(cricRecords)
+	log.Println("Updated cms records", len(cmsRecords))
+	if Config().Verbose > 2 {
+		for k, v := range cmsRecords {
+			log.Printf("key=%s record=%+v\n", k, v)
+		}
+	} else if Config().Verbose > 0 {
+		for k, v := range cmsRecords {
+			log.Printf("key=%s record=%+v\n", k, v)
+			break // break to avoid lots of CRIC record printous
 		}
-		log.Printf("obtain CRIC records from %s, %v", Config.CricFile, err)
+	}
+}
+
+// helper function to periodically update cric records
+// should be run as goroutine, the records are shared by all server listeners
+func updateCricRecords() {
+	// if cric file is given read it first, then if we have
+	// cric url we'll update it from there
+	if Config().CricFile != "" {
+		cricRecords, err := cmsauth.ParseCric(Config().CricFile, Config().CricVerbose > 0)
+		log.Printf("obtain CRIC records from %s, %v", Config().CricFile, err)
 		if err != nil {
 			log.Printf("Unable to update CRIC records: %v", err)
-		} else {
-			CricRecords = cricRecords
-			keys := reflect.ValueOf(CricRecords).MapKeys()
-			log.Println("Updated CRIC records", len(keys))
-			if key == "id" {
-				cmsRecords = cricRecords
-			} else {
-				updateCMSRecords(cricRecords)
-			}
-			log.Println("Updated cms records", len(cmsRecords))
+		} else if err := applyCricRecords(cricRecords, Config().CricFile); err != nil {
+			log.Printf("Unable to update CRIC records: %v", err)
 		}
 	}
 	for {
-		interval := Config.UpdateCricInterval
+		interval := Config().UpdateCricInterval
 		if interval == 0 {
 			interval = 3600
 		}
 		// parse cric records
-		if Config.CricURL != "" {
-			if key == "id" {
-				cricRecords, err = cmsauth.GetCricDataByKey(Config.CricURL, "id", verbose)
-			} else {
-				cricRecords, err = cmsauth.GetCricData(Config.CricURL, verbose)
-			}
-			log.Printf("obtain CRIC records from %s, %v", Config.CricURL, err)
-		} else if Config.CricFile != "" {
-			if key == "id" {
-				cricRecords, err = cmsauth.ParseCricByKey(Config.CricFile, "id", verbose)
-			} else {
-				cricRecords, err = cmsauth.ParseCric(Config.CricFile, verbose)
-			}
-			log.Printf("obtain CRIC records from %s, %v", Config.CricFile, err)
-		} else {
-			log.Println("Untable to get CRIC records no file or no url was provided")
-		}
+		cricRecords, source, err := getCricRecords(Config().CricVerbose > 0)
 		if err != nil {
 			log.Printf("Unable to update CRIC records: %v", err)
-		} else {
-			CricRecords = cricRecords
-			keys := reflect.ValueOf(CricRecords).MapKeys()
-			log.Println("Updated CRIC records", len(keys))
-			if key == "id" {
-				cmsRecords = cricRecords
-			} else {
-				updateCMSRecords(cricRecords)
-			}
-			log.Println("Updated cms records", len(cmsRecords))
-			if Config.Verbose > 2 {
-				for k, v := range cmsRecords {
-					log.Printf("key=%s value=%s record=%+v\n", key, k, v)
-				}
-			} else if Config.Verbose > 0 {
-				for k, v := range cmsRecords {
-					log.Printf("key=%s value=%s record=%+v\n", key, k, v)
-					break // break to avoid lots of CRIC record printous
-				}
-			}
+		} else if err := applyCricRecords(cricRecords, source); err != nil {
+			log.Printf("Unable to update CRIC records: %v", err)
 		}
 		d := time.Duration(interval) * time.Second
-		time.Sleep(d) // sleep for next iteration
+		select {
+		case <-time.After(d): // sleep for next iteration
+		case <-cricUpdate: // CRIC settings were changed
+			log.Println("CRIC settings were changed, update cric records")
+		case <-cricStop: // server is stopped
+			log.Println("stop updates of cric records")
+			return
+		}
 	}
 }
 
+// helper function to add CRIC information about the user with given key
+// into user data
+func cricUserData(userData map[string]interface{}, cricRecords cmsauth.CricRecords, key interface{}) {
+	if rec, ok := cricRecords[fmt.Sprintf("%v", key)]; ok {
+		userData["cern_upn"] = rec.Login
+		userData["dn"] = rec.DN
+		userData["dns"] = rec.DNs
+		userData["roles"] = rec.Roles
+	}
+}
+
+// helper function to stop updates of cric records
+func stopCricUpdates() {
+	cricStopOnce.Do(func() { close(cricStop) })
+}
+
 // helper function to create cmsRecords
 func updateCMSRecords(cricRecords cmsauth.CricRecords) {
 	cmsRecordsLock.Lock()
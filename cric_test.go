@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/dmwm/cmsauth"
+	"github.com/stretchr/testify/assert"
+)
+
+// helper function to create cric records of given users
+func cricUsers(logins ...string) cmsauth.CricRecords {
+	records := make(cmsauth.CricRecords)
+	for idx, login := range logins {
+		records[login] = cmsauth.CricEntry{
+			Login: login,
+			ID:    int64(idx + 1),
+			DN:    "/CN=" + login,
+			DNs:   []string{"/CN=" + login},
+			Roles: map[string][]string{"user": {"group:cms"}},
+		}
+	}
+	return records
+}
+
+// Test_cricChanges function
+func Test_cricChanges(t *testing.T) {
+	old := cricUsers("a", "b", "c")
+	records := cricUsers("a", "b", "d")
+	rec := records["a"]
+	rec.DNs = []string{"/CN=a", "/CN=a2"}
+	records["a"] = rec
+	rec = records["b"]
+	rec.Roles = map[string][]string{"admin": {"group:cms"}}
+	records["b"] = rec
+
+	changes := cricChanges(old, records)
+	var actions []string
+	for _, c := range changes {
+		actions = append(actions, c.Login+":"+c.Action)
+	}
+	assert.Equal(t, actions, []string{"a:dn", "b:roles", "c:removed", "d:added"})
+
+	// one of three users is dropped
+	assert.Equal(t, cricDropCheck(old, records, 50), "")
+	assert.NotEqual(t, cricDropCheck(old, records, 10), "")
+	assert.Equal(t, cricDropCheck(old, records, 100), "")
+	assert.Equal(t, cricDropCheck(nil, records, 10), "")
+}
+
+// Test_applyCricRecords function
+func Test_applyCricRecords(t *testing.T) {
+	Config().CricMaxDrop = defaultCricMaxDrop
+	Config().CricDropConfirm = 3
+	CricRecordsByLogin = nil
+	defer func() {
+		Config().CricMaxDrop = 0
+		Config().CricDropConfirm = 0
+		setCricRecords(cmsauth.CricRecords{})
+		cricUpdates = nil
+	}()
+
+	// initial load is always applied
+	err := applyCricRecords(cricUsers("a", "b", "c", "d"), "cric.json")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, len(CricRecordsByLogin), 4)
+
+	// update which drops too many users is refused
+	err = applyCricRecords(cricUsers("a", "b"), "cric.json")
+	assert.NotEqual(t, err, nil)
+	assert.Equal(t, len(CricRecordsByLogin), 4)
+
+	// changes are served by cric changes handler
+	w := httptest.NewRecorder()
+	cricChangesHandler(w, httptest.NewRequest("GET", "/cric/changes", nil))
+	var updates []CricUpdate
+	err = json.NewDecoder(w.Body).Decode(&updates)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, len(updates), 2)
+	assert.Equal(t, updates[0].Applied, true)
+	assert.Equal(t, updates[1].Applied, false)
+	assert.Equal(t, len(updates[1].Changes), 2)
+
+	// another drop resets confirmation of refused users
+	err = applyCricRecords(cricUsers("a"), "cric.json")
+	assert.NotEqual(t, err, nil)
+
+	// drop confirmed by consecutive refreshes with the same users is applied
+	for i := 1; i < Config().CricDropConfirm; i++ {
+		err = applyCricRecords(cricUsers("a", "b"), "cric.json")
+		assert.NotEqual(t, err, nil)
+	}
+	err = applyCricRecords(cricUsers("a", "b"), "cric.json")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, len(CricRecordsByLogin), 2)
+
+	// refused drop is not applied without confirmation option
+	Config().CricDropConfirm = 0
+	for i := 0; i < 5; i++ {
+		err = applyCricRecords(cricUsers("a"), "cric.json")
+		assert.NotEqual(t, err, nil)
+	}
+	assert.Equal(t, len(CricRecordsByLogin), 2)
+}
@@ -7,6 +7,7 @@ package main
 
 import (
 	"fmt"
+	"net/url"
 
 	"github.com/shirou/gopsutil/load"
 	"github.com/shirou/gopsutil/net"
@@ -15,48 +16,174 @@ import (
 
 // Ingress part of server configuration
 type Ingress struct {
-	Path       string `json:"path"`        // url path to the service
-	ServiceURL string `json:"service_url"` // service url
-	OldPath    string `json:"old_path"`    // path from url to be replaced with new_path
-	NewPath    string `json:"new_path"`    // path from url to replace old_path
+	Name        string      `json:"name"`         // backend name used as audience of exchanged tokens
+	Path        string      `json:"path"`         // url path to the service (prefix, exact path or regular expression)
+	PathType    string      `json:"path_type"`    // type of path matching: prefix (default), exact, regex
+	Host        string      `json:"host"`         // optional host name (or wildcard *.domain) to match
+	ServiceURL  string      `json:"service_url"`  // service url (comma separated list of urls)
+	OldPath     string      `json:"old_path"`     // path from url to be replaced with new_path
+	NewPath     string      `json:"new_path"`     // path from url to replace old_path or regex template
+	Strategy    string      `json:"lb_strategy"`  // load balancing strategy: round-robin, least-conn, weighted, random
+	Weights     []int       `json:"weights"`      // weights of service urls used by weighted strategy
+	MaxFails    int         `json:"max_fails"`    // number of consecutive failures to eject backend
+	FailTimeout int         `json:"fail_timeout"` // backend ejection time in sec
+	HealthCheck HealthCheck `json:"health_check"` // active health check configuration
+	Roles       []string    `json:"roles"`        // CRIC roles (role or role:scope) allowed to access the service
+	Groups      []string    `json:"groups"`       // CRIC groups allowed to access the service
+	Logins      []string    `json:"logins"`       // user logins allowed to access the service
+	DNs         []string    `json:"dns"`          // user DNs allowed to access the service
+}
+
+// HealthCheck represents active health check configuration of ingress backends
+type HealthCheck struct {
+	Path               string `json:"path"`                // url path to check, e.g. /healthz, empty disables checks
+	Interval           int    `json:"interval"`            // interval between checks in sec
+	Timeout            int    `json:"timeout"`             // timeout of single check in sec
+	HealthyThreshold   int    `json:"healthy_threshold"`   // consecutive successful checks to mark backend alive
+	UnhealthyThreshold int    `json:"unhealthy_threshold"` // consecutive failed checks to mark backend dead
 }
 
 // Configuration stores server configuration parameters
 type Configuration struct {
-	Port                int             `json:"port"`                   // server port number
-	MetricsPort         int             `json:"metrics_port"`           // server metrics port number
-	RootCAs             string          `json:"rootCAs"`                // server Root CAs path
-	Base                string          `json:"base"`                   // base URL
-	StaticPage          string          `json:"static_page"`            // static file to use
-	LogFile             string          `json:"log_file"`               // server log file
-	ClientID            string          `json:"client_id"`              // OICD client id
-	ClientSecret        string          `json:"client_secret"`          // OICD client secret
-	TargetURL           string          `json:"target_url"`             // proxy target url (where requests will go)
-	XForwardedHost      string          `json:"X-Forwarded-Host"`       // X-Forwarded-Host field of HTTP request
-	XContentTypeOptions string          `json:"X-Content-Type-Options"` // X-Content-Type-Options option
-	DocumentRoot        string          `json:"document_root"`          // root directory for the server
-	OAuthURL            string          `json:"oauth_url"`              // CERN SSO OAuth2 realm url
-	AuthTokenURL        string          `json:"auth_token_url"`         // CERN SSO OAuth2 OICD Token url
-	CMSHeaders          bool            `json:"cms_headers"`            // set CMS headers
-	RedirectURL         string          `json:"redirect_url"`           // redirect auth url for proxy server
-	Verbose             int             `json:"verbose"`                // verbose output
-	Ingress             []Ingress       `json:"ingress"`                // incress section
-	ServerCrt           string          `json:"server_cert"`            // server certificate
-	ServerKey           string          `json:"server_key"`             // server certificate
-	Hmac                string          `json:"hmac"`                   // cmsweb hmac file
-	CricURL             string          `json:"cric_url"`               // CRIC URL
-	CricFile            string          `json:"cric_file"`              // name of the CRIC file
-	CricVerbose         int             `json:"cric_verbose"`           // verbose output for cric
-	UpdateCricInterval  int64           `json:"update_cric"`            // interval (in sec) to update cric records
-	UTC                 bool            `json:"utc"`                    // report logger time in UTC
-	ReadTimeout         int             `json:"read_timeout"`           // server read timeout in sec
-	WriteTimeout        int             `json:"write_timeout"`          // server write timeout in sec
-	PrintMonitRecord    bool            `json:"print_monit_record"`     // print monit record on stdout
-	Scitokens           ScitokensConfig `json:"scitokens"`              // scitokens configuration
-	WellKnown           string          `json:"well_known"`             // location of well-known area
-	Providers           []string        `json:"providers`               // list of JWKS providers
-	MinTLSVersion       string          `json:"minTLSVersion"`          // minimum TLS version
-	MaxTLSVersion       string          `json:"maxTLSVersion"`          // maximum TLS version
+	Port                int                 `json:"port"`                   // server port number
+	MetricsPort         int                 `json:"metrics_port"`           // server metrics port number
+	RootCAs             string              `json:"rootCAs"`                // server Root CAs path
+	Base                string              `json:"base"`                   // base URL
+	StaticPage          string              `json:"static_page"`            // static file to use
+	LogFile             string              `json:"log_file"`               // server log file
+	ClientID            string              `json:"client_id"`              // OICD client id
+	ClientSecret        string              `json:"client_secret"`          // OICD client secret
+	TargetURL           string              `json:"target_url"`             // proxy target url (where requests will go)
+	XForwardedHost      string              `json:"X-Forwarded-Host"`       // X-Forwarded-Host field of HTTP request
+	XContentTypeOptions string              `json:"X-Content-Type-Options"` // X-Content-Type-Options option
+	DocumentRoot        string              `json:"document_root"`          // root directory for the server
+	OAuthURL            string              `json:"oauth_url"`              // CERN SSO OAuth2 realm url
+	AuthTokenURL        string              `json:"auth_token_url"`         // CERN SSO OAuth2 OICD Token url
+	CMSHeaders          bool                `json:"cms_headers"`            // set CMS headers
+	RedirectURL         string              `json:"redirect_url"`           // redirect auth url for proxy server
+	LogoutRedirectURL   string              `json:"logout_redirect_url"`    // url to redirect users after logout, default is server base path
+	DisablePKCE         bool                `json:"disable_pkce"`           // disable PKCE (S256) in OAuth authorization code flow
+	DisableNonce        bool                `json:"disable_nonce"`          // disable nonce check of ID token in OAuth authorization code flow
+	Scopes              []string            `json:"scopes"`                 // scopes requested from OAuth provider, default openid, profile, email
+	Claims              ClaimsConfig        `json:"claims"`                 // mapping of token claims to user attributes
+	LoginProviders      []LoginProvider     `json:"login_providers"`        // OAuth login providers of browser users, by default oauth_url is used
+	Verbose             int                 `json:"verbose"`                // verbose output
+	Ingress             []Ingress           `json:"ingress"`                // incress section
+	ServerCrt           string              `json:"server_cert"`            // server certificate
+	ServerKey           string              `json:"server_key"`             // server certificate
+	Hmac                string              `json:"hmac"`                   // cmsweb hmac file
+	CricURL             string              `json:"cric_url"`               // CRIC URL
+	CricFile            string              `json:"cric_file"`              // name of the CRIC file
+	CricVerbose         int                 `json:"cric_verbose"`           // verbose output for cric
+	UpdateCricInterval  int64               `json:"update_cric"`            // interval (in sec) to update cric records
+	CricMaxDrop         float64             `json:"cric_max_drop"`          // max percentage of users dropped by cric update, 100 disables the check
+	CricDropConfirm     int                 `json:"cric_drop_confirm"`      // number of consecutive cric refreshes which confirm refused drop of users, 0 (default) disables it
+	CricOffline         bool                `json:"cric_offline"`           // read cric records from cric file only
+	UTC                 bool                `json:"utc"`                    // report logger time in UTC
+	ReadTimeout         int                 `json:"read_timeout"`           // server read timeout in sec
+	WriteTimeout        int                 `json:"write_timeout"`          // server write timeout in sec
+	PrintMonitRecord    bool                `json:"print_monit_record"`     // print monit record on stdout
+	Scitokens           ScitokensConfig     `json:"scitokens"`              // scitokens configuration
+	WellKnown           string              `json:"well_known"`             // location of well-known area
+	Providers           []string            `json:"providers"`              // list of JWKS providers
+	JWKSRefreshInterval int                 `json:"jwks_refresh_interval"`  // interval (in sec) to refresh JWKS of providers, negative value disables it
+	ProviderRules       []ProviderRule      `json:"provider_rules"`         // token validation rules of JWKS providers
+	MinTLSVersion       string              `json:"minTLSVersion"`          // minimum TLS version
+	MaxTLSVersion       string              `json:"maxTLSVersion"`          // maximum TLS version
+	Transport           TransportConfig     `json:"transport"`              // transport configuration of reverse proxy
+	ReloadInterval      int                 `json:"reload_interval"`        // interval (in sec) to check config file for changes, negative value disables it
+	Listeners           []Listener          `json:"listeners"`              // list of server listeners run by single process
+	AuthOrder           []string            `json:"auth_order"`             // order of authentication methods of combined server: x509, bearer, scitokens
+	ShutdownTimeout     int                 `json:"shutdown_timeout"`       // time (in sec) to drain in-flight requests on shutdown, by default write_timeout
+	Session             SessionConfig       `json:"session"`                // session store configuration of OAuth server
+	TokenCache          TokenCacheConfig    `json:"token_cache"`            // cache of validated access tokens
+	TokenExchange       TokenExchangeConfig `json:"token_exchange"`         // token exchange configuration of OAuth server
+	InternalToken       InternalTokenConfig `json:"internal_token"`         // internal token passed to backends
+}
+
+// ProviderRule represents token validation rule of JWKS provider
+type ProviderRule struct {
+	URL       string   `json:"url"`       // provider url from providers list
+	Issuer    string   `json:"issuer"`    // expected token issuer, default is issuer of provider OpenID configuration
+	Audiences []string `json:"audiences"` // accepted aud or azp of tokens, empty list or * accepts any audience
+	Algs      []string `json:"algs"`      // allowed signing algorithms, default are RS, PS and ES algorithms
+	Leeway    int      `json:"leeway"`    // allowed clock skew (in sec) of exp and nbf claims
+}
+
+// InternalTokenConfig represents configuration of signed internal tokens
+// passed to backends
+type InternalTokenConfig struct {
+	Enable         bool   `json:"enable"`           // add signed internal token to backend requests
+	Header         string `json:"header"`           // HTTP header of internal token, default X-Auth-Token
+	Lifetime       int    `json:"lifetime"`         // lifetime (in sec) of internal token, default 60
+	DropCMSHeaders bool   `json:"drop_cms_headers"` // remove Cms-* headers from backend requests
+}
+
+// TokenExchangeConfig represents configuration of token exchange of OAuth server
+type TokenExchangeConfig struct {
+	Enable   bool `json:"enable"`   // enable token exchange endpoint
+	Lifetime int  `json:"lifetime"` // lifetime (in sec) of exchanged tokens, default 300
+}
+
+// TokenCacheConfig represents configuration of cache of validated access tokens
+type TokenCacheConfig struct {
+	Size        int `json:"size"`         // maximum number of cached tokens, default 10000, negative value disables cache
+	NegativeTTL int `json:"negative_ttl"` // time (in sec) to keep invalid tokens in cache, default 30
+}
+
+// LoginProvider represents OAuth login provider of browser users
+type LoginProvider struct {
+	Name         string   `json:"name"`           // provider name used in provider hint and callback url
+	Title        string   `json:"title"`          // provider title shown on selection page
+	OAuthURL     string   `json:"oauth_url"`      // OpenID Connect provider url
+	ClientID     string   `json:"client_id"`      // client id, default is server client_id
+	ClientSecret string   `json:"client_secret"`  // client secret, default is server client_secret
+	RedirectURL  string   `json:"redirect_url"`   // callback url, default is server redirect_url with provider name
+	AuthTokenURL string   `json:"auth_token_url"` // token url, default is token endpoint of the provider
+	Scopes       []string `json:"scopes"`         // requested scopes, default is server scopes
+}
+
+// ClaimsConfig represents mapping of token claims to user attributes, every
+// attribute is taken from the first existing claim of its list
+type ClaimsConfig struct {
+	Username []string `json:"username"` // claims of user name, default cern_upn, preferred_username
+	ID       []string `json:"id"`       // claims of user id, default cern_person_id
+	Email    []string `json:"email"`    // claims of user email, default email
+	Roles    []string `json:"roles"`    // claims of user roles reported as token scope, default cern_roles, scope
+	Groups   []string `json:"groups"`   // claims of user groups used by ingress groups policy, not used by default
+}
+
+// SessionConfig represents configuration of session store of OAuth server
+type SessionConfig struct {
+	Store      string   `json:"store"`       // session store: memory (default), file or cookie
+	TTL        int      `json:"ttl"`         // session lifetime in sec, default 3600
+	File       string   `json:"file"`        // BoltDB file of file session store
+	Secret     string   `json:"secret"`      // secret to encrypt sessions of cookie session store
+	OldSecrets []string `json:"old_secrets"` // previous secrets to decrypt sessions of cookie session store
+	Cookie     string   `json:"cookie"`      // name of session cookie, default gosessionid
+}
+
+// Listener represents server listener with its own port, authentication
+// method and ingress rules
+type Listener struct {
+	Port      int       `json:"port"`        // listener port number
+	Auth      string    `json:"auth"`        // authentication method: oauth, x509, scitokens or combined
+	ServerCrt string    `json:"server_cert"` // listener certificate, by default server certificate is used
+	ServerKey string    `json:"server_key"`  // listener key, by default server key is used
+	Ingress   []Ingress `json:"ingress"`     // listener ingress rules, by default server ingress rules are used
+}
+
+// TransportConfig represents configuration of transport used by reverse proxy
+type TransportConfig struct {
+	MaxIdleConns          int  `json:"max_idle_conns"`          // max number of idle connections across all backends
+	MaxIdleConnsPerHost   int  `json:"max_idle_conns_per_host"` // max number of idle connections per backend
+	MaxConnsPerHost       int  `json:"max_conns_per_host"`      // max number of connections per backend, 0 means no limit
+	IdleConnTimeout       int  `json:"idle_conn_timeout"`       // idle connection timeout in sec
+	DialTimeout           int  `json:"dial_timeout"`            // dial timeout in sec
+	KeepAlive             int  `json:"keep_alive"`              // keep-alive period of connections in sec
+	TLSHandshakeTimeout   int  `json:"tls_handshake_timeout"`   // TLS handshake timeout in sec
+	ResponseHeaderTimeout int  `json:"response_header_timeout"` // timeout to wait for backend response headers in sec, 0 means no timeout
+	HTTP2                 bool `json:"http2"`                   // use HTTP/2 with TLS backends
 }
 
 // HTTPRecord provides http record we send to logs endpoint
@@ -105,14 +232,15 @@ type ServerSettings struct {
 
 // TokenAttributes contains structure of access token attributes
 type TokenAttributes struct {
-	UserName     string `json:"username"`      // user name
-	Active       bool   `json:"active"`        // is token active or not
-	SessionState string `json:"session_state"` // session state fields
-	ClientID     string `json:"clientId"`      // client id
-	Email        string `json:"email"`         // client email address
-	Scope        string `json:"scope"`         // scope of the token
-	Expiration   int64  `json:"exp"`           // token expiration
-	ClientHost   string `json:"clientHost"`    // client host
+	UserName     string   `json:"username"`      // user name
+	Active       bool     `json:"active"`        // is token active or not
+	SessionState string   `json:"session_state"` // session state fields
+	ClientID     string   `json:"clientId"`      // client id
+	Email        string   `json:"email"`         // client email address
+	Scope        string   `json:"scope"`         // scope of the token
+	Expiration   int64    `json:"exp"`           // token expiration
+	ClientHost   string   `json:"clientHost"`    // client host
+	Groups       []string `json:"groups"`        // groups of the user
 }
 
 // TokenInfo contains information about all tokens
@@ -134,6 +262,18 @@ func (t *TokenInfo) String() string {
 	return s
 }
 
+// AuthRequest represents original request of the user which is redirected
+// to OAuth provider for authentication
+type AuthRequest struct {
+	URL      string     // original request URI (path and query)
+	Method   string     // original request method
+	Form     url.Values // form of original POST request
+	Provider string     // name of login provider
+	Verifier string     // PKCE code verifier
+	Nonce    string     // nonce of ID token
+	Created  int64      // creation time of the request in unix nanoseconds
+}
+
 // Memory structure keeps track of server memory
 type Memory struct {
 	Total       uint64  `json:"total"`
@@ -166,6 +306,11 @@ type Metrics struct {
 	RPS               float64                 `json:"rps"`               // throughput req/sec
 	RPSPhysical       float64                 `json:"rpsPhysical"`       // throughput req/sec using physical cpu
 	RPSLogical        float64                 `json:"rpsLogical"`        // throughput req/sec using logical cpu
+	TokenRefreshes    uint64                  `json:"tokenRefreshes"`    // total number of refreshed access tokens of OAuth sessions
+	TokenRefreshFails uint64                  `json:"tokenRefreshFails"` // total number of failed refreshes of access tokens of OAuth sessions
+	TokenCacheHits    uint64                  `json:"tokenCacheHits"`    // total number of access tokens found in token cache
+	TokenCacheMisses  uint64                  `json:"tokenCacheMisses"`  // total number of access tokens not found in token cache
+	TokenCacheSize    uint64                  `json:"tokenCacheSize"`    // number of access tokens in token cache
 }
 
 // ScitokensConfig represents configuration of scitokens service
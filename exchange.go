@@ -0,0 +1,216 @@
+package main
+
+// exchange module provides token exchange of OAuth server
+//
+// Copyright (c) 2020 - Valentin Kuznetsov <vkuznet@gmail.com>
+//
+
+/*
+The {base}/token/exchange endpoint (enabled by token_exchange.enable)
+implements OAuth 2.0 Token Exchange (RFC 8693). Clients send their access
+token (subject_token) along with name of ingress backend (audience) and
+obtain short-lived token of the backend signed by the server key, such that
+backend services do not see upstream SSO tokens of the users, e.g.
+
+curl -d grant_type=urn:ietf:params:oauth:grant-type:token-exchange \
+     -d subject_token=$token \
+     -d subject_token_type=urn:ietf:params:oauth:token-type:access_token \
+     -d audience=dbs https://cmsweb.cern.ch/token/exchange
+
+The token is issued only if the user is allowed to access the backend by its
+ingress policy and it is valid for token_exchange.lifetime seconds.
+*/
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+// token exchange grant and token types, see RFC 8693
+const (
+	tokenExchangeGrant = "urn:ietf:params:oauth:grant-type:token-exchange"
+	accessTokenType    = "urn:ietf:params:oauth:token-type:access_token"
+	jwtTokenType       = "urn:ietf:params:oauth:token-type:jwt"
+)
+
+// defaultExchangeLifetime defines default lifetime (in sec) of exchanged tokens
+const defaultExchangeLifetime = 300
+
+// ExchangeClaims represents claims of token issued by token exchange
+type ExchangeClaims struct {
+	Scope string `json:"scope,omitempty"` // user's scopes
+	Email string `json:"email,omitempty"` // user's email
+	jwt.StandardClaims
+}
+
+// ExchangeResponse represents response of token exchange
+type ExchangeResponse struct {
+	AccessToken     string `json:"access_token"`      // issued token
+	IssuedTokenType string `json:"issued_token_type"` // type of issued token
+	TokenType       string `json:"token_type"`        // token type string
+	Expires         int64  `json:"expires_in"`        // token lifetime in sec
+	Scope           string `json:"scope,omitempty"`   // scope of issued token
+}
+
+// ExchangeError represents error response of token exchange, see RFC 6749
+type ExchangeError struct {
+	Error       string `json:"error"`             // error code
+	Description string `json:"error_description"` // error description
+}
+
+// helper function to write error response of token exchange
+func exchangeError(w http.ResponseWriter, code, msg string, status int) {
+	log.Printf("token exchange error %s, %s\n", code, msg)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(ExchangeError{Error: code, Description: msg})
+}
+
+// helper function to find ingress rule of backend with given name
+func backendRule(r *http.Request, name string) *IngressRule {
+	if name == "" {
+		return nil
+	}
+	for _, rule := range requestIngress(r).Rules {
+		if rule.Name == name {
+			return rule
+		}
+	}
+	return nil
+}
+
+// helper function to get scope of exchanged token, requested scopes should
+// be subset of user scopes
+func exchangeScope(requested, scope string) (string, bool) {
+	if requested == "" {
+		return scope, true
+	}
+	scopes := strings.Fields(scope)
+	for _, s := range strings.Fields(requested) {
+		if !InList(s, scopes) {
+			return "", false
+		}
+	}
+	return requested, true
+}
+
+// token exchange handler issues token of ingress backend for validated
+// token of the user
+func tokenExchangeHandler(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	status := http.StatusOK
+	tstamp := int64(start.UnixNano() / 1000000) // use milliseconds for MONIT
+	defer logRequest(w, r, start, "token-exchange", &status, tstamp)
+
+	if r.Method != "POST" {
+		status = http.StatusMethodNotAllowed
+		http.Error(w, "token exchange requires POST request", status)
+		return
+	}
+	status = http.StatusBadRequest
+	if err := r.ParseForm(); err != nil {
+		exchangeError(w, "invalid_request", fmt.Sprintf("unable to parse form, %v", err), status)
+		return
+	}
+	if grant := r.FormValue("grant_type"); grant != tokenExchangeGrant {
+		exchangeError(w, "unsupported_grant_type", fmt.Sprintf("unsupported grant_type '%s'", grant), status)
+		return
+	}
+	subjectToken := r.FormValue("subject_token")
+	if subjectToken == "" {
+		exchangeError(w, "invalid_request", "no subject_token", status)
+		return
+	}
+	if ttype := r.FormValue("subject_token_type"); ttype != accessTokenType && ttype != jwtTokenType {
+		exchangeError(w, "invalid_request", fmt.Sprintf("unsupported subject_token_type '%s'", ttype), status)
+		return
+	}
+	issuedType := r.FormValue("requested_token_type")
+	if issuedType == "" {
+		issuedType = accessTokenType
+	}
+	if issuedType != accessTokenType && issuedType != jwtTokenType {
+		exchangeError(w, "invalid_request", fmt.Sprintf("unsupported requested_token_type '%s'", issuedType), status)
+		return
+	}
+	audience := r.FormValue("audience")
+	rule := backendRule(r, audience)
+	if rule == nil {
+		exchangeError(w, "invalid_target", fmt.Sprintf("unknown backend '%s'", audience), status)
+		return
+	}
+
+	// validate token of the user and check that user can access the backend
+	attrs, err := verifyAccessToken(subjectToken)
+	if err != nil {
+		exchangeError(w, "invalid_grant", fmt.Sprintf("%v", err), status)
+		return
+	}
+	userData := make(map[string]interface{})
+	userData["email"] = attrs.Email
+	userData["name"] = attrs.UserName
+	userData["id"] = attrs.ClientID
+	if len(attrs.Groups) > 0 {
+		userData["groups"] = attrs.Groups
+	}
+	cricUserData(userData, CricRecordsByID, attrs.ClientID)
+	sub, ok := userData["cern_upn"].(string)
+	if !ok {
+		msg := fmt.Sprintf("user with id '%v' not found in CRIC DB", attrs.ClientID)
+		exchangeError(w, "invalid_grant", msg, status)
+		return
+	}
+	if err := rule.authorize(userData); err != nil {
+		exchangeError(w, "invalid_target", fmt.Sprintf("access to backend '%s' is denied, %v", audience, err), status)
+		return
+	}
+	scope, ok := exchangeScope(r.FormValue("scope"), attrs.Scope)
+	if !ok {
+		exchangeError(w, "invalid_scope", fmt.Sprintf("scope '%s' is not granted to the user", r.FormValue("scope")), status)
+		return
+	}
+
+	// issue token of the backend signed by the server key
+	lifetime := Config().TokenExchange.Lifetime
+	now := time.Now()
+	issuer, kid := getIssuer(r)
+	claims := ExchangeClaims{
+		scope, attrs.Email,
+		jwt.StandardClaims{
+			Audience:  audience,                                              // aud
+			ExpiresAt: now.Add(time.Duration(lifetime) * time.Second).Unix(), // exp
+			Issuer:    issuer,                                                // iss
+			IssuedAt:  now.Unix(),                                            // iat
+			Id:        genUUID(),                                             // jti
+			Subject:   sub,                                                   // sub
+			NotBefore: now.Unix(),                                            // nbf
+		},
+	}
+	token, err := signClaims(claims, kid)
+	if err != nil {
+		status = http.StatusInternalServerError
+		exchangeError(w, "server_error", fmt.Sprintf("unable to sign token, %v", err), status)
+		return
+	}
+	status = http.StatusOK
+	resp := ExchangeResponse{
+		AccessToken:     token,
+		IssuedTokenType: issuedType,
+		TokenType:       "Bearer",
+		Expires:         int64(lifetime),
+		Scope:           scope,
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Pragma", "no-cache")
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		log.Println("unable to write token exchange response", err)
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/dmwm/cmsauth"
+	"github.com/stretchr/testify/assert"
+)
+
+// helper function to send token exchange request
+func exchangeRequest(form url.Values) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("POST", "/token/exchange", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	tokenExchangeHandler(w, r)
+	return w
+}
+
+// Test_tokenExchange function
+func Test_tokenExchange(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.Equal(t, err, nil)
+	privateKey = key
+	publicKey = &privateKey.PublicKey
+	reg, err := newIngressRules([]Ingress{
+		{Name: "dbs", Path: "/dbs", ServiceURL: "http://localhost:8250"},
+		{Name: "admin", Path: "/admin", ServiceURL: "http://localhost:8251", Logins: []string{"admin"}},
+	}, "", nil)
+	assert.Equal(t, err, nil)
+	old := currentState()
+	updateState(func(st *serverState) {
+		st.Ingress = reg
+		st.AccessTokens = newTokenCache(defaultTokenCacheSize)
+	})
+	exp := time.Now().Add(time.Hour).Unix()
+	AccessTokens().Add("user-token", TokenAttributes{ClientID: "1", Email: "user@cern.ch", Scope: "admin operator", Expiration: exp}, nil, time.Minute)
+	CricRecordsByID = cmsauth.CricRecords{"1": cmsauth.CricEntry{Login: "user", ID: 1}}
+	Config().TokenExchange.Lifetime = defaultExchangeLifetime
+	defer func() {
+		privateKey = nil
+		publicKey = nil
+		updateState(func(st *serverState) {
+			st.Ingress = old.Ingress
+			st.AccessTokens = old.AccessTokens
+		})
+		CricRecordsByID = nil
+		Config().TokenExchange = TokenExchangeConfig{}
+	}()
+
+	// user token is exchanged to token of the backend
+	form := url.Values{
+		"grant_type":         []string{tokenExchangeGrant},
+		"subject_token":      []string{"user-token"},
+		"subject_token_type": []string{accessTokenType},
+		"audience":           []string{"dbs"},
+		"scope":              []string{"operator"},
+	}
+	w := exchangeRequest(form)
+	assert.Equal(t, w.Code, http.StatusOK)
+	var resp ExchangeResponse
+	err = json.NewDecoder(w.Body).Decode(&resp)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, resp.IssuedTokenType, accessTokenType)
+	assert.Equal(t, resp.Expires, int64(defaultExchangeLifetime))
+	claims := &ExchangeClaims{}
+	_, err = jwt.ParseWithClaims(resp.AccessToken, claims, validateToken)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, claims.Audience, "dbs")
+	assert.Equal(t, claims.Subject, "user")
+	assert.Equal(t, claims.Scope, "operator")
+
+	// exchanged token is not accepted as scitoken while scitoken is
+	r := httptest.NewRequest("GET", "/dbs", nil)
+	r.Header.Set("Authorization", "Bearer "+resp.AccessToken)
+	_, err = validateJWT(httptest.NewRecorder(), r)
+	assert.NotEqual(t, err, nil)
+	Config().Scitokens.Lifetime = 10
+	defer func() { Config().Scitokens = ScitokensConfig{} }()
+	scitoken, err := getSciToken("https://cms-auth.web.cern.ch", "", genUUID(), "user", "read:/")
+	assert.Equal(t, err, nil)
+	r.Header.Set("Authorization", "Bearer "+scitoken)
+	_, err = validateJWT(httptest.NewRecorder(), r)
+	assert.Equal(t, err, nil)
+
+	// invalid requests are rejected with error codes of RFC 6749
+	for field, code := range map[string]string{
+		"grant_type":    "unsupported_grant_type",
+		"subject_token": "invalid_grant",
+		"audience":      "invalid_target",
+		"scope":         "invalid_scope",
+	} {
+		values := url.Values{}
+		for k, v := range form {
+			values[k] = v
+		}
+		values.Set(field, "unknown")
+		w = exchangeRequest(values)
+		assert.Equal(t, w.Code, http.StatusBadRequest, field)
+		var rec ExchangeError
+		err = json.NewDecoder(w.Body).Decode(&rec)
+		assert.Equal(t, err, nil)
+		assert.Equal(t, rec.Error, code, field)
+	}
+
+	// token of backend which user can't access is not issued
+	form.Set("audience", "admin")
+	w = exchangeRequest(form)
+	assert.Equal(t, w.Code, http.StatusBadRequest)
+}
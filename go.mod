@@ -3,6 +3,7 @@ module github.com/vkuznet/auth-proxy-server
 go 1.16
 
 require (
+	github.com/BurntSushi/toml v0.4.1
 	github.com/MicahParks/keyfunc v0.4.0
 	github.com/StackExchange/wmi v0.0.0-20210224194228-fe8f1750fd46 // indirect
 	github.com/coreos/go-oidc v2.2.1+incompatible
@@ -21,7 +22,9 @@ require (
 	github.com/thomasdarimont/go-kc-example v0.0.0-20170529223628-e3951d8faa4c
 	github.com/tklauser/go-sysconf v0.3.5 // indirect
 	github.com/vkuznet/TokenManager v0.0.1 // indirect
+	go.etcd.io/bbolt v1.3.6
 	golang.org/x/crypto v0.0.0-20210317152858-513c2a44f670
 	golang.org/x/oauth2 v0.0.0-20210313182246-cd4f82c27b84
 	gopkg.in/square/go-jose.v2 v2.5.1 // indirect
+	gopkg.in/yaml.v3 v3.0.1
 )
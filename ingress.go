@@ -0,0 +1,360 @@
+package main
+
+// ingress module provides ingress rules of the server
+//
+// Copyright (c) 2020 - Valentin Kuznetsov <vkuznet@gmail.com>
+//
+
+/*
+Ingress rules are matched against request path using one of the following
+path types:
+- prefix (default) path is equal to rule path or starts with rule path and "/"
+- exact            path is equal to rule path
+- regex            rule path is regular expression matched against request path
+
+Rules with host field only apply to requests with given host (either exact
+name or wildcard, e.g. *.cern.ch). If several rules match the request, the
+winner is chosen in the following order: rule with matching host over rule
+without host, exact match over other matches, longest matched part of the
+path (prefix length or length of regex match) and, finally, order of the rule
+in configuration.
+
+For regex rules the new_path is a template where capture groups of the
+expression can be used, e.g. path "^/dbs/(\w+)/(.*)" with new_path
+"/dbs/prod/$1/$2", and it replaces the first matched part of the path.
+
+Ingress rules may define authorization policy based on CRIC user records:
+- roles  list of CRIC roles, either role name (e.g. "admin") or role with
+         its scope (e.g. "admin:group:reqmgr" or "data-manager:site:T1_US_FNAL")
+- groups list of CRIC groups (e.g. "reqmgr") user should have in any role,
+         or groups of the user provided by token claims (see claims.groups)
+- logins list of user logins
+- dns    list of user DNs
+The user is authorized if any of the policy entries matches. Rules
+without policy entries are accessible by all authenticated users.
+*/
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// IngressRule represents ingress record along with its pool of backends
+type IngressRule struct {
+	Ingress                // ingress record from server configuration
+	Pool    *BackendPool   // pool of ingress backends
+	regex   *regexp.Regexp // compiled path expression of regex rules
+}
+
+// IngressRegistry holds ingress rules of the server along with their
+// backend pools and transport shared by backend reverse proxies
+type IngressRegistry struct {
+	Rules     []*IngressRule           // ingress rules
+	Target    *BackendPool             // backend pool of configuration target url
+	Transport *http.Transport          // transport of reverse proxies
+	Listeners map[int]*IngressRegistry // registries of listeners with their own ingress rules
+}
+
+// helper function to create ingress rule from ingress record
+func newIngressRule(rec Ingress, pool *BackendPool) (*IngressRule, error) {
+	rule := &IngressRule{Ingress: rec, Pool: pool}
+	switch rec.PathType {
+	case "", "prefix", "exact":
+	case "regex":
+		re, err := regexp.Compile(rec.Path)
+		if err != nil {
+			return nil, err
+		}
+		rule.regex = re
+	default:
+		msg := fmt.Sprintf("unsupported path type '%s'", rec.PathType)
+		return nil, errors.New(msg)
+	}
+	return rule, nil
+}
+
+// helper function to match request host against rule host
+func matchHost(ruleHost, host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(host)
+	ruleHost = strings.ToLower(ruleHost)
+	if strings.HasPrefix(ruleHost, "*.") {
+		return strings.HasSuffix(host, ruleHost[1:])
+	}
+	return host == ruleHost
+}
+
+// helper function to match request path against the rule, it returns
+// length of matched part of the path and match status
+func (rule *IngressRule) matchPath(path string) (int, bool) {
+	switch rule.PathType {
+	case "exact":
+		if path == rule.Path {
+			return len(path), true
+		}
+	case "regex":
+		if loc := rule.regex.FindStringIndex(path); loc != nil {
+			return loc[1] - loc[0], true
+		}
+	default:
+		prefix := strings.TrimSuffix(rule.Path, "/")
+		if path == prefix || strings.HasPrefix(path, prefix+"/") {
+			return len(prefix), true
+		}
+	}
+	return 0, false
+}
+
+// helper function to rewrite request path according to the rule
+func (rule *IngressRule) rewrite(path string) string {
+	if rule.regex != nil {
+		// expand new path template with capture groups of the first
+		// match and replace the matched part of the path with it
+		if loc := rule.regex.FindStringSubmatchIndex(path); loc != nil && rule.NewPath != "" {
+			dst := rule.regex.ExpandString(nil, rule.NewPath, path, loc)
+			path = path[:loc[0]] + string(dst) + path[loc[1]:]
+		}
+	} else if rule.OldPath != "" {
+		// replace old path to new one, e.g. /couchdb/_all_dbs => /_all_dbs
+		path = strings.Replace(path, rule.OldPath, rule.NewPath, 1)
+	}
+	// replace empty path with root path
+	if path == "" {
+		path = "/"
+	}
+	return path
+}
+
+// helper function to check if rule defines authorization policy
+func (rule *IngressRule) hasPolicy() bool {
+	return len(rule.Roles)+len(rule.Groups)+len(rule.Logins)+len(rule.DNs) > 0
+}
+
+// helper function to authorize user against ingress rule policy, the
+// user data should contain CRIC information about the user (login, dn, dns
+// and roles), it returns an error with the reason of access denial
+func (rule *IngressRule) authorize(userData map[string]interface{}) error {
+	if !rule.hasPolicy() {
+		return nil
+	}
+	var login, dn string
+	if v, ok := userData["cern_upn"]; ok {
+		login = fmt.Sprintf("%v", v)
+	}
+	if v, ok := userData["dn"]; ok {
+		dn = fmt.Sprintf("%v", v)
+	}
+	var dns []string
+	if v, ok := userData["dns"].([]string); ok {
+		dns = v
+	}
+	var roles map[string][]string
+	if v, ok := userData["roles"].(map[string][]string); ok {
+		roles = v
+	}
+	if login != "" && InList(login, rule.Logins) {
+		return nil
+	}
+	for _, d := range rule.DNs {
+		if d != "" && (d == dn || InList(d, dns)) {
+			return nil
+		}
+	}
+	for _, role := range rule.Roles {
+		arr := strings.SplitN(role, ":", 2)
+		scopes, ok := roles[strings.ToLower(arr[0])]
+		if !ok {
+			continue
+		}
+		if len(arr) == 1 || InList(arr[1], scopes) {
+			return nil
+		}
+	}
+	var groups []string
+	if v, ok := userData["groups"].([]string); ok {
+		groups = v
+	}
+	for _, group := range rule.Groups {
+		// groups of the user provided by token claims
+		if InList(group, groups) {
+			return nil
+		}
+		for _, scopes := range roles {
+			if InList(fmt.Sprintf("group:%s", group), scopes) {
+				return nil
+			}
+		}
+	}
+	msg := fmt.Sprintf("user login '%s' dn '%s' roles %v does not match policy of ingress path %s (roles %v groups %v logins %v dns %v)", login, dn, roles, rule.Path, rule.Roles, rule.Groups, rule.Logins, rule.DNs)
+	return errors.New(msg)
+}
+
+// helper function to check ingress policy for given HTTP request and user data
+func checkIngressPolicy(r *http.Request, userData map[string]interface{}) error {
+	if rule := findIngressRule(requestIngress(r).Rules, r); rule != nil {
+		return rule.authorize(userData)
+	}
+	return nil
+}
+
+// helper function to find ingress rule for given HTTP request
+func findIngressRule(rules []*IngressRule, r *http.Request) *IngressRule {
+	var best *IngressRule
+	var bestHost, bestExact bool
+	var bestLength int
+	for _, rule := range rules {
+		if rule.Host != "" && !matchHost(rule.Host, r.Host) {
+			continue
+		}
+		length, ok := rule.matchPath(r.URL.Path)
+		if !ok {
+			continue
+		}
+		host := rule.Host != ""
+		exact := rule.PathType == "exact"
+		if best != nil {
+			if bestHost != host {
+				if bestHost {
+					continue
+				}
+			} else if bestExact != exact {
+				if bestExact {
+					continue
+				}
+			} else if length <= bestLength {
+				continue
+			}
+		}
+		best, bestHost, bestExact, bestLength = rule, host, exact, length
+	}
+	return best
+}
+
+// helper function to create ingress registry for given ingress records
+// and target url, all reverse proxies of the backends use given transport
+func newIngressRules(recs []Ingress, targetURL string, transport *http.Transport) (*IngressRegistry, error) {
+	reg := &IngressRegistry{Transport: transport}
+	for _, rec := range recs {
+		pool, err := newBackendPool(rec, transport)
+		if err != nil {
+			log.Printf("unable to create backend pool for ingress %+v, error %v\n", rec, err)
+			return nil, err
+		}
+		rule, err := newIngressRule(rec, pool)
+		if err != nil {
+			log.Printf("unable to create ingress rule %+v, error %v\n", rec, err)
+			return nil, err
+		}
+		reg.Rules = append(reg.Rules, rule)
+	}
+	if targetURL != "" {
+		pool, err := newBackendPool(Ingress{ServiceURL: targetURL}, transport)
+		if err != nil {
+			log.Printf("unable to create backend pool for target url %s, error %v\n", targetURL, err)
+			return nil, err
+		}
+		reg.Target = pool
+	}
+	return reg, nil
+}
+
+// helper function to create ingress registry for given configuration,
+// all reverse proxies of the backends (including ones of server listeners)
+// share single transport
+func newIngressRegistry(cfg Configuration) (*IngressRegistry, error) {
+	transport := newTransport(cfg.Transport)
+	reg, err := newIngressRules(cfg.Ingress, cfg.TargetURL, transport)
+	if err != nil {
+		return nil, err
+	}
+	reg.Listeners = make(map[int]*IngressRegistry)
+	for _, l := range cfg.Listeners {
+		if len(l.Ingress) == 0 {
+			continue
+		}
+		lreg, err := newIngressRules(l.Ingress, cfg.TargetURL, transport)
+		if err != nil {
+			return nil, err
+		}
+		reg.Listeners[l.Port] = lreg
+	}
+	return reg, nil
+}
+
+// helper function to get ingress registry of given listener port, the
+// listeners without their own ingress rules use server ones
+func (reg *IngressRegistry) listener(port int) *IngressRegistry {
+	if lreg, ok := reg.Listeners[port]; ok {
+		return lreg
+	}
+	return reg
+}
+
+// Start starts health checks of registry backend pools
+func (reg *IngressRegistry) Start() {
+	for _, rule := range reg.Rules {
+		rule.Pool.Start()
+	}
+	for _, lreg := range reg.Listeners {
+		lreg.Start()
+	}
+}
+
+// Stop stops health checks of registry backend pools and closes idle
+// connections of its transport, in-flight requests are not affected
+func (reg *IngressRegistry) Stop() {
+	for _, rule := range reg.Rules {
+		rule.Pool.Stop()
+	}
+	for _, lreg := range reg.Listeners {
+		lreg.Stop()
+	}
+	reg.Transport.CloseIdleConnections()
+}
+
+// helper function to get current ingress registry, it is swapped along with
+// server state on configuration reload such that in-flight requests
+// complete with registry they started with
+func currentIngress() *IngressRegistry {
+	return currentState().Ingress
+}
+
+// helper function to get current ingress registry of the listener which
+// received given HTTP request
+func requestIngress(r *http.Request) *IngressRegistry {
+	reg := currentIngress()
+	if port, ok := listenerPort(r); ok {
+		return reg.listener(port)
+	}
+	return reg
+}
+
+// helper function to swap current ingress registry with new one
+func swapIngress(reg *IngressRegistry) {
+	reg.Start()
+	var old *IngressRegistry
+	updateState(func(st *serverState) {
+		old = st.Ingress
+		st.Ingress = reg
+	})
+	if old.Transport != nil {
+		old.Stop()
+	}
+}
+
+// helper function to initialize ingress rules and their backend pools
+func initIngressRules() error {
+	reg, err := newIngressRegistry(*Config())
+	if err != nil {
+		return err
+	}
+	swapIngress(reg)
+	return nil
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// helper function to create ingress rules for tests
+func testIngressRules(t *testing.T, records []Ingress) []*IngressRule {
+	var rules []*IngressRule
+	for _, rec := range records {
+		rule, err := newIngressRule(rec, nil)
+		assert.Equal(t, err, nil)
+		rules = append(rules, rule)
+	}
+	return rules
+}
+
+// helper function to find ingress path for given host and path
+func testFindIngress(rules []*IngressRule, host, path string) string {
+	r, _ := http.NewRequest("GET", "https://"+host+path, nil)
+	rule := findIngressRule(rules, r)
+	if rule == nil {
+		return ""
+	}
+	return rule.Host + rule.Path
+}
+
+// Test_findIngressRule function
+func Test_findIngressRule(t *testing.T) {
+	rules := testIngressRules(t, []Ingress{
+		{Path: "/"},
+		{Path: "/dbs"},
+		{Path: "/dbs/prod/global"},
+		{Path: "/dbs/exact", PathType: "exact"},
+		{Path: `^/phedex/(\w+)`, PathType: "regex"},
+		{Path: "/dbs", Host: "*.cern.ch"},
+	})
+	assert.Equal(t, testFindIngress(rules, "a.b.com", "/dbs"), "/dbs")
+	assert.Equal(t, testFindIngress(rules, "a.b.com", "/dbs/prod/global/datasets"), "/dbs/prod/global")
+	assert.Equal(t, testFindIngress(rules, "a.b.com", "/dbsx"), "/")
+	assert.Equal(t, testFindIngress(rules, "a.b.com", "/foo/dbs/bar"), "/")
+	assert.Equal(t, testFindIngress(rules, "a.b.com", "/dbs/exact"), "/dbs/exact")
+	assert.Equal(t, testFindIngress(rules, "a.b.com", "/phedex/datasvc"), `^/phedex/(\w+)`)
+	assert.Equal(t, testFindIngress(rules, "cmsweb.cern.ch:8443", "/dbs/prod/global"), "*.cern.ch/dbs")
+}
+
+// Test_rewrite function
+func Test_rewrite(t *testing.T) {
+	rules := testIngressRules(t, []Ingress{
+		{Path: "/couchdb", OldPath: "/couchdb", NewPath: ""},
+		{Path: `^/dbs/(\w+)/(.*)$`, PathType: "regex", NewPath: "/dbs/prod/$1/DBSReader/$2"},
+		{Path: `/v(\d+)/`, PathType: "regex", NewPath: "/api/v${1}/"},
+	})
+	assert.Equal(t, rules[0].rewrite("/couchdb"), "/")
+	assert.Equal(t, rules[0].rewrite("/couchdb/_all_dbs"), "/_all_dbs")
+	assert.Equal(t, rules[1].rewrite("/dbs/global/datasets"), "/dbs/prod/global/DBSReader/datasets")
+	// only the first match is replaced and the rest of the path is kept
+	assert.Equal(t, rules[2].rewrite("/app/v1/files/v2/x"), "/app/api/v1/files/v2/x")
+}
+
+// Test_authorize function
+func Test_authorize(t *testing.T) {
+	rules := testIngressRules(t, []Ingress{
+		{Path: "/open"},
+		{Path: "/admin", Roles: []string{"admin:group:reqmgr"}, Logins: []string{"boss"}},
+		{Path: "/ops", Groups: []string{"facops"}},
+	})
+	userData := make(map[string]interface{})
+	userData["cern_upn"] = "name"
+	userData["dn"] = "/DC=org/CN=First Last"
+	userData["roles"] = map[string][]string{"admin": {"group:reqmgr"}, "user": {"group:facops"}}
+	assert.Equal(t, rules[0].authorize(userData), nil)
+	assert.Equal(t, rules[1].authorize(userData), nil)
+	assert.Equal(t, rules[2].authorize(userData), nil)
+
+	userData["roles"] = map[string][]string{"admin": {"group:dbs"}}
+	assert.NotEqual(t, rules[1].authorize(userData), nil)
+	assert.NotEqual(t, rules[2].authorize(userData), nil)
+	userData["cern_upn"] = "boss"
+	assert.Equal(t, rules[1].authorize(userData), nil)
+}
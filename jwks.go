@@ -15,6 +15,7 @@ import (
 	"math/big"
 	"net/http"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/pascaldekloe/jwt"
@@ -60,12 +61,55 @@ type OpenIDConfiguration struct {
 type Provider struct {
 	URL           string              // provider url
 	Configuration OpenIDConfiguration // provider OpenID configuration
-	PublicKey     *rsa.PublicKey      // RSA public key of the provider
 	JWKSBody      []byte              // jwks body content of the provider
+	KeyIDs        []string            // ids of provider keys
+	Updated       time.Time           // time of last successful JWKS update
+	Rule          ProviderRule        // token validation rule of the provider
+	keys          *jwt.KeyRegister    // RSA and EC public keys of the provider
+	lastFetch     time.Time           // time of last JWKS fetch attempt
+	mutex         sync.RWMutex        // protects provider keys
+	fetchMutex    sync.Mutex          // serializes JWKS fetches of the provider
+}
+
+// defaultJWKSRefreshInterval defines default interval (in sec) to refresh
+// JWKS of providers
+const defaultJWKSRefreshInterval = 3600
+
+// jwksMissInterval defines minimal interval between JWKS fetches triggered
+// by tokens signed with unknown keys
+const jwksMissInterval = 30 * time.Second
+
+// jwksTimeout defines timeout of requests to OpenID configuration and JWKS
+// of providers
+const jwksTimeout = 10 * time.Second
+
+// jwksClient is HTTP client used to fetch OpenID configuration and JWKS of
+// providers, the unresponsive provider should not block token validation
+// and configuration reloads
+var jwksClient = &http.Client{Timeout: jwksTimeout}
+
+// defaultTokenAlgs defines default signing algorithms of provider tokens
+var defaultTokenAlgs = []string{
+	jwt.RS256, jwt.RS384, jwt.RS512,
+	jwt.PS256, jwt.PS384, jwt.PS512,
+	jwt.ES256, jwt.ES384, jwt.ES512,
+}
+
+// tokenError represents token rejected by validation rule of the provider
+type tokenError struct {
+	Provider string // provider url
+	Reason   string // reason of token rejection
+}
+
+// Error returns string representation of token error
+func (e *tokenError) Error() string {
+	return fmt.Sprintf("token rejected by provider %s: %s", e.Provider, e.Reason)
 }
 
 // String provides string representation of provider
 func (p *Provider) String() string {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
 	data, err := json.MarshalIndent(p, "", "    ")
 	if err != nil {
 		return fmt.Sprintf("Provider, error=%v", err)
@@ -75,7 +119,7 @@ func (p *Provider) String() string {
 
 // Init function initialize provider configuration
 func (p *Provider) Init(purl string) error {
-	resp, err := http.Get(fmt.Sprintf("%s/.well-known/openid-configuration", purl))
+	resp, err := jwksClient.Get(fmt.Sprintf("%s/.well-known/openid-configuration", purl))
 	if err != nil {
 		log.Println("unable to contact ", purl, " error ", err)
 		return err
@@ -94,56 +138,223 @@ func (p *Provider) Init(purl string) error {
 	}
 	p.URL = purl
 	p.Configuration = conf
-	if Config.Verbose > 0 {
+	if Config().Verbose > 0 {
 		log.Println("provider configuration", conf)
 	}
 
-	// obtain public key for our OpenID provider, for that we send
-	// HTTP request to jwks_uri, fetch cert information and decode its public key
-	resp2, err := http.Get(p.Configuration.JWKSUri)
+	// obtain public keys of our OpenID provider from its jwks_uri
+	err = p.fetchKeys()
 	if err != nil {
-		log.Println("unable to contact ", p.Configuration.JWKSUri, " error ", err)
 		return err
 	}
-	defer resp2.Body.Close()
-	body2, err := ioutil.ReadAll(resp2.Body)
-	if err != nil {
-		log.Println("unable to read body of HTTP response ", err)
-		return err
+	if Config().Verbose > 0 {
+		log.Println("\n", p.String())
 	}
-	var certs Certs
-	err = json.Unmarshal(body2, &certs)
+	return nil
+}
+
+// helper function to fetch JWKS of the provider and replace its keys,
+// provider keeps its current keys if JWKS can't be fetched
+func (p *Provider) fetchKeys() error {
+	p.fetchMutex.Lock()
+	defer p.fetchMutex.Unlock()
+	return p.fetchJWKS()
+}
+
+// helper function to fetch JWKS of the provider, the caller should hold
+// fetchMutex of the provider
+func (p *Provider) fetchJWKS() error {
+	p.mutex.Lock()
+	p.lastFetch = time.Now()
+	p.mutex.Unlock()
+	resp, err := jwksClient.Get(p.Configuration.JWKSUri)
 	if err != nil {
-		log.Println("unable to unmarshal body of HTTP response ", err)
+		log.Println("unable to contact ", p.Configuration.JWKSUri, " error ", err)
 		return err
 	}
-	p.JWKSBody = body2
-	exp := certs.Keys[0].E   // exponent
-	mod := certs.Keys[0].N   // modulus
-	kty := certs.Keys[0].Kty // kty attribute
-	if strings.ToLower(kty) != "rsa" {
-		msg := fmt.Sprintf("not RSA kty key: %s", kty)
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg := fmt.Sprintf("unable to fetch %s, status %s", p.Configuration.JWKSUri, resp.Status)
 		log.Println(msg)
 		return errors.New(msg)
 	}
-	pub, err := getPublicKey(exp, mod)
+	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		log.Println("unable to get public key ", err)
+		log.Println("unable to read body of HTTP response ", err)
 		return err
 	}
-	p.PublicKey = pub
-	if Config.Verbose > 0 {
-		log.Println("\n", p.String())
+	keys, kids, err := loadKeys(body)
+	if err != nil {
+		log.Printf("unable to load keys of %s, error %v\n", p.Configuration.JWKSUri, err)
+		return err
 	}
+	p.mutex.Lock()
+	p.JWKSBody = body
+	p.KeyIDs = kids
+	p.keys = keys
+	p.Updated = time.Now()
+	p.mutex.Unlock()
 	return nil
 }
 
+// helper function to load RSA and EC signing keys from JWKS body, other keys
+// are skipped
+func loadKeys(body []byte) (*jwt.KeyRegister, []string, error) {
+	var certs struct {
+		Keys []json.RawMessage `json:"keys"`
+	}
+	if err := json.Unmarshal(body, &certs); err != nil {
+		return nil, nil, err
+	}
+	keys := &jwt.KeyRegister{}
+	var kids []string
+	for _, data := range certs.Keys {
+		var rec Keys
+		if err := json.Unmarshal(data, &rec); err != nil {
+			return nil, nil, err
+		}
+		kty := strings.ToUpper(rec.Kty)
+		if (kty != "RSA" && kty != "EC") || rec.Use == "enc" {
+			if Config().Verbose > 0 {
+				log.Printf("skip key %s of %s kty and %s use\n", rec.Kid, rec.Kty, rec.Use)
+			}
+			continue
+		}
+		if _, err := keys.LoadJWK(data); err != nil {
+			log.Printf("unable to load key %s, error %v\n", rec.Kid, err)
+			continue
+		}
+		kids = append(kids, rec.Kid)
+	}
+	if len(kids) == 0 {
+		msg := "no RSA or EC keys found in JWKS"
+		return nil, nil, errors.New(msg)
+	}
+	return keys, kids, nil
+}
+
+// helper function to get provider keys and check if they contain key with
+// given id
+func (p *Provider) keyRegister(kid string) (*jwt.KeyRegister, bool) {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	for _, k := range p.KeyIDs {
+		if k == kid {
+			return p.keys, true
+		}
+	}
+	return p.keys, false
+}
+
+// helper function to refresh provider keys when token is signed by unknown
+// key, refreshes are limited to one per jwksMissInterval and concurrent
+// requests wait for the running refresh instead of fetching JWKS again
+func (p *Provider) refreshOnMiss(kid string) bool {
+	p.fetchMutex.Lock()
+	defer p.fetchMutex.Unlock()
+	if _, found := p.keyRegister(kid); found {
+		// the key was fetched by concurrent request
+		return true
+	}
+	p.mutex.RLock()
+	recent := time.Since(p.lastFetch) < jwksMissInterval
+	p.mutex.RUnlock()
+	if recent {
+		return false
+	}
+	log.Printf("provider %s has no key %s, refresh its JWKS\n", p.URL, kid)
+	return p.fetchJWKS() == nil
+}
+
+// helper function to get token validation rule of provider with given url
+// from server configuration, the rule defaults are taken from the provider
+// configuration, audiences are checked only if they are configured such that
+// tokens issued to other clients (e.g. CLI tools) remain valid
+func providerRule(cfg Configuration, p *Provider) ProviderRule {
+	rule := ProviderRule{URL: p.URL}
+	for _, rec := range cfg.ProviderRules {
+		if rec.URL == p.URL {
+			rule = rec
+		}
+	}
+	if rule.Issuer == "" {
+		rule.Issuer = p.Configuration.Issuer
+	}
+	if len(rule.Algs) == 0 {
+		rule.Algs = defaultTokenAlgs
+	}
+	return rule
+}
+
+// helper function to initialize providers of given configuration, providers
+// which can't be contacted keep their current keys
+func initProviders(cfg Configuration) (map[string]*Provider, error) {
+	providers := make(map[string]*Provider)
+	for _, purl := range cfg.Providers {
+		log.Println("initialize provider ", purl)
+		p := &Provider{}
+		err := p.Init(purl)
+		if err != nil {
+			old, ok := OAuthProviders()[purl]
+			if !ok {
+				log.Printf("fail to initialize %s error %v", purl, err)
+				return providers, err
+			}
+			log.Printf("fail to initialize %s error %v, use its cached keys", purl, err)
+			p = old.clone()
+		}
+		p.Rule = providerRule(cfg, p)
+		providers[purl] = p
+	}
+	return providers, nil
+}
+
+// helper function to copy provider configuration and keys
+func (p *Provider) clone() *Provider {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	return &Provider{
+		URL:           p.URL,
+		Configuration: p.Configuration,
+		JWKSBody:      p.JWKSBody,
+		KeyIDs:        p.KeyIDs,
+		Updated:       p.Updated,
+		keys:          p.keys,
+		lastFetch:     p.lastFetch,
+	}
+}
+
+// helper function to periodically refresh JWKS of all providers, providers
+// which can't be contacted keep their current keys
+func refreshProviders() {
+	for {
+		interval := Config().JWKSRefreshInterval
+		if interval == 0 {
+			interval = defaultJWKSRefreshInterval
+		}
+		if interval < 0 {
+			// refresh on unknown keys only, check configuration later
+			time.Sleep(time.Minute)
+			continue
+		}
+		time.Sleep(time.Duration(interval) * time.Second)
+		for purl, p := range OAuthProviders() {
+			if err := p.fetchKeys(); err != nil {
+				log.Printf("unable to refresh JWKS of %s, error %v\n", purl, err)
+			}
+		}
+	}
+}
+
 // helper function to check given access token and return its claims
 // it is based on github.com/dgrijalva/jwt-go and github.com/MicahParks/keyfunc go packages
-func tokenClaims(provider Provider, accessToken string) (map[string]interface{}, error) {
+func tokenClaims(provider *Provider, accessToken string) (map[string]interface{}, error) {
 	out := make(map[string]interface{})
 	// Create the JWKS from the resource at the given URL.
-	jwks, err := keyfunc.New(provider.JWKSBody)
+	provider.mutex.RLock()
+	body := provider.JWKSBody
+	provider.mutex.RUnlock()
+	jwks, err := keyfunc.New(body)
 	if err != nil {
 		return out, err
 	}
@@ -202,17 +413,40 @@ func getPublicKey(exp, mod string) (*rsa.PublicKey, error) {
 }
 
 // helper function to check access token and return claims map based on
-// github.com/pascaldekloe/jwt go package
-func tokenClaims2(provider Provider, token string) (map[string]interface{}, error) {
+// github.com/pascaldekloe/jwt go package, the token is checked with provider
+// key of its kid and provider keys are refreshed if the kid is unknown.
+// Tokens signed by the provider are checked against provider validation rule
+// and rejected with tokenError.
+func tokenClaims2(provider *Provider, token string) (map[string]interface{}, error) {
 	out := make(map[string]interface{})
+	rule := provider.Rule
+	kid, alg := tokenHeader(token)
+	keys, found := provider.keyRegister(kid)
+	if !found && kid != "" && provider.refreshOnMiss(kid) {
+		keys, found = provider.keyRegister(kid)
+	}
+	if keys == nil {
+		msg := fmt.Sprintf("provider %s has no keys", provider.URL)
+		return out, errors.New(msg)
+	}
+	algs := rule.Algs
+	if len(algs) == 0 {
+		algs = defaultTokenAlgs
+	}
+	if !InList(alg, algs) {
+		msg := fmt.Sprintf("signing algorithm '%s' is not allowed", alg)
+		if found {
+			return out, &tokenError{Provider: provider.URL, Reason: msg}
+		}
+		return out, errors.New(msg)
+	}
 	// verify a JWT
-	claims, err := jwt.RSACheck([]byte(token), provider.PublicKey)
+	claims, err := keys.Check([]byte(token))
 	if err != nil {
 		return out, err
 	}
-	if !claims.Valid(time.Now()) {
-		msg := "The token is not valid"
-		return out, errors.New(msg)
+	if reason := checkClaims(claims, rule, time.Now()); reason != "" {
+		return out, &tokenError{Provider: provider.URL, Reason: reason}
 	}
 	for k, v := range claims.Set {
 		out[k] = v
@@ -221,3 +455,55 @@ func tokenClaims2(provider Provider, token string) (map[string]interface{}, erro
 	out["exp"] = t.Unix()
 	return out, nil
 }
+
+// helper function to check token claims against provider validation rule,
+// it returns reason of token rejection
+func checkClaims(claims *jwt.Claims, rule ProviderRule, now time.Time) string {
+	if rule.Issuer != "" && claims.Issuer != rule.Issuer {
+		return fmt.Sprintf("token issuer '%s' does not match '%s'", claims.Issuer, rule.Issuer)
+	}
+	if len(rule.Audiences) > 0 && !InList("*", rule.Audiences) {
+		auds := claims.Audiences
+		if azp, ok := claims.Set["azp"].(string); ok {
+			auds = append(auds, azp)
+		}
+		var accepted bool
+		for _, aud := range auds {
+			if InList(aud, rule.Audiences) {
+				accepted = true
+				break
+			}
+		}
+		if !accepted {
+			return fmt.Sprintf("token audience %v is not accepted", auds)
+		}
+	}
+	leeway := time.Duration(rule.Leeway) * time.Second
+	if claims.Expires != nil && !claims.Expires.Time().Add(leeway).After(now) {
+		return "token is expired"
+	}
+	if claims.NotBefore != nil && claims.NotBefore.Time().After(now.Add(leeway)) {
+		return "token is not valid yet"
+	}
+	return ""
+}
+
+// helper function to get key id and signing algorithm from header of given JWT
+func tokenHeader(token string) (string, string) {
+	arr := strings.Split(token, ".")
+	if len(arr) != 3 {
+		return "", ""
+	}
+	data, err := base64.RawURLEncoding.DecodeString(arr[0])
+	if err != nil {
+		return "", ""
+	}
+	var header struct {
+		Kid string `json:"kid"`
+		Alg string `json:"alg"`
+	}
+	if err := json.Unmarshal(data, &header); err != nil {
+		return "", ""
+	}
+	return header.Kid, header.Alg
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pascaldekloe/jwt"
+	"github.com/stretchr/testify/assert"
+)
+
+// helper function to create JWK of RSA public key
+func rsaJWK(kid string, key *rsa.PublicKey) map[string]string {
+	return map[string]string{
+		"kid": kid,
+		"kty": "RSA",
+		"use": "sig",
+		"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+		"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+	}
+}
+
+// helper function to create JWK of EC public key
+func ecJWK(kid string, key *ecdsa.PublicKey) map[string]string {
+	size := (key.Curve.Params().BitSize + 7) / 8
+	x := make([]byte, size)
+	y := make([]byte, size)
+	return map[string]string{
+		"kid": kid,
+		"kty": "EC",
+		"crv": key.Curve.Params().Name,
+		"x":   base64.RawURLEncoding.EncodeToString(key.X.FillBytes(x)),
+		"y":   base64.RawURLEncoding.EncodeToString(key.Y.FillBytes(y)),
+	}
+}
+
+// Test_providerKeys function
+func Test_providerKeys(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.Equal(t, err, nil)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Equal(t, err, nil)
+	newKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.Equal(t, err, nil)
+
+	// OpenID provider which serves RSA, EC and encryption keys
+	keys := []map[string]string{
+		rsaJWK("rsa", &rsaKey.PublicKey),
+		ecJWK("ec", &ecKey.PublicKey),
+		{"kid": "enc", "kty": "oct", "k": "c2VjcmV0"},
+	}
+	var fetches int
+	available := true
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/.well-known/openid-configuration" {
+			json.NewEncoder(w).Encode(OpenIDConfiguration{Issuer: server.URL, JWKSUri: server.URL + "/certs"})
+			return
+		}
+		fetches++
+		if !available {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": keys})
+	}))
+	defer server.Close()
+
+	p := &Provider{}
+	err = p.Init(server.URL)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, p.KeyIDs, []string{"rsa", "ec"})
+
+	// tokens signed by RSA and EC keys are validated by their kid
+	exp := jwt.NewNumericTime(time.Now().Add(time.Minute))
+	claims := jwt.Claims{KeyID: "rsa", Registered: jwt.Registered{Expires: exp}, Set: map[string]interface{}{"cern_upn": "user"}}
+	token, err := claims.RSASign(jwt.RS256, rsaKey)
+	assert.Equal(t, err, nil)
+	out, err := tokenClaims2(p, string(token))
+	assert.Equal(t, err, nil)
+	assert.Equal(t, out["cern_upn"], "user")
+	claims = jwt.Claims{KeyID: "ec", Registered: jwt.Registered{Subject: "user", Expires: exp}}
+	token, err = claims.ECDSASign(jwt.ES256, ecKey)
+	assert.Equal(t, err, nil)
+	_, err = tokenClaims2(p, string(token))
+	assert.Equal(t, err, nil)
+	assert.Equal(t, fetches, 1)
+
+	// token signed by rotated key triggers JWKS refresh
+	keys = append(keys, rsaJWK("new", &newKey.PublicKey))
+	p.lastFetch = time.Now().Add(-jwksMissInterval)
+	claims = jwt.Claims{KeyID: "new", Registered: jwt.Registered{Subject: "user", Expires: exp}}
+	token, err = claims.RSASign(jwt.RS256, newKey)
+	assert.Equal(t, err, nil)
+	_, err = tokenClaims2(p, string(token))
+	assert.Equal(t, err, nil)
+	assert.Equal(t, fetches, 2)
+
+	// refreshes on unknown kid are rate limited
+	claims = jwt.Claims{KeyID: "unknown", Registered: jwt.Registered{Subject: "user", Expires: exp}}
+	token, err = claims.RSASign(jwt.RS256, newKey)
+	assert.Equal(t, err, nil)
+	for i := 0; i < 3; i++ {
+		_, err = tokenClaims2(p, string(token))
+		assert.Equal(t, err, nil)
+	}
+	assert.Equal(t, fetches, 2)
+
+	// concurrent tokens signed by rotated key trigger single JWKS refresh
+	burstKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.Equal(t, err, nil)
+	keys = append(keys, rsaJWK("burst", &burstKey.PublicKey))
+	p.lastFetch = time.Now().Add(-jwksMissInterval)
+	claims = jwt.Claims{KeyID: "burst", Registered: jwt.Registered{Subject: "user", Expires: exp}}
+	token, err = claims.RSASign(jwt.RS256, burstKey)
+	assert.Equal(t, err, nil)
+	var wg sync.WaitGroup
+	errs := make([]error, 10)
+	for i := 0; i < len(errs); i++ {
+		wg.Add(1)
+		go func(idx int) {
+			defer wg.Done()
+			_, errs[idx] = tokenClaims2(p, string(token))
+		}(i)
+	}
+	wg.Wait()
+	for _, e := range errs {
+		assert.Equal(t, e, nil)
+	}
+	assert.Equal(t, fetches, 3)
+
+	// cached keys are used when provider is unreachable
+	available = false
+	err = p.fetchKeys()
+	assert.NotEqual(t, err, nil)
+	assert.Equal(t, fetches, 4)
+	_, err = tokenClaims2(p, string(token))
+	assert.Equal(t, err, nil, fmt.Sprintf("keys %v", p.KeyIDs))
+	assert.Equal(t, len(p.KeyIDs), 4)
+}
+
+// Test_checkClaims function
+func Test_checkClaims(t *testing.T) {
+	now := time.Now()
+	rule := ProviderRule{Issuer: "https://auth.cern.ch/auth/realms/cern", Audiences: []string{"cms-proxy"}, Leeway: 30}
+	claims := &jwt.Claims{Registered: jwt.Registered{
+		Issuer:    "https://auth.cern.ch/auth/realms/cern",
+		Audiences: []string{"cms-proxy"},
+		Expires:   jwt.NewNumericTime(now.Add(-10 * time.Second)),
+	}}
+	// expired token is accepted within leeway
+	assert.Equal(t, checkClaims(claims, rule, now), "")
+	claims.Expires = jwt.NewNumericTime(now.Add(-time.Minute))
+	assert.Equal(t, checkClaims(claims, rule, now), "token is expired")
+	claims.Expires = nil
+	claims.NotBefore = jwt.NewNumericTime(now.Add(time.Minute))
+	assert.Equal(t, checkClaims(claims, rule, now), "token is not valid yet")
+	claims.NotBefore = nil
+
+	// token of another issuer or audience is rejected
+	claims.Issuer = "https://evil.com"
+	assert.Equal(t, strings.Contains(checkClaims(claims, rule, now), "issuer"), true)
+	claims.Issuer = rule.Issuer
+	claims.Audiences = []string{"other"}
+	assert.Equal(t, strings.Contains(checkClaims(claims, rule, now), "audience"), true)
+
+	// authorized party or any audience is accepted
+	claims.Set = map[string]interface{}{"azp": "cms-proxy"}
+	assert.Equal(t, checkClaims(claims, rule, now), "")
+	claims.Set = nil
+	rule.Audiences = []string{"*"}
+	assert.Equal(t, checkClaims(claims, rule, now), "")
+}
+
+// Test_tokenRules function
+func Test_tokenRules(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.Equal(t, err, nil)
+	keys := &jwt.KeyRegister{}
+	data, err := json.Marshal(rsaJWK("rsa", &key.PublicKey))
+	assert.Equal(t, err, nil)
+	_, err = keys.LoadJWK(data)
+	assert.Equal(t, err, nil)
+	p := &Provider{URL: "https://auth.cern.ch", KeyIDs: []string{"rsa"}, keys: keys, lastFetch: time.Now()}
+	p.Rule = ProviderRule{Issuer: "https://auth.cern.ch", Audiences: []string{"cms-proxy"}, Algs: []string{jwt.RS256}}
+
+	exp := jwt.NewNumericTime(time.Now().Add(time.Minute))
+	claims := jwt.Claims{KeyID: "rsa", Registered: jwt.Registered{Issuer: "https://auth.cern.ch", Audiences: []string{"cms-proxy"}, Expires: exp}}
+	token, err := claims.RSASign(jwt.RS256, key)
+	assert.Equal(t, err, nil)
+	_, err = tokenClaims2(p, string(token))
+	assert.Equal(t, err, nil)
+
+	// tokens with wrong audience or not allowed algorithm are rejected
+	// with reason of rejection
+	claims.Audiences = []string{"other"}
+	token, err = claims.RSASign(jwt.RS256, key)
+	assert.Equal(t, err, nil)
+	_, err = tokenClaims2(p, string(token))
+	var terr *tokenError
+	assert.Equal(t, errors.As(err, &terr), true)
+	assert.Equal(t, strings.Contains(terr.Reason, "audience"), true)
+	claims.Audiences = []string{"cms-proxy"}
+	token, err = claims.RSASign(jwt.RS512, key)
+	assert.Equal(t, err, nil)
+	_, err = tokenClaims2(p, string(token))
+	assert.Equal(t, errors.As(err, &terr), true)
+	assert.Equal(t, strings.Contains(terr.Reason, "RS512"), true)
+
+	// rejected token is not introspected
+	updateState(func(st *serverState) {
+		st.Providers = map[string]*Provider{p.URL: p}
+	})
+	Config().Providers = []string{p.URL}
+	defer func() {
+		updateState(func(st *serverState) {
+			st.Providers = nil
+		})
+		Config().Providers = nil
+	}()
+	_, err = verifyAccessToken(string(token))
+	assert.Equal(t, errors.As(err, &terr), true)
+}
+
+// Test_providerTimeout function
+func Test_providerTimeout(t *testing.T) {
+	// unresponsive OpenID provider
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+	jwksClient.Timeout = 100 * time.Millisecond
+	defer func() { jwksClient.Timeout = jwksTimeout }()
+
+	// provider initialization fails after timeout
+	start := time.Now()
+	p := &Provider{}
+	err := p.Init(server.URL)
+	assert.NotEqual(t, err, nil)
+	assert.Equal(t, time.Since(start) < jwksTimeout, true)
+
+	// JWKS fetch fails after timeout
+	p.Configuration.JWKSUri = server.URL + "/certs"
+	start = time.Now()
+	err = p.fetchKeys()
+	assert.NotEqual(t, err, nil)
+	assert.Equal(t, time.Since(start) < jwksTimeout, true)
+}
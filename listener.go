@@ -0,0 +1,147 @@
+package main
+
+// listener module provides server listeners
+//
+// Copyright (c) 2020 - Valentin Kuznetsov <vkuznet@gmail.com>
+//
+
+/*
+The server can run several listeners in a single process, e.g. OAuth, x509,
+scitokens and combined front-ends, via listeners section of the configuration:
+
+    "listeners": [
+        {"port": 8181, "auth": "oauth"},
+        {"port": 8443, "auth": "x509", "ingress": [...]},
+        {"port": 8843, "auth": "scitokens"}
+    ]
+
+Every listener has its own port, authentication method and (optional)
+ingress rules, otherwise it uses server ingress rules. All listeners share
+CRIC records, metrics, logging and transport of reverse proxies. If the
+listeners section is not provided the server runs single listener on
+server port with authentication method chosen by command line flags.
+Changes of listeners (ports, auth methods and certificates) require server
+restart, while their ingress rules are updated on configuration reload.
+*/
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+)
+
+// listenerContextKey represents type of context keys used by listeners
+type listenerContextKey int
+
+// listenerPortKey is context key of listener port
+const listenerPortKey listenerContextKey = 0
+
+// helper function to get server listeners for given configuration, if
+// configuration does not provide listeners we use single listener on server
+// port with given authentication method
+func serverListeners(cfg Configuration, auth string) []Listener {
+	if len(cfg.Listeners) > 0 {
+		return cfg.Listeners
+	}
+	return []Listener{{Port: cfg.Port, Auth: auth}}
+}
+
+// helper function to get port of the listener which received HTTP request
+func listenerPort(r *http.Request) (int, bool) {
+	port, ok := r.Context().Value(listenerPortKey).(int)
+	return port, ok
+}
+
+// helper function to attach listener port to context of HTTP requests
+func withListener(port int, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := context.WithValue(r.Context(), listenerPortKey, port)
+		handler.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// helper function to get server certificate and key files of given listener
+func listenerCerts(l Listener) (string, string) {
+	serverCrt := Config().ServerCrt
+	if l.ServerCrt != "" {
+		serverCrt = l.ServerCrt
+	}
+	serverKey := Config().ServerKey
+	if l.ServerKey != "" {
+		serverKey = l.ServerKey
+	}
+	// check if provided crt/key files exists
+	return checkFile(serverCrt), checkFile(serverKey)
+}
+
+// helper function to create HTTPs server of given listener
+func listenerServer(l Listener) (*http.Server, error) {
+	serverCrt, serverKey := listenerCerts(l)
+	var mux *http.ServeMux
+	customVerify := true
+	switch l.Auth {
+	case "oauth":
+		mux = oauthServeMux(l.Port, serverCrt)
+		customVerify = false
+	case "x509":
+		mux = x509ServeMux()
+	case "scitokens":
+		mux = scitokensServeMux()
+	case "combined":
+		mux = combinedServeMux()
+	default:
+		msg := fmt.Sprintf("unsupported auth '%s' of listener on port %d", l.Auth, l.Port)
+		return nil, errors.New(msg)
+	}
+	server, err := getServer(l.Port, serverCrt, serverKey, customVerify)
+	if err != nil {
+		return nil, err
+	}
+	server.Handler = withListener(l.Port, mux)
+	return server, nil
+}
+
+// helper function to setup HTTP handlers of metrics server, it serves
+// metrics along with profiler (/debug/pprof/) and expvar (/debug/vars)
+// handlers registered in default mux
+func metricsServeMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc(fmt.Sprintf("%s/metrics", Config().Base), metricsHandler)
+	mux.HandleFunc(fmt.Sprintf("%s/cric/changes", Config().Base), cricChangesHandler)
+	mux.Handle("/debug/", http.DefaultServeMux)
+	return mux
+}
+
+// helper function to start server listeners, it blocks until one of the
+// listeners fails or server is shutdown
+func startListeners(listeners []Listener) {
+	var servers []*runningServer
+
+	// start http server to serve metrics only
+	if Config().MetricsPort > 0 {
+		mux := metricsServeMux()
+		ln, err := listen(Config().MetricsPort)
+		if err != nil {
+			log.Fatalf("unable to start metrics server on port %d, error %v\n", Config().MetricsPort, err)
+		}
+		server := &http.Server{Handler: mux}
+		servers = append(servers, &runningServer{Port: Config().MetricsPort, Server: server, Listener: ln})
+	}
+
+	for _, l := range listeners {
+		server, err := listenerServer(l)
+		if err != nil {
+			log.Fatalf("unable to start %s server on port %d, error %v\n", l.Auth, l.Port, err)
+		}
+		ln, err := listen(l.Port)
+		if err != nil {
+			log.Fatalf("unable to start %s server on port %d, error %v\n", l.Auth, l.Port, err)
+		}
+		log.Printf("start %s listener on port %d\n", l.Auth, l.Port)
+		serverCrt, serverKey := listenerCerts(l)
+		servers = append(servers, &runningServer{Port: l.Port, Server: server, Listener: ln, ServerCrt: serverCrt, ServerKey: serverKey, Timeouts: true})
+	}
+	serve(servers)
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Test_serverListeners function
+func Test_serverListeners(t *testing.T) {
+	cfg := Configuration{Port: 8181}
+	listeners := serverListeners(cfg, "x509")
+	assert.Equal(t, listeners, []Listener{{Port: 8181, Auth: "x509"}})
+
+	cfg.Listeners = []Listener{{Port: 8181, Auth: "oauth"}, {Port: 8443, Auth: "x509"}}
+	assert.Equal(t, serverListeners(cfg, "x509"), cfg.Listeners)
+}
+
+// Test_requestIngress function
+func Test_requestIngress(t *testing.T) {
+	cfg := Configuration{
+		Ingress: []Ingress{{Path: "/dbs", ServiceURL: "http://dbs:8250"}},
+		Listeners: []Listener{
+			{Port: 8181, Auth: "oauth"},
+			{Port: 8443, Auth: "x509", Ingress: []Ingress{{Path: "/phedex", ServiceURL: "http://phedex:8280"}}},
+		},
+	}
+	reg, err := newIngressRegistry(cfg)
+	assert.Equal(t, err, nil)
+	swapIngress(reg)
+	defer swapIngress(&IngressRegistry{Transport: reg.Transport})
+
+	// find ingress rules of the listeners which receive the request
+	var paths []string
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, rule := range requestIngress(r).Rules {
+			paths = append(paths, rule.Path)
+		}
+	})
+	for _, port := range []int{8181, 8443} {
+		r := httptest.NewRequest("GET", "/dbs", nil)
+		withListener(port, handler).ServeHTTP(httptest.NewRecorder(), r)
+	}
+	assert.Equal(t, paths, []string{"/dbs", "/phedex"})
+}
+
+// Test_validateListeners function
+func Test_validateListeners(t *testing.T) {
+	cfg := Configuration{
+		MetricsPort: 9090,
+		Listeners: []Listener{
+			{Port: 8181, Auth: "oauth"},
+			{Port: 8181, Auth: "x509"},
+			{Port: 9090, Auth: "oauth"},
+			{Port: 8443, Auth: "kerberos"},
+			{Port: 8843, Auth: "scitokens", Ingress: []Ingress{{Path: "/dbs"}}},
+		},
+	}
+	var msgs []string
+	for _, err := range validateListeners(cfg) {
+		msgs = append(msgs, err.Error())
+	}
+	msg := strings.Join(msgs, "\n")
+	for _, key := range []string{"listeners[1]: port 8181", "listeners[2]: port 9090 is used by metrics_port", "listeners[3]: unsupported auth", "listeners[4].ingress[0]: empty service_url", "only one oauth listener"} {
+		assert.True(t, strings.Contains(msg, key), "missing problem "+key)
+	}
+}
+
+// Test_metricsServeMux function
+func Test_metricsServeMux(t *testing.T) {
+	mux := metricsServeMux()
+	for _, path := range []string{"/debug/pprof/", "/debug/vars"} {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		assert.Equal(t, w.Code, http.StatusOK, path)
+	}
+}
@@ -22,7 +22,7 @@ import (
 // helper function to produce UTC time prefixed output
 func utcMsg(data []byte) string {
 	var msg string
-	if Config.UTC {
+	if Config().UTC {
 		msg = fmt.Sprintf("[" + time.Now().UTC().String() + "] " + string(data))
 	} else {
 		msg = fmt.Sprintf("[" + time.Now().String() + "] " + string(data))
@@ -75,8 +75,14 @@ func logRequest(w http.ResponseWriter, r *http.Request, start time.Time, cauth s
 		aproto = fmt.Sprintf("No TLS")
 		cipher = "None"
 	}
+	authProto := aproto
 	if cauth == "" {
 		cauth = fmt.Sprintf("%v", r.Header.Get("Cms-Authn-Method"))
+		// authentication method is defined by the request, e.g. by
+		// combined server, and we report it as auth protocol
+		if cauth != "" {
+			authProto = cauth
+		}
 	}
 	cmsAuthCert := r.Header.Get("Cms-Auth-Cert")
 	if cmsAuthCert == "" {
@@ -118,7 +124,7 @@ func logRequest(w http.ResponseWriter, r *http.Request, start time.Time, cauth s
 		Proto:          r.Proto,
 		Status:         int64(*status),
 		ContentLength:  r.ContentLength,
-		AuthProto:      aproto,
+		AuthProto:      authProto,
 		Cipher:         cipher,
 		CmsAuthCert:    cmsAuthCert,
 		CmsLoginName:   cmsLoginName,
@@ -136,7 +142,7 @@ func logRequest(w http.ResponseWriter, r *http.Request, start time.Time, cauth s
 		RecTimestamp:   int64(time.Now().Unix()),
 		RecDate:        time.Now().Format(time.RFC3339),
 	}
-	if Config.PrintMonitRecord {
+	if Config().PrintMonitRecord {
 		data, err := monitRecord(rec)
 		if err == nil {
 			fmt.Println(string(data))
@@ -0,0 +1,239 @@
+package main
+
+// login module provides OAuth login providers of the server
+//
+// Copyright (c) 2020 - Valentin Kuznetsov <vkuznet@gmail.com>
+//
+
+/*
+The OAuth server authenticates browser users via one or several OpenID
+Connect providers defined by login_providers configuration, e.g. CERN SSO,
+CMS IAM or test Keycloak instance. Every provider has its own client
+credentials and callback url ({base}/callback/<name> by default).
+If several providers are configured users choose one of them on provider
+selection page, or via ?provider=<name> hint of their request. Without
+login_providers the server uses single provider defined by oauth_url,
+client_id and client_secret parameters with {base}/callback url.
+The provider used for login is kept in user session and it is used to
+refresh, revoke and end user tokens. All providers feed the same user data
+and CMS headers logic of the OAuth server.
+*/
+
+import (
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"strings"
+
+	oidc "github.com/coreos/go-oidc"
+	"golang.org/x/oauth2"
+)
+
+// defaultLoginName defines name of login provider defined by oauth_url
+const defaultLoginName = "default"
+
+// oauthLogin represents OAuth login provider of browser users
+type oauthLogin struct {
+	Name          string                // provider name
+	Title         string                // provider title shown on selection page
+	OAuth2Config  oauth2.Config         // OAuth2 configuration of the provider client
+	Verifier      *oidc.IDTokenVerifier // ID token verifier
+	Configuration OpenIDConfiguration   // OpenID configuration of the provider
+	AuthTokenURL  string                // token url of the provider
+}
+
+// OAuthLogins holds login providers of OAuth server
+var OAuthLogins []*oauthLogin
+
+// helper function to get login provider by its name, empty name refers to
+// the first (default) provider
+func loginProvider(name string) *oauthLogin {
+	for _, login := range OAuthLogins {
+		if name == "" || login.Name == name {
+			return login
+		}
+	}
+	return nil
+}
+
+// helper function to get login provider requested via provider hint of
+// HTTP request, it returns empty name if user should choose the provider
+func requestLogin(r *http.Request) string {
+	if len(OAuthLogins) == 1 {
+		return OAuthLogins[0].Name
+	}
+	name := r.URL.Query().Get("provider")
+	if name != "" && loginProvider(name) != nil {
+		return name
+	}
+	return ""
+}
+
+// helper function to check if request comes from web browser which can
+// render login selection page, API and CLI clients do not accept HTML
+func browserRequest(r *http.Request) bool {
+	for _, accept := range r.Header.Values("Accept") {
+		if strings.Contains(accept, "text/html") {
+			return true
+		}
+	}
+	return false
+}
+
+// helper function to get authorization url of login provider for given
+// state, PKCE code verifier and nonce
+func (l *oauthLogin) authCodeURL(state, verifier, nonce string) string {
+	var opts []oauth2.AuthCodeOption
+	if verifier != "" {
+		opts = append(opts,
+			oauth2.SetAuthURLParam("code_challenge", codeChallenge(verifier)),
+			oauth2.SetAuthURLParam("code_challenge_method", "S256"))
+	}
+	if nonce != "" {
+		opts = append(opts, oidc.Nonce(nonce))
+	}
+	return l.OAuth2Config.AuthCodeURL(state, opts...)
+}
+
+// helper function to get configuration of login providers, redirectURL
+// defines default callback url of the server
+func loginConfigs(cfg Configuration, redirectURL string) []LoginProvider {
+	if len(cfg.LoginProviders) == 0 {
+		return []LoginProvider{{
+			Name:         defaultLoginName,
+			OAuthURL:     cfg.OAuthURL,
+			ClientID:     cfg.ClientID,
+			ClientSecret: cfg.ClientSecret,
+			RedirectURL:  redirectURL,
+			AuthTokenURL: cfg.AuthTokenURL,
+			Scopes:       cfg.Scopes,
+		}}
+	}
+	var recs []LoginProvider
+	for _, rec := range cfg.LoginProviders {
+		if rec.ClientID == "" {
+			rec.ClientID = cfg.ClientID
+			rec.ClientSecret = cfg.ClientSecret
+		}
+		if rec.RedirectURL == "" {
+			rec.RedirectURL = fmt.Sprintf("%s/%s", strings.TrimSuffix(redirectURL, "/"), rec.Name)
+		}
+		if len(rec.Scopes) == 0 {
+			rec.Scopes = cfg.Scopes
+		}
+		recs = append(recs, rec)
+	}
+	return recs
+}
+
+// helper function to initialize login provider
+func initLogin(rec LoginProvider) (*oauthLogin, error) {
+	// Provider is a struct in oidc package that represents
+	// an OpenID Connect server's configuration.
+	provider, err := oidc.NewProvider(Context, rec.OAuthURL)
+	if err != nil {
+		msg := fmt.Sprintf("unable to initialize login provider %s, error %v", rec.Name, err)
+		return nil, errors.New(msg)
+	}
+	title := rec.Title
+	if title == "" {
+		title = rec.Name
+	}
+	scopes := rec.Scopes
+	if len(scopes) == 0 {
+		scopes = defaultScopes
+	}
+	login := &oauthLogin{
+		Name:  rec.Name,
+		Title: title,
+		// configure an OpenID Connect aware OAuth2 client
+		OAuth2Config: oauth2.Config{
+			ClientID:     rec.ClientID,
+			ClientSecret: rec.ClientSecret,
+			RedirectURL:  rec.RedirectURL,
+			Endpoint:     provider.Endpoint(),
+			Scopes:       scopes,
+		},
+		// define token ID verifier
+		Verifier: provider.Verifier(&oidc.Config{ClientID: rec.ClientID}),
+	}
+	// obtain revocation and end session endpoints of the provider
+	if err := provider.Claims(&login.Configuration); err != nil {
+		log.Printf("unable to parse OpenID configuration of login provider %s, error %v\n", rec.Name, err)
+	}
+	// authTokenUrl defines where token can be obtained
+	login.AuthTokenURL = login.Configuration.TokenEndpoint
+	if login.AuthTokenURL == "" {
+		login.AuthTokenURL = fmt.Sprintf("%s/protocol/openid-connect/token", rec.OAuthURL)
+	}
+	if rec.AuthTokenURL != "" {
+		login.AuthTokenURL = rec.AuthTokenURL
+	}
+	return login, nil
+}
+
+// helper function to initialize login providers of OAuth server
+func initLogins(cfg Configuration, redirectURL string) ([]*oauthLogin, error) {
+	var logins []*oauthLogin
+	for _, rec := range loginConfigs(cfg, redirectURL) {
+		login, err := initLogin(rec)
+		if err != nil {
+			return logins, err
+		}
+		log.Printf("login provider %s %s, callback %s\n", login.Name, rec.OAuthURL, rec.RedirectURL)
+		logins = append(logins, login)
+	}
+	return logins, nil
+}
+
+// selectionTemplate defines HTML page to choose login provider
+var selectionTemplate = template.Must(template.New("selection").Parse(`<!DOCTYPE html>
+<html>
+<head><title>Login</title></head>
+<body>
+<h3>Please choose login provider</h3>
+<ul>
+{{range .Logins}}<li><a href="{{$.Login}}?state={{$.State}}&provider={{.Name}}">{{.Title}}</a></li>
+{{end}}</ul>
+</body>
+</html>`))
+
+// helper function to write page to choose login provider for given state
+func loginSelectionPage(w http.ResponseWriter, state string) {
+	data := struct {
+		Login  string
+		State  string
+		Logins []*oauthLogin
+	}{fmt.Sprintf("%s/login", Config().Base), state, OAuthLogins}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	if err := selectionTemplate.Execute(w, data); err != nil {
+		log.Println("unable to write login selection page", err)
+	}
+}
+
+// login handler redirects user to login provider chosen on selection page
+func oauthLoginHandler(w http.ResponseWriter, r *http.Request) {
+	state := r.URL.Query().Get("state")
+	name := r.URL.Query().Get("provider")
+	login := loginProvider(name)
+	if name == "" || login == nil {
+		http.Error(w, fmt.Sprintf("unknown login provider '%s'", name), http.StatusBadRequest)
+		return
+	}
+	sess := globalSessions.SessionStart(w, r)
+	sessLock.Lock()
+	areq, ok := setAuthRequestProvider(sess, state, name)
+	err := globalSessions.SessionSave(w, sess)
+	sessLock.Unlock()
+	if !ok {
+		http.Error(w, fmt.Sprintf("state did not match, %v", state), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		log.Println("unable to save session", err)
+	}
+	http.Redirect(w, r, login.authCodeURL(state, areq.Verifier, areq.Nonce), http.StatusFound)
+}
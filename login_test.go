@@ -0,0 +1,92 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Test_loginConfigs function
+func Test_loginConfigs(t *testing.T) {
+	cfg := Configuration{OAuthURL: "https://auth.cern.ch/auth/realms/cern", ClientID: "id", ClientSecret: "secret"}
+	recs := loginConfigs(cfg, "https://cmsweb.cern.ch/callback")
+	assert.Equal(t, len(recs), 1)
+	assert.Equal(t, recs[0].Name, defaultLoginName)
+	assert.Equal(t, recs[0].RedirectURL, "https://cmsweb.cern.ch/callback")
+
+	// named providers use server credentials and callback with their name
+	cfg.LoginProviders = []LoginProvider{
+		{Name: "cern", OAuthURL: "https://auth.cern.ch/auth/realms/cern"},
+		{Name: "iam", OAuthURL: "https://cms-auth.web.cern.ch", ClientID: "iam", ClientSecret: "iam-secret"},
+	}
+	recs = loginConfigs(cfg, "https://cmsweb.cern.ch/callback")
+	assert.Equal(t, recs[0].ClientID, "id")
+	assert.Equal(t, recs[0].RedirectURL, "https://cmsweb.cern.ch/callback/cern")
+	assert.Equal(t, recs[1].ClientID, "iam")
+	assert.Equal(t, recs[1].ClientSecret, "iam-secret")
+	assert.Equal(t, recs[1].RedirectURL, "https://cmsweb.cern.ch/callback/iam")
+}
+
+// Test_loginSelection function
+func Test_loginSelection(t *testing.T) {
+	store, err := newSessionStore(SessionConfig{})
+	assert.Equal(t, err, nil)
+	globalSessions = store
+	cern := &oauthLogin{Name: "cern", Title: "CERN SSO"}
+	cern.OAuth2Config.Endpoint.AuthURL = "https://auth.cern.ch/auth"
+	iam := &oauthLogin{Name: "iam", Title: "CMS IAM"}
+	iam.OAuth2Config.Endpoint.AuthURL = "https://cms-auth.web.cern.ch/authorize"
+	OAuthLogins = []*oauthLogin{cern, iam}
+	defer func() {
+		globalSessions = nil
+		OAuthLogins = nil
+	}()
+
+	// provider hint selects login provider and it is removed from original url
+	r := httptest.NewRequest("GET", "/dbs?dataset=/a/b/c&provider=iam", nil)
+	assert.Equal(t, requestLogin(r), "iam")
+	w := httptest.NewRecorder()
+	sess := store.SessionStart(w, r)
+	cookies := w.Result().Cookies()
+	_, areq := newAuthRequest(sess, r, requestLogin(r))
+	assert.Equal(t, areq.URL, "/dbs?dataset=%2Fa%2Fb%2Fc")
+
+	// without provider hint user chooses provider on selection page, while
+	// API clients can't use it
+	r = httptest.NewRequest("GET", "/dbs", nil)
+	assert.Equal(t, requestLogin(r), "")
+	assert.Equal(t, browserRequest(r), false)
+	r.Header.Set("Accept", "text/html,application/xhtml+xml,*/*;q=0.8")
+	assert.Equal(t, browserRequest(r), true)
+	state, _ := newAuthRequest(sess, r, requestLogin(r))
+	w = httptest.NewRecorder()
+	loginSelectionPage(w, state)
+	assert.Equal(t, strings.Contains(w.Body.String(), "CMS IAM"), true)
+	assert.Equal(t, strings.Contains(w.Body.String(), "/login?state="+state+"&provider=iam"), true)
+
+	// login handler redirects user to chosen provider
+	r = httptest.NewRequest("GET", "/login?state="+state+"&provider=iam", nil)
+	for _, cookie := range cookies {
+		r.AddCookie(cookie)
+	}
+	w = httptest.NewRecorder()
+	oauthLoginHandler(w, r)
+	assert.Equal(t, w.Code, http.StatusFound)
+	loc, err := url.Parse(w.Header().Get("Location"))
+	assert.Equal(t, err, nil)
+	assert.Equal(t, loc.Host, "cms-auth.web.cern.ch")
+	assert.Equal(t, loc.Query().Get("state"), state)
+	areq, ok := popAuthRequest(sess, state)
+	assert.Equal(t, ok, true)
+	assert.Equal(t, areq.Provider, "iam")
+
+	// unknown provider is rejected
+	r = httptest.NewRequest("GET", "/login?state="+state+"&provider=evil", nil)
+	w = httptest.NewRecorder()
+	oauthLoginHandler(w, r)
+	assert.Equal(t, w.Code, http.StatusBadRequest)
+}
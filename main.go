@@ -8,15 +8,27 @@ package main
 
 /*
 The code is implemented as the following modules:
+- authtoken.go provides signed internal tokens of backend requests
+- balancer.go provides load balancing of ingress backends
+- combined.go provides implementation of combined (x509 or token) proxy server
 - config.go provides server configuration methods
 - cric.go provides CMS CRIC service functionality
 - data.go holds all data structures used in the package
+- exchange.go provides token exchange of OAuth server
+- ingress.go provides ingress rules of the server
+- listener.go provides server listeners
 - logging.go provides logging functionality
-- oauth.go provides implementation of oathProxyServer
-- x509.go provides implementation of x509ProxyServer
+- login.go provides OAuth login providers of the server
+- oauth.go provides implementation of OAuth proxy server
+- proxy.go provides reverse proxies of ingress backends
+- reload.go provides hot reload of server configuration
+- session.go provides session stores of OAuth server
+- shutdown.go provides graceful shutdown and restart of the server
+- tokencache.go provides cache of validated access tokens
+- x509.go provides implementation of x509 proxy server
 - utils.go provides various utils used in a code
 
-Both server implementations (oauthProxyServer and x509ProxyServer) support
+All server implementations (OAuth, x509, scitokens and combined) support
 /server end-point which can be used to update server settings, e.g.
 curl -X POST -H"Content-type: application/json" -d '{"verbose":true}' https://a.b.com/server
 
@@ -36,15 +48,14 @@ import (
 	"html/template"
 	"io/ioutil"
 	"log"
-	"math/rand"
 	"net/http"
-	"net/http/httputil"
-	"net/url"
 	"os"
 	"path/filepath"
+	"reflect"
 	"runtime"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	_ "expvar"         // to be used for monitoring, see https://github.com/divan/expvarmon
@@ -64,11 +75,15 @@ var NumPhysicalCores int
 // NumLogicalCores represents number of cores in our node
 var NumLogicalCores int
 
-// CMSAuth structure to create CMS Auth headers
-var CMSAuth cmsauth.CMSAuth
+// CMSAuth function provides structure to create CMS Auth headers
+func CMSAuth() *cmsauth.CMSAuth {
+	return currentState().CMSAuth
+}
 
-// OAuthProviders contains maps of all participated providers
-var OAuthProviders map[string]Provider
+// OAuthProviders function provides map of all participated providers
+func OAuthProviders() map[string]*Provider {
+	return currentState().Providers
+}
 
 // version of the code
 var version string
@@ -98,19 +113,14 @@ func (t *transport) RoundTrip(req *http.Request) (resp *http.Response, err error
 	return resp, nil
 }
 
-// Serve a reverse proxy for a given url
-func reverseProxy(targetURL string, w http.ResponseWriter, r *http.Request) {
+// Serve a reverse proxy for a given backend
+func reverseProxy(backend *Backend, w http.ResponseWriter, r *http.Request) {
 	start := time.Now()
 
-	// parse the url
-	url, _ := url.Parse(targetURL)
-
-	// create the reverse proxy
-	proxy := httputil.NewSingleHostReverseProxy(url)
+	// backend url
+	url := backend.URL
 
-	// set custom transport to capture size of response body
-	//     proxy.Transport = &transport{http.DefaultTransport}
-	if Config.Verbose > 2 {
+	if Config().Verbose > 2 {
 		log.Printf("HTTP headers: %+v\n", r.Header)
 	}
 
@@ -127,107 +137,60 @@ func reverseProxy(targetURL string, w http.ResponseWriter, r *http.Request) {
 			reqHost = name
 		}
 	}
-	if Config.XForwardedHost != "" {
-		r.Header.Set("X-Forwarded-Host", Config.XForwardedHost)
+	if Config().XForwardedHost != "" {
+		r.Header.Set("X-Forwarded-Host", Config().XForwardedHost)
 	} else {
 		r.Header.Set("X-Forwarded-Host", reqHost)
 	}
 	r.Header.Set("X-Forwarded-For", r.RemoteAddr)
 	r.Host = url.Host
-	if Config.Verbose > 0 {
+	if Config().Verbose > 0 {
 		log.Printf("proxy request: %+v\n", r)
 	}
 
-	// use custom modify response function to setup response headers
-	proxy.ModifyResponse = func(resp *http.Response) error {
-		if Config.Verbose > 0 {
-			log.Println("proxy ModifyResponse")
-		}
-		if Config.XContentTypeOptions != "" {
-			resp.Header.Set("X-Content-Type-Options", Config.XContentTypeOptions)
-		}
-		resp.Header.Set("Response-Status", resp.Status)
-		resp.Header.Set("Response-Status-Code", fmt.Sprintf("%d", resp.StatusCode))
-		resp.Header.Set("Response-Proto", resp.Proto)
-		resp.Header.Set("Response-Time", time.Since(start).String())
-		resp.Header.Set("Response-Time-Seconds", fmt.Sprintf("%v", time.Since(start).Seconds()))
-		return nil
-	}
-	proxy.ErrorHandler = func(rw http.ResponseWriter, r *http.Request, err error) {
-		if Config.Verbose > 0 {
-			log.Printf("proxy ErrorHandler error was: %+v", err)
-		}
-		header := rw.Header()
-		header.Set("Response-Status", fmt.Sprintf("%d", http.StatusBadGateway))
-		header.Set("Response-Status-Code", fmt.Sprintf("%d", http.StatusBadGateway))
-		header.Set("Response-Time", time.Since(start).String())
-		header.Set("Response-Time-Seconds", fmt.Sprintf("%v", time.Since(start).Seconds()))
-		rw.WriteHeader(http.StatusInternalServerError)
-		rw.Write([]byte(err.Error()))
-	}
+	// keep track of active connections for least-conn strategy
+	atomic.AddInt64(&backend.connections, 1)
+	defer atomic.AddInt64(&backend.connections, -1)
 
 	// ServeHttp is non blocking and uses a go routine under the hood
-	proxy.ServeHTTP(w, r)
-}
-
-// helper function to get random service url
-func srvURL(surl string) string {
-	// if we are given comma separated service urls we'll use random one
-	if strings.Contains(surl, ",") {
-		arr := strings.Split(surl, ",")
-		/* #nosec */
-		idx := rand.Intn(len(arr))         /* #nosec */
-		return strings.Trim(arr[idx], " ") // remove empty spaces around the string
-	}
-	return surl
+	backend.proxy.ServeHTTP(w, withProxyStart(r, start))
 }
 
 // helper function to redirect HTTP requests based on configuration ingress rules
 func redirect(w http.ResponseWriter, r *http.Request) {
 	// if Configuration provides Ingress rules we'll use them
 	// to redirect user request
-	for _, rec := range Config.Ingress {
-		// check that request URL path had ingress path with slash
-		if strings.Contains(r.URL.Path+"/", rec.Path+"/") {
-			if Config.Verbose > 0 {
-				log.Printf("ingress request path %s, record path %s, service url %s, old path %s, new path %s\n", r.URL.Path, rec.Path, rec.ServiceURL, rec.OldPath, rec.NewPath)
-			}
-			url := srvURL(rec.ServiceURL)
-			if rec.OldPath != "" {
-				// replace old path to new one, e.g. /couchdb/_all_dbs => /_all_dbs
-				r.URL.Path = strings.Replace(r.URL.Path, rec.OldPath, rec.NewPath, 1)
-				// if r.URL.Path ended with "/", remove it to avoid
-				// cases /path/index.html/ after old->new path substitution
-				// but for couchdb/_utils we need final slash
-				//                 if !strings.Contains(r.URL.Path, "couchdb") {
-				//                     r.URL.Path = strings.TrimSuffix(r.URL.Path, "/")
-				//                 }
-				// replace empty path with root path
-				if r.URL.Path == "" {
-					r.URL.Path = "/"
-				}
-				if Config.Verbose > 0 {
-					log.Printf("service url %s, new request path %s\n", url, r.URL.Path)
-				}
+	reg := requestIngress(r)
+	if rec := findIngressRule(reg.Rules, r); rec != nil {
+		if Config().Verbose > 0 {
+			log.Printf("ingress request host %s path %s, record host %s path %s type %s, service url %s, old path %s, new path %s\n", r.Host, r.URL.Path, rec.Host, rec.Path, rec.PathType, rec.ServiceURL, rec.OldPath, rec.NewPath)
+		}
+		setInternalToken(r, rec.Name)
+		backend := rec.Pool.Next()
+		if rec.OldPath != "" || rec.regex != nil {
+			r.URL.Path = rec.rewrite(r.URL.Path)
+			if Config().Verbose > 0 {
+				log.Printf("service url %s, new request path %s\n", backend, r.URL.Path)
 			}
-			reverseProxy(url, w, r)
-			return
 		}
+		reverseProxy(backend, w, r)
+		return
 	}
 	// if no redirection was done, then we'll use either TargetURL
 	// or return Hello reply
-	if Config.TargetURL != "" {
-		reverseProxy(Config.TargetURL, w, r)
+	if reg.Target != nil {
+		setInternalToken(r, "")
+		reverseProxy(reg.Target.Next(), w, r)
 	} else {
-		if Config.DocumentRoot != "" {
-			fname := fmt.Sprintf("%s%s", Config.DocumentRoot, r.URL.Path)
+		if Config().DocumentRoot != "" {
+			fname := fmt.Sprintf("%s%s", Config().DocumentRoot, r.URL.Path)
 			if strings.HasSuffix(fname, "css") {
 				w.Header().Set("Content-Type", "text/css")
 			} else if strings.HasSuffix(fname, "js") {
 				w.Header().Set("Content-Type", "application/javascript")
 			}
 			if r.URL.Path == "/" {
-				fname = fmt.Sprintf("%s/index.html", Config.DocumentRoot)
+				fname = fmt.Sprintf("%s/index.html", Config().DocumentRoot)
 			}
 			if _, err := os.Stat(fname); err == nil {
 				body, err := ioutil.ReadFile(filepath.Clean(fname))
@@ -239,8 +202,8 @@ func redirect(w http.ResponseWriter, r *http.Request) {
 			}
 		}
 		// use static page content if provided in configuration
-		if Config.StaticPage != "" {
-			tmpl := template.Must(template.ParseFiles(Config.StaticPage))
+		if Config().StaticPage != "" {
+			tmpl := template.Must(template.ParseFiles(Config().StaticPage))
 			tmpl.Execute(w, "")
 			return
 		}
@@ -273,8 +236,12 @@ func settingsHandler(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
-	Config.Verbose = s.Verbose
-	log.Println("Update verbose level of config", Config)
+	updateState(func(st *serverState) {
+		cfg := *st.Config
+		cfg.Verbose = s.Verbose
+		st.Config = &cfg
+	})
+	log.Println("Update verbose level of config", *Config())
 	w.WriteHeader(http.StatusOK)
 	return
 }
@@ -293,7 +260,7 @@ func metricsHandler(w http.ResponseWriter, r *http.Request) {
 // helper function to return version string of the server
 func info() string {
 	goVersion := runtime.Version()
-	tstamp := time.Now().Format("2006-02-01")
+	tstamp := time.Now().Format("2006-01-02")
 	return fmt.Sprintf("auth-proxy-server git=%s go=%s date=%s", version, goVersion, tstamp)
 }
 
@@ -304,33 +271,64 @@ func main() {
 	flag.BoolVar(&useX509, "useX509", false, "start X509 auth server")
 	var scitokens bool
 	flag.BoolVar(&scitokens, "scitokens", false, "start scitokens server")
+	var combined bool
+	flag.BoolVar(&combined, "combined", false, "start combined server which accepts x509 certificates or tokens")
 	var version bool
 	flag.BoolVar(&version, "version", false, "print version information about the server")
+	var validate bool
+	flag.BoolVar(&validate, "validate", false, "validate configuration file and exit")
+	var envs bool
+	flag.BoolVar(&envs, "envs", false, "print environment variables which override configuration and exit")
+	var dump string
+	flag.StringVar(&dump, "dump-config", "", "print effective configuration in given format (json, yaml, toml) with redacted secrets and exit")
 	flag.Parse()
 	if version {
 		fmt.Println(info())
 		os.Exit(0)
 	}
+	if envs {
+		for _, env := range envVars(envPrefix, "", reflect.TypeOf(Configuration{})) {
+			fmt.Printf("%s\t%s (%s)\n", env.Name, env.Key, env.Type)
+		}
+		os.Exit(0)
+	}
 	err := parseConfig(config)
+	if validate {
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		fmt.Printf("configuration %s is valid\n", config)
+		os.Exit(0)
+	}
 	if err != nil {
 		log.Fatalf("unable to parse config %s, error %v\n", config, err)
 	}
+	if dump != "" {
+		data, err := dumpConfig(*Config(), dump)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		fmt.Println(string(data))
+		os.Exit(0)
+	}
 
 	// configure logger with log time, filename, and line number
 	log.SetFlags(0)
-	if Config.Verbose > 0 {
+	if Config().Verbose > 0 {
 		log.SetFlags(log.Lshortfile)
 	}
 	log.SetOutput(new(logWriter))
-	if Config.LogFile != "" {
-		rl, err := rotatelogs.New(Config.LogFile + "-%Y%m%d")
+	if Config().LogFile != "" {
+		rl, err := rotatelogs.New(Config().LogFile + "-%Y%m%d")
 		if err == nil {
 			rotlogs := rotateLogWriter{RotateLogs: rl}
 			log.SetOutput(rotlogs)
 		}
 	}
-	if Config.Verbose > 0 {
-		log.Printf("%+v\n", Config)
+	if Config().Verbose > 0 {
+		log.Printf("%+v\n", *Config())
 	}
 
 	// setup StartTime and metrics last update time
@@ -348,28 +346,43 @@ func main() {
 	}
 
 	// initialize all particiapted providers
-	OAuthProviders = make(map[string]Provider)
-	for _, purl := range Config.Providers {
-		log.Println("initialize provider ", purl)
-		p := Provider{}
-		err := p.Init(purl)
-		if err != nil {
-			log.Fatalf("fail to initialize %s error %v", p.URL, err)
-		}
-		OAuthProviders[purl] = p
+	providers, err := initProviders(*Config())
+	if err != nil {
+		log.Fatalf("fail to initialize providers, error %v", err)
+	}
+
+	auth := &cmsauth.CMSAuth{}
+	auth.Init(Config().Hmac)
+	updateState(func(st *serverState) {
+		st.Providers = providers
+		st.CMSAuth = auth
+		// initialize cache of validated access tokens
+		st.AccessTokens = newTokenCache(st.Config.TokenCache.Size)
+	})
+
+	// initialize ingress rules and their backend pools
+	err = initIngressRules()
+	if err != nil {
+		log.Fatalf("unable to initialize ingress rules, error %v\n", err)
 	}
 
-	CMSAuth.Init(Config.Hmac)
+	// watch configuration file and reload it on changes or SIGHUP signal
+	go watchConfig(config)
+
+	// periodically refresh JWKS of participated providers
+	go refreshProviders()
+
+	// periodically update CRIC records shared by all listeners
+	go updateCricRecords()
 
 	// start our servers
+	method := "oauth"
 	if useX509 {
-		go updateCricRecords("dn")
-		x509ProxyServer()
-		return
+		method = "x509"
 	} else if scitokens {
-		scitokensServer()
-		return
+		method = "scitokens"
+	} else if combined {
+		method = "combined"
 	}
-	go updateCricRecords("id")
-	oauthProxyServer()
+	startListeners(serverListeners(*Config(), method))
 }
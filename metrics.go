@@ -8,6 +8,7 @@ import (
 	"fmt"
 	"os"
 	"runtime"
+	"sync/atomic"
 	"time"
 
 	"github.com/shirou/gopsutil/cpu"
@@ -66,6 +67,11 @@ func metrics() Metrics {
 	metrics.PostX509Requests = TotalX509PostRequests
 	metrics.GetOAuthRequests = TotalOAuthGetRequests
 	metrics.PostOAuthRequests = TotalOAuthPostRequests
+	metrics.TokenRefreshes = TotalTokenRefreshes
+	metrics.TokenRefreshFails = TotalTokenRefreshFails
+	metrics.TokenCacheHits = atomic.LoadUint64(&TotalTokenCacheHits)
+	metrics.TokenCacheMisses = atomic.LoadUint64(&TotalTokenCacheMisses)
+	metrics.TokenCacheSize = uint64(AccessTokens().Len())
 	metrics.GetRequests = metrics.GetX509Requests + metrics.GetOAuthRequests
 	metrics.PostRequests = metrics.PostX509Requests + metrics.PostOAuthRequests
 	if (metrics.GetRequests + metrics.PostRequests) > 0 {
@@ -188,6 +194,21 @@ func promMetrics() string {
 	out += fmt.Sprintf("# HELP %s_post_oauth_requests reports total number of OAuth HTTP POST requests\n", prefix)
 	out += fmt.Sprintf("# TYPE %s_post_oauth_requests counter\n", prefix)
 	out += fmt.Sprintf("%s_post_oauth_requests %v\n", prefix, data.PostOAuthRequests)
+	out += fmt.Sprintf("# HELP %s_token_refreshes reports total number of refreshed access tokens of OAuth sessions\n", prefix)
+	out += fmt.Sprintf("# TYPE %s_token_refreshes counter\n", prefix)
+	out += fmt.Sprintf("%s_token_refreshes %v\n", prefix, data.TokenRefreshes)
+	out += fmt.Sprintf("# HELP %s_token_refresh_fails reports total number of failed refreshes of access tokens of OAuth sessions\n", prefix)
+	out += fmt.Sprintf("# TYPE %s_token_refresh_fails counter\n", prefix)
+	out += fmt.Sprintf("%s_token_refresh_fails %v\n", prefix, data.TokenRefreshFails)
+	out += fmt.Sprintf("# HELP %s_token_cache_hits reports total number of access tokens found in token cache\n", prefix)
+	out += fmt.Sprintf("# TYPE %s_token_cache_hits counter\n", prefix)
+	out += fmt.Sprintf("%s_token_cache_hits %v\n", prefix, data.TokenCacheHits)
+	out += fmt.Sprintf("# HELP %s_token_cache_misses reports total number of access tokens not found in token cache\n", prefix)
+	out += fmt.Sprintf("# TYPE %s_token_cache_misses counter\n", prefix)
+	out += fmt.Sprintf("%s_token_cache_misses %v\n", prefix, data.TokenCacheMisses)
+	out += fmt.Sprintf("# HELP %s_token_cache_size reports number of access tokens in token cache\n", prefix)
+	out += fmt.Sprintf("# TYPE %s_token_cache_size gauge\n", prefix)
+	out += fmt.Sprintf("%s_token_cache_size %v\n", prefix, data.TokenCacheSize)
 
 	// total requests
 	out += fmt.Sprintf("# HELP %s_get_requests reports total number of HTTP GET requests\n", prefix)
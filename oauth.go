@@ -14,6 +14,7 @@ CMS CRIC meta-data. An additional hmac is set via cmsauth package.
 The server can be initialize either as HTTP or HTTPs and provides the
 following end-points
 - /token/renew renew user tokens
+- /token/exchange exchange user token to token of ingress backend (if enabled)
 - /token returns information about tokens
 - /callback handles the callback authentication requests
 - / performs reverse proxy redirects to backends defined in ingress part of configuration
@@ -29,9 +30,14 @@ CERN SSO OAuth2 OICD
 
 import (
 	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"html/template"
+	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
@@ -45,7 +51,6 @@ import (
 	oidc "github.com/coreos/go-oidc"
 	"github.com/google/uuid"
 	"github.com/thomasdarimont/go-kc-example/session"
-	_ "github.com/thomasdarimont/go-kc-example/session_memory"
 	"golang.org/x/oauth2"
 )
 
@@ -55,37 +60,106 @@ var TotalOAuthGetRequests uint64
 // TotalOAuthPostRequests counts total number of POST requests received by the server
 var TotalOAuthPostRequests uint64
 
-// AuthTokenURL holds url for token authentication
-var AuthTokenURL string
+// TotalTokenRefreshes counts total number of refreshed access tokens of sessions
+var TotalTokenRefreshes uint64
 
-// OAuth2Config holds OAuth2 configuration
-var OAuth2Config oauth2.Config
+// TotalTokenRefreshFails counts total number of failed refreshes of access tokens of sessions
+var TotalTokenRefreshFails uint64
 
-// Verifier is ID token verifier
-var Verifier *oidc.IDTokenVerifier
+// authRequestTTL defines time to complete authentication of the user at
+// OAuth provider
+const authRequestTTL = 10 * time.Minute
+
+// maxAuthRequests defines max number of pending authentication requests of
+// the session, e.g. of concurrent browser tabs
+const maxAuthRequests = 5
+
+// maxReplayFormSize defines max size of form of POST request which is
+// replayed after authentication
+const maxReplayFormSize = 2048
+
+// refreshWindow defines time (in sec) before access token expiration when
+// the token of user session is refreshed
+const refreshWindow = 60
+
+// LogoutRedirectURL holds url where users are redirected after logout
+var LogoutRedirectURL string
 
 // Context for our requests
 var Context context.Context
 
-// globalSession manager for our HTTP requests
-var globalSessions *session.Manager
+// globalSessions keeps session store for our HTTP requests
+var globalSessions SessionStore
 
 // sessLock keeps lock for sess updates
 var sessLock sync.RWMutex
 
-// initialize global session manager
-func init() {
-	globalSessions, _ = session.NewManager("memory", "gosessionid", 3600)
-	go globalSessions.GC()
+// refreshCall represents refresh of session tokens shared by concurrent
+// requests of the session
+type refreshCall struct {
+	RefreshToken string        // refresh token used to renew tokens
+	TokenInfo    TokenInfo     // renewed tokens
+	Error        error         // refresh error
+	Expire       time.Time     // time until result is reused by requests of the session
+	done         chan struct{} // closed when refresh is completed
+}
+
+// refreshCalls holds refreshes of session tokens keyed by session id
+var refreshCalls = make(map[string]*refreshCall)
+
+// refreshLock protects refresh calls
+var refreshLock sync.Mutex
+
+// helper function to renew tokens of given session only once for concurrent
+// requests, e.g. browser loads of page resources, since provider rotates
+// refresh token and rejects reused one. The result is kept for
+// refreshWindow seconds for requests which still carry old tokens (e.g. in
+// session cookie) and is applied to their sessions.
+func renewSessionToken(sid, provider, refreshToken string, r *http.Request) (TokenInfo, error) {
+	now := time.Now()
+	refreshLock.Lock()
+	for key, call := range refreshCalls {
+		if isClosed(call.done) && now.After(call.Expire) {
+			delete(refreshCalls, key)
+		}
+	}
+	call, ok := refreshCalls[sid]
+	if ok && call.RefreshToken == refreshToken {
+		refreshLock.Unlock()
+		<-call.done
+		return call.TokenInfo, call.Error
+	}
+	call = &refreshCall{RefreshToken: refreshToken, done: make(chan struct{})}
+	refreshCalls[sid] = call
+	refreshLock.Unlock()
+
+	call.TokenInfo, call.Error = renewToken(loginProvider(provider), refreshToken, r)
+	call.Expire = time.Now().Add(refreshWindow * time.Second)
+	close(call.done)
+	return call.TokenInfo, call.Error
+}
+
+// helper function to check if given channel is closed
+func isClosed(ch chan struct{}) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
 }
 
 // helper function to verify/validate given token
 func introspectToken(token string) (TokenAttributes, error) {
-	verifyURL := fmt.Sprintf("%s/introspect", AuthTokenURL)
+	login := loginProvider("")
+	if login == nil {
+		return TokenAttributes{}, errors.New("no login provider")
+	}
+	verifyURL := fmt.Sprintf("%s/introspect", login.AuthTokenURL)
 	form := url.Values{}
 	form.Add("token", token)
-	form.Add("client_id", Config.ClientID)
-	form.Add("client_secret", Config.ClientSecret)
+	form.Add("client_id", login.OAuth2Config.ClientID)
+	form.Add("client_secret", login.OAuth2Config.ClientSecret)
 	r, err := http.NewRequest("POST", verifyURL, strings.NewReader(form.Encode()))
 	if err != nil {
 		msg := fmt.Sprintf("unable to POST request to %s, %v", verifyURL, err)
@@ -94,12 +168,12 @@ func introspectToken(token string) (TokenAttributes, error) {
 	r.Header.Add("Content-Type", "application/x-www-form-urlencoded")
 	r.Header.Add("User-Agent", "go-client")
 	client := http.Client{}
-	if Config.Verbose > 1 {
+	if Config().Verbose > 1 {
 		dump, err := httputil.DumpRequestOut(r, true)
 		log.Println("request", string(dump), err)
 	}
 	resp, err := client.Do(r)
-	if Config.Verbose > 1 {
+	if Config().Verbose > 1 {
 		dump, err := httputil.DumpResponse(resp, true)
 		log.Println("response", string(dump), err)
 	}
@@ -124,37 +198,40 @@ func introspectToken(token string) (TokenAttributes, error) {
 }
 
 // helper function to renew access token of the client
-func renewToken(token string, r *http.Request) (TokenInfo, error) {
+func renewToken(login *oauthLogin, token string, r *http.Request) (TokenInfo, error) {
 	if token == "" {
 		msg := fmt.Sprintf("empty authorization token")
 		return TokenInfo{}, errors.New(msg)
 	}
+	if login == nil {
+		return TokenInfo{}, errors.New("no login provider")
+	}
 	form := url.Values{}
 	form.Add("refresh_token", token)
 	form.Add("grant_type", "refresh_token")
-	form.Add("client_id", Config.ClientID)
-	form.Add("client_secret", Config.ClientSecret)
-	r, err := http.NewRequest("POST", AuthTokenURL, strings.NewReader(form.Encode()))
+	form.Add("client_id", login.OAuth2Config.ClientID)
+	form.Add("client_secret", login.OAuth2Config.ClientSecret)
+	r, err := http.NewRequest("POST", login.AuthTokenURL, strings.NewReader(form.Encode()))
 	if err != nil {
-		msg := fmt.Sprintf("unable to POST request to %s, %v", AuthTokenURL, err)
+		msg := fmt.Sprintf("unable to POST request to %s, %v", login.AuthTokenURL, err)
 		return TokenInfo{}, errors.New(msg)
 	}
 	r.Header.Add("Content-Type", "application/x-www-form-urlencoded")
 	r.Header.Add("User-Agent", "go-client")
 	client := http.Client{}
-	if Config.Verbose > 1 {
+	if Config().Verbose > 1 {
 		dump, err := httputil.DumpRequestOut(r, true)
 		log.Println("request", string(dump), err)
 	}
 	resp, err := client.Do(r)
-	if Config.Verbose > 1 {
-		dump, err := httputil.DumpResponse(resp, true)
-		log.Println("response", string(dump), err)
-	}
 	if err != nil {
 		msg := fmt.Sprintf("validate error: %+v", err)
 		return TokenInfo{}, errors.New(msg)
 	}
+	if Config().Verbose > 1 {
+		dump, err := httputil.DumpResponse(resp, true)
+		log.Println("response", string(dump), err)
+	}
 	defer resp.Body.Close()
 	var tokenInfo TokenInfo
 	data, err := ioutil.ReadAll(resp.Body)
@@ -162,6 +239,10 @@ func renewToken(token string, r *http.Request) (TokenInfo, error) {
 		msg := fmt.Sprintf("unable to read response body %s error %v", string(data), err)
 		return TokenInfo{}, errors.New(msg)
 	}
+	if resp.StatusCode != http.StatusOK {
+		msg := fmt.Sprintf("unable to renew token, status %s, response %s", resp.Status, string(data))
+		return TokenInfo{}, errors.New(msg)
+	}
 	err = json.Unmarshal(data, &tokenInfo)
 	if err != nil {
 		msg := fmt.Sprintf("unable to decode response body, error %v", err)
@@ -170,68 +251,354 @@ func renewToken(token string, r *http.Request) (TokenInfo, error) {
 	return tokenInfo, nil
 }
 
-// helper function to inspect token against all participated providers
+// helper function to generate random URL safe string from given number of
+// random bytes
+func randomString(size int) string {
+	b := make([]byte, size)
+	if _, err := io.ReadFull(rand.Reader, b); err != nil {
+		log.Println("unable to generate random string", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// helper function to get PKCE S256 code challenge of given code verifier,
+// see RFC 7636
+func codeChallenge(verifier string) string {
+	hash := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(hash[:])
+}
+
+// default scopes requested from OAuth provider
+var defaultScopes = []string{oidc.ScopeOpenID, "profile", "email"}
+
+// helper function to get scopes requested from OAuth provider
+func oauthScopes() []string {
+	if len(Config().Scopes) > 0 {
+		return Config().Scopes
+	}
+	return defaultScopes
+}
+
+// helper function to store original request of the user in the session
+// under new OAuth state along with PKCE code verifier and nonce of
+// authorization request and given login provider (empty if user should
+// choose it), it should be called under sessLock
+func newAuthRequest(sess session.Session, r *http.Request, provider string) (string, AuthRequest) {
+	now := time.Now().UnixNano()
+	areq := AuthRequest{URL: r.URL.RequestURI(), Method: r.Method, Provider: provider, Created: now}
+	// remove login provider hint from original url
+	if query := r.URL.Query(); len(OAuthLogins) > 1 && query.Get("provider") != "" {
+		query.Del("provider")
+		rurl := *r.URL
+		rurl.RawQuery = query.Encode()
+		areq.URL = rurl.RequestURI()
+	}
+	if !Config().DisablePKCE {
+		areq.Verifier = randomString(32)
+	}
+	if !Config().DisableNonce {
+		areq.Nonce = randomString(16)
+	}
+	// keep form of small POST requests to replay them after authentication,
+	// forms of cross-site requests are not kept since another site could
+	// forge them on behalf of the user
+	ctype := r.Header.Get("Content-Type")
+	if r.Method == "POST" && strings.HasPrefix(ctype, "application/x-www-form-urlencoded") &&
+		r.ContentLength > 0 && r.ContentLength <= maxReplayFormSize && sameOriginRequest(r) {
+		if err := r.ParseForm(); err == nil {
+			areq.Form = r.PostForm
+		}
+	}
+
+	// keep only recent auth requests, e.g. of concurrent browser tabs
+	requests := make(map[string]AuthRequest)
+	if recs, ok := sess.Get("authRequests").(map[string]AuthRequest); ok {
+		for key, rec := range recs {
+			if time.Duration(now-rec.Created) < authRequestTTL {
+				requests[key] = rec
+			}
+		}
+	}
+	for len(requests) >= maxAuthRequests {
+		var oldest string
+		for key, rec := range requests {
+			if oldest == "" || rec.Created < requests[oldest].Created {
+				oldest = key
+			}
+		}
+		delete(requests, oldest)
+	}
+	state := uuid.New().String()
+	requests[state] = areq
+	sess.Set("authRequests", requests)
+	return state, areq
+}
+
+// helper function to get and remove auth request of given OAuth state from
+// the session, it should be called under sessLock
+func popAuthRequest(sess session.Session, state string) (AuthRequest, bool) {
+	recs, ok := sess.Get("authRequests").(map[string]AuthRequest)
+	if !ok || state == "" {
+		return AuthRequest{}, false
+	}
+	areq, ok := recs[state]
+	if !ok || time.Duration(time.Now().UnixNano()-areq.Created) >= authRequestTTL {
+		return AuthRequest{}, false
+	}
+	requests := make(map[string]AuthRequest)
+	for key, rec := range recs {
+		if key != state {
+			requests[key] = rec
+		}
+	}
+	sess.Set("authRequests", requests)
+	return areq, true
+}
+
+// helper function to set login provider of auth request of given OAuth
+// state, it should be called under sessLock
+func setAuthRequestProvider(sess session.Session, state, provider string) (AuthRequest, bool) {
+	recs, ok := sess.Get("authRequests").(map[string]AuthRequest)
+	if !ok || state == "" {
+		return AuthRequest{}, false
+	}
+	areq, ok := recs[state]
+	if !ok || time.Duration(time.Now().UnixNano()-areq.Created) >= authRequestTTL {
+		return AuthRequest{}, false
+	}
+	areq.Provider = provider
+	requests := make(map[string]AuthRequest)
+	for key, rec := range recs {
+		requests[key] = rec
+	}
+	requests[state] = areq
+	sess.Set("authRequests", requests)
+	return areq, true
+}
+
+// helper function to check that redirect target points to our server, it
+// returns base path of the server for targets pointing to other hosts
+func safeRedirectURL(target string) string {
+	home := fmt.Sprintf("%s/", Config().Base)
+	// reject protocol relative and backslash urls which browsers treat as
+	// urls of other hosts, e.g. //evil.com or /\evil.com
+	if target == "" || strings.HasPrefix(target, "//") || strings.Contains(target, "\\") {
+		return home
+	}
+	rurl, err := url.Parse(target)
+	if err != nil {
+		return home
+	}
+	if rurl.Scheme == "" && rurl.Host == "" && strings.HasPrefix(rurl.Path, "/") {
+		return target
+	}
+	// absolute urls are allowed only for hosts of redirect urls
+	for _, login := range OAuthLogins {
+		ourl, err := url.Parse(login.OAuth2Config.RedirectURL)
+		if err != nil || ourl.Host == "" {
+			continue
+		}
+		if (rurl.Scheme == "https" || rurl.Scheme == "http") && rurl.Host == ourl.Host {
+			return target
+		}
+	}
+	log.Printf("reject redirect to %s\n", target)
+	return home
+}
+
+// helper function to check if request is sent by page of our server, i.e.
+// it is not cross-site request of another site
+func sameOriginRequest(r *http.Request) bool {
+	if site := r.Header.Get("Sec-Fetch-Site"); site != "" {
+		return site == "same-origin"
+	}
+	origin := r.Header.Get("Origin")
+	if origin == "" || origin == "null" {
+		return false
+	}
+	ourl, err := url.Parse(origin)
+	return err == nil && ourl.Host == r.Host
+}
+
+// replayTemplate defines HTML page which allows user to re-submit original
+// POST request after authentication, the form is submitted by explicit
+// user action only
+var replayTemplate = template.Must(template.New("replay").Parse(`<!DOCTYPE html>
+<html>
+<body>
+<p>You are authenticated, please confirm submission of your original request to {{.URL}}</p>
+<form method="POST" action="{{.URL}}">
+{{range $key, $values := .Form}}{{range $values}}<input type="hidden" name="{{$key}}" value="{{.}}">
+{{end}}{{end}}<input type="submit" value="Continue">
+</form>
+</body>
+</html>`))
+
+// helper function to replay original POST request of the user
+func replayPost(w http.ResponseWriter, target string, form url.Values) {
+	data := struct {
+		URL  string
+		Form url.Values
+	}{target, form}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	if err := replayTemplate.Execute(w, data); err != nil {
+		log.Println("unable to replay POST request", err)
+	}
+}
+
+// helper function to revoke given token at revocation endpoint of OAuth
+// provider, see RFC 7009
+func revokeToken(login *oauthLogin, token, tokenType string) error {
+	if login == nil {
+		return errors.New("no login provider")
+	}
+	rurl := login.Configuration.RevocationEndpoint
+	if rurl == "" {
+		return errors.New("OAuth provider does not provide revocation endpoint")
+	}
+	form := url.Values{}
+	form.Add("token", token)
+	form.Add("token_type_hint", tokenType)
+	form.Add("client_id", login.OAuth2Config.ClientID)
+	form.Add("client_secret", login.OAuth2Config.ClientSecret)
+	resp, err := http.PostForm(rurl, form)
+	if err != nil {
+		msg := fmt.Sprintf("unable to POST request to %s, %v", rurl, err)
+		return errors.New(msg)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		data, _ := ioutil.ReadAll(resp.Body)
+		msg := fmt.Sprintf("unable to revoke token, status %s, response %s", resp.Status, string(data))
+		return errors.New(msg)
+	}
+	return nil
+}
+
+// helper function to store tokens in user session along with their absolute
+// expiration times, it should be called under sessLock
+func setSessionTokens(sess session.Session, tokenInfo TokenInfo) {
+	now := time.Now().Unix()
+	if tokenInfo.AccessToken != "" {
+		sess.Set("accessToken", tokenInfo.AccessToken)
+		sess.Set("accessExpire", tokenInfo.AccessExpire)
+		sess.Set("accessExpireAt", now+tokenInfo.AccessExpire)
+	}
+	if tokenInfo.RefreshToken != "" {
+		sess.Set("refreshToken", tokenInfo.RefreshToken)
+		sess.Set("refreshExpire", tokenInfo.RefreshExpire)
+		// zero refresh_expires_in means that refresh token does not expire,
+		// e.g. offline token
+		var expireAt int64
+		if tokenInfo.RefreshExpire > 0 {
+			expireAt = now + tokenInfo.RefreshExpire
+		}
+		sess.Set("refreshExpireAt", expireAt)
+	}
+	if tokenInfo.IDToken != "" {
+		sess.Set("rawIDToken", tokenInfo.IDToken)
+	}
+}
+
+// helper function to remove tokens from user session, it should be called
+// under sessLock
+func clearSessionTokens(sess session.Session) {
+	for _, key := range []string{"accessToken", "accessExpire", "accessExpireAt", "refreshToken", "refreshExpire", "refreshExpireAt", "rawIDToken", "userinfo"} {
+		sess.Delete(key)
+	}
+}
+
+// helper function to refresh access token of user session if it expires
+// within refreshWindow seconds. The tokens are removed from the session
+// if refresh token is expired or refresh fails, i.e. user should
+// re-authenticate via SSO. It returns true if session has valid access token.
+func refreshSessionToken(sess session.Session, r *http.Request) bool {
+	now := time.Now().Unix()
+	sessLock.Lock()
+	accessExpireAt, _ := sess.Get("accessExpireAt").(int64)
+	refreshExpireAt, _ := sess.Get("refreshExpireAt").(int64)
+	refreshToken, _ := sess.Get("refreshToken").(string)
+	provider, _ := sess.Get("provider").(string)
+	hasToken := sess.Get("accessToken") != nil
+	sessLock.Unlock()
+	if !hasToken || accessExpireAt == 0 {
+		// session without tokens or tokens without expiration
+		return hasToken
+	}
+	if now < accessExpireAt-refreshWindow {
+		return true
+	}
+	if refreshToken == "" || (refreshExpireAt > 0 && now >= refreshExpireAt) {
+		if Config().Verbose > 0 {
+			log.Println("access and refresh tokens of session are expired")
+		}
+		sessLock.Lock()
+		clearSessionTokens(sess)
+		sessLock.Unlock()
+		return false
+	}
+	// renew token outside of the lock to not block other requests, the
+	// concurrent requests of the session share single refresh and then
+	// store its tokens in their session
+	tokenInfo, err := renewSessionToken(sess.SessionID(), provider, refreshToken, r)
+	sessLock.Lock()
+	defer sessLock.Unlock()
+	if err != nil || tokenInfo.AccessToken == "" {
+		log.Printf("unable to refresh access token of session, error %v\n", err)
+		atomic.AddUint64(&TotalTokenRefreshFails, 1)
+		clearSessionTokens(sess)
+		return false
+	}
+	atomic.AddUint64(&TotalTokenRefreshes, 1)
+	setSessionTokens(sess, tokenInfo)
+	if Config().Verbose > 0 {
+		log.Printf("refreshed access token of session, expires in %d sec\n", tokenInfo.AccessExpire)
+	}
+	return true
+}
+
+// helper function to inspect token against all participated providers, it
+// returns tokenError if token of the provider violates its validation rule
 func inspectTokenProviders(token string) (TokenAttributes, error) {
-	for _, purl := range Config.Providers {
-		if p, ok := OAuthProviders[purl]; ok {
+	var rejected error
+	for _, purl := range Config().Providers {
+		if p, ok := OAuthProviders()[purl]; ok {
 			attrs, err := inspectToken(p, token)
 			if err == nil {
-				if Config.Verbose > 0 {
+				if Config().Verbose > 0 {
 					log.Println("token is validated with provider ", purl)
 				}
 				return attrs, nil
 			} else {
 				log.Println("provider", p.URL, " token error ", err)
 			}
+			var terr *tokenError
+			if rejected == nil && errors.As(err, &terr) {
+				rejected = err
+			}
 		}
 	}
-	msg := fmt.Sprintf("Token is not valid with participated providers: %v", Config.Providers)
+	if rejected != nil {
+		return TokenAttributes{}, rejected
+	}
+	msg := fmt.Sprintf("Token is not valid with participated providers: %v", Config().Providers)
 	return TokenAttributes{}, errors.New(msg)
 }
 
 // inspect token and extract token attributes
-func inspectToken(provider Provider, token string) (TokenAttributes, error) {
+func inspectToken(provider *Provider, token string) (TokenAttributes, error) {
 	var attrs TokenAttributes
 	claims, err := tokenClaims2(provider, token)
 	if err != nil {
 		return attrs, err
 	}
-	if Config.Verbose > 1 {
+	if Config().Verbose > 1 {
 		log.Println("token claims", claims)
 	}
-	for k, v := range claims {
-		if k == "email" {
-			attrs.Email = fmt.Sprintf("%v", v)
-		}
-		if k == "cern_upn" || k == "preferred_username" {
-			attrs.UserName = fmt.Sprintf("%v", v)
-		}
-		if k == "cern_person_id" {
-			attrs.ClientID = fmt.Sprintf("%v", v)
-		}
-		if k == "session_state" {
-			attrs.SessionState = fmt.Sprintf("%v", v)
-		}
-		if k == "exp" {
-			switch val := v.(type) {
-			case float64:
-				attrs.Expiration = int64(val)
-			case int64:
-				attrs.Expiration = val
-			}
-		}
-		if k == "scope" {
-			attrs.Scope = fmt.Sprintf("%v", v)
-		}
-		if k == "cern_roles" {
-			s := fmt.Sprintf("%v", v)
-			s = strings.Replace(s, "[", "", -1)
-			s = strings.Replace(s, "]", "", -1)
-			attrs.Scope = s
-		}
-	}
+	attrs = claimsAttributes(claims)
 	attrs.Active = true
-	if Config.Verbose > 1 {
+	if Config().Verbose > 1 {
 		if err := printJSON(attrs, "token attributes"); err != nil {
 			msg := fmt.Sprintf("Failed to output token attributes: %v", err)
 			log.Println(msg)
@@ -240,6 +607,108 @@ func inspectToken(provider Provider, token string) (TokenAttributes, error) {
 	return attrs, err
 }
 
+// default names of token claims of user attributes, the first existing
+// claim is used
+var (
+	defaultUsernameClaims = []string{"cern_upn", "preferred_username"}
+	defaultIDClaims       = []string{"cern_person_id"}
+	defaultEmailClaims    = []string{"email"}
+	defaultRolesClaims    = []string{"cern_roles", "scope"}
+	defaultGroupsClaims   = []string{} // groups are used only if their claim is configured
+)
+
+// helper function to get value of first existing claim from given list of
+// claim names
+func claimValue(claims map[string]interface{}, names []string) (interface{}, bool) {
+	for _, name := range names {
+		if v, ok := claims[name]; ok && v != nil {
+			return v, true
+		}
+	}
+	return nil, false
+}
+
+// helper function to convert claim value into list of strings
+func claimList(v interface{}) []string {
+	var out []string
+	switch val := v.(type) {
+	case []interface{}:
+		for _, item := range val {
+			out = append(out, fmt.Sprintf("%v", item))
+		}
+	case []string:
+		out = val
+	case string:
+		out = strings.Fields(val)
+	default:
+		out = append(out, fmt.Sprintf("%v", val))
+	}
+	return out
+}
+
+// helper function to get claim names of given configuration or defaults
+func claimNames(names, defaults []string) []string {
+	if len(names) > 0 {
+		return names
+	}
+	return defaults
+}
+
+// helper function to get token attributes from token claims using claims
+// mapping of server configuration
+func claimsAttributes(claims map[string]interface{}) TokenAttributes {
+	var attrs TokenAttributes
+	mapping := Config().Claims
+	if v, ok := claimValue(claims, claimNames(mapping.Username, defaultUsernameClaims)); ok {
+		attrs.UserName = fmt.Sprintf("%v", v)
+	}
+	if v, ok := claimValue(claims, claimNames(mapping.ID, defaultIDClaims)); ok {
+		// numeric ids are decoded as float64, therefore avoid exponent format
+		if f, ok := v.(float64); ok {
+			v = int64(f)
+		}
+		attrs.ClientID = fmt.Sprintf("%v", v)
+	}
+	if v, ok := claimValue(claims, claimNames(mapping.Email, defaultEmailClaims)); ok {
+		attrs.Email = fmt.Sprintf("%v", v)
+	}
+	if v, ok := claimValue(claims, claimNames(mapping.Roles, defaultRolesClaims)); ok {
+		attrs.Scope = strings.Join(claimList(v), " ")
+	}
+	if v, ok := claimValue(claims, claimNames(mapping.Groups, defaultGroupsClaims)); ok {
+		attrs.Groups = claimList(v)
+	}
+	if v, ok := claims["session_state"]; ok {
+		attrs.SessionState = fmt.Sprintf("%v", v)
+	}
+	switch val := claims["exp"].(type) {
+	case float64:
+		attrs.Expiration = int64(val)
+	case int64:
+		attrs.Expiration = val
+	}
+	return attrs
+}
+
+// helper function to map userinfo claims of the session to user data and
+// token attributes using claims mapping of server configuration, as it is
+// done for claims of access tokens
+func mapUserInfo(userData map[string]interface{}, attrs *TokenAttributes) {
+	uattrs := claimsAttributes(userData)
+	if uattrs.UserName != "" {
+		userData["name"] = uattrs.UserName
+	}
+	if uattrs.Email != "" {
+		userData["email"] = uattrs.Email
+	}
+	if attrs.ClientID == "" {
+		attrs.ClientID = uattrs.ClientID
+	}
+	if len(attrs.Groups) == 0 {
+		attrs.Groups = uattrs.Groups
+	}
+}
+
 // helper function to get token from http request
 func getToken(r *http.Request) string {
 	tokenStr := r.Header.Get("Authorization")
@@ -260,19 +729,42 @@ func checkAccessToken(r *http.Request) (TokenAttributes, error) {
 		return TokenAttributes{}, errors.New("no token present in HTTP request")
 	}
 
+	// verify token, its attributes may come from token cache
+	attrs, err := verifyAccessToken(token)
+	if err != nil {
+		return attrs, err
+	}
+	if attrs.ClientHost == "" {
+		attrs.ClientHost = r.Referer()
+	}
+	r.Header.Set("scope", attrs.Scope)
+	r.Header.Set("client-host", attrs.ClientHost)
+	r.Header.Set("client-id", attrs.ClientID)
+	return attrs, nil
+}
+
+// helper function to verify access token, verification results are kept in
+// AccessTokens cache, while provider errors are not cached
+func verifyAccessToken(token string) (TokenAttributes, error) {
+	if entry, ok := AccessTokens().Get(token); ok {
+		return entry.Attrs, entry.Err
+	}
+	negativeTTL := time.Duration(Config().TokenCache.NegativeTTL) * time.Second
+
 	// first, we inspect our token
 	attrs, err := inspectTokenProviders(token)
 	if err == nil {
-		if attrs.ClientHost == "" {
-			attrs.ClientHost = r.Referer()
-		}
-		r.Header.Set("scope", attrs.Scope)
-		r.Header.Set("client-host", attrs.ClientHost)
-		r.Header.Set("client-id", attrs.ClientID)
+		AccessTokens().Add(token, attrs, nil, negativeTTL)
 		return attrs, nil
 	}
 
 	log.Println("unable to inspect token: ", err)
+	var terr *tokenError
+	if errors.As(err, &terr) {
+		// token of participated provider does not need introspection
+		AccessTokens().Add(token, attrs, err, negativeTTL)
+		return attrs, err
+	}
 
 	// if inspection fails, we'll try to send introspect request to auth provider
 	// to verify token
@@ -285,17 +777,17 @@ func checkAccessToken(r *http.Request) (TokenAttributes, error) {
 	if !attrs.Active || attrs.Expiration-time.Now().Unix() < 0 {
 		msg := fmt.Sprintf("token is invalid: %+v", attrs)
 		log.Println(msg)
-		return attrs, errors.New("invalid token")
+		err = errors.New("invalid token")
+		AccessTokens().Add(token, attrs, err, negativeTTL)
+		return attrs, err
 	}
-	if Config.Verbose > 2 {
+	if Config().Verbose > 2 {
 		if err := printJSON(attrs, "token attributes"); err != nil {
 			msg := fmt.Sprintf("Failed to output token attributes: %v", err)
 			log.Println(msg)
 		}
 	}
-	r.Header.Set("scope", attrs.Scope)
-	r.Header.Set("client-host", attrs.ClientHost)
-	r.Header.Set("client-id", attrs.ClientID)
+	AccessTokens().Add(token, attrs, nil, negativeTTL)
 	return attrs, nil
 }
 
@@ -303,29 +795,44 @@ func checkAccessToken(r *http.Request) (TokenAttributes, error) {
 // user tokens
 func oauthCallbackHandler(w http.ResponseWriter, r *http.Request) {
 	sess := globalSessions.SessionStart(w, r)
-	if Config.Verbose > 0 {
-		msg := fmt.Sprintf("call from '/callback', r.URL %s, sess.path %v", r.URL, sess.Get("path"))
-		printHTTPRequest(r, msg)
+	if Config().Verbose > 0 {
+		printHTTPRequest(r, fmt.Sprintf("call from '/callback', r.URL %s", r.URL))
 	}
+	// original request of the user is stored in the session under state
+	// value, it is used only once
+	state := r.URL.Query().Get("state")
 	sessLock.Lock()
-	state := sess.Get("somestate")
+	areq, ok := popAuthRequest(sess, state)
 	sessLock.Unlock()
-	if state == nil {
+	if !ok {
 		http.Error(w, fmt.Sprintf("state did not match, %v", state), http.StatusBadRequest)
 		return
 	}
-	if r.URL.Query().Get("state") != state.(string) {
-		http.Error(w, fmt.Sprintf("r.URL state did not match, %v", state), http.StatusBadRequest)
+	verifier := areq.Verifier
+	nonce := areq.Nonce
+	login := loginProvider(areq.Provider)
+	if areq.Provider == "" || login == nil {
+		http.Error(w, fmt.Sprintf("unknown login provider '%s'", areq.Provider), http.StatusBadRequest)
+		return
+	}
+	// callback url of named login provider ends with its name
+	name := strings.Trim(strings.TrimPrefix(r.URL.Path, fmt.Sprintf("%s/callback", Config().Base)), "/")
+	if name != "" && name != login.Name {
+		http.Error(w, fmt.Sprintf("callback of login provider '%s' does not match '%s'", name, login.Name), http.StatusBadRequest)
 		return
 	}
 
 	//exchanging the code for a token
-	oauth2Token, err := OAuth2Config.Exchange(Context, r.URL.Query().Get("code"))
+	var opts []oauth2.AuthCodeOption
+	if verifier != "" {
+		opts = append(opts, oauth2.SetAuthURLParam("code_verifier", verifier))
+	}
+	oauth2Token, err := login.OAuth2Config.Exchange(Context, r.URL.Query().Get("code"), opts...)
 	if err != nil {
 		http.Error(w, "Failed to exchange token: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
-	if Config.Verbose > 2 {
+	if Config().Verbose > 2 {
 		log.Println("oauth2Token", oauth2Token)
 	}
 	rawIDToken, ok := oauth2Token.Extra("id_token").(string)
@@ -336,14 +843,18 @@ func oauthCallbackHandler(w http.ResponseWriter, r *http.Request) {
 	refreshToken, ok := oauth2Token.Extra("refresh_token").(string)
 	refreshExpire, ok := oauth2Token.Extra("refresh_expires_in").(float64)
 	accessExpire, ok := oauth2Token.Extra("expires_in").(float64)
-	if Config.Verbose > 2 {
+	if Config().Verbose > 2 {
 		log.Println("rawIDToken", rawIDToken)
 	}
-	idToken, err := Verifier.Verify(Context, rawIDToken)
+	idToken, err := login.Verifier.Verify(Context, rawIDToken)
 	if err != nil {
 		http.Error(w, "Failed to verify ID Token: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
+	if nonce != "" && idToken.Nonce != nonce {
+		http.Error(w, "ID Token nonce did not match", http.StatusBadRequest)
+		return
+	}
 
 	//preparing the data to be presented on the page
 	//it includes the tokens and the user info
@@ -365,30 +876,77 @@ func oauthCallbackHandler(w http.ResponseWriter, r *http.Request) {
 
 	//storing the token and the info of the user in session memory
 	sessLock.Lock()
-	sess.Set("rawIDToken", rawIDToken)
-	sess.Set("refreshToken", refreshToken)
-	sess.Set("refreshExpire", int64(refreshExpire))
-	sess.Set("accessExpire", int64(accessExpire))
-	sess.Set("userinfo", resp.IDTokenClaims)
-	urlPath := sess.Get("path").(string)
 	accessToken := resp.OAuth2Token.AccessToken
+	setSessionTokens(sess, TokenInfo{
+		AccessToken:   accessToken,
+		AccessExpire:  int64(accessExpire),
+		RefreshToken:  refreshToken,
+		RefreshExpire: int64(refreshExpire),
+		IDToken:       rawIDToken,
+	})
+	sess.Set("userinfo", resp.IDTokenClaims)
+	sess.Set("provider", login.Name)
 	if accessToken != "" {
-		sess.Set("accessToken", accessToken)
 		r.Header.Set("Authorization", fmt.Sprintf("Bearer %s", accessToken))
 	}
+	err = globalSessions.SessionSave(w, sess)
 	sessLock.Unlock()
-	if Config.Verbose > 0 {
+	if err != nil {
+		log.Println("unable to save session", err)
+	}
+	if Config().Verbose > 0 {
 		log.Printf("response data %+v", resp)
 		log.Println("session data", string(data))
-		log.Println("redirect to", urlPath)
+		log.Printf("redirect to %s %s\n", areq.Method, areq.URL)
 		printHTTPRequest(r, "new http request headers after CERN SSO")
 	}
-	http.Redirect(w, r, urlPath, http.StatusFound)
-	return
+	// replay original POST request or redirect user to original url
+	target := safeRedirectURL(areq.URL)
+	if areq.Method == "POST" && len(areq.Form) > 0 {
+		replayPost(w, target, areq.Form)
+		return
+	}
+	http.Redirect(w, r, target, http.StatusFound)
+}
+
+// logout handler destroys user session, revokes its refresh token at OAuth
+// provider and redirects user to end session endpoint of OAuth provider
+func oauthLogoutHandler(w http.ResponseWriter, r *http.Request) {
+	sess := globalSessions.SessionStart(w, r)
+	sessLock.Lock()
+	refreshToken, _ := sess.Get("refreshToken").(string)
+	idToken, _ := sess.Get("rawIDToken").(string)
+	provider, _ := sess.Get("provider").(string)
+	sessLock.Unlock()
+	globalSessions.SessionDestroy(w, r)
+	login := loginProvider(provider)
+	if Config().Verbose > 0 {
+		printHTTPRequest(r, "logout request")
+	}
+
+	// revoke refresh token to terminate user session at OAuth provider
+	if refreshToken != "" {
+		if err := revokeToken(login, refreshToken, "refresh_token"); err != nil {
+			log.Println("unable to revoke refresh token", err)
+		}
+	}
+
+	// RP-initiated logout at OAuth provider
+	rurl := LogoutRedirectURL
+	if login != nil && login.Configuration.EndSessionEndpoint != "" {
+		params := url.Values{}
+		params.Add("post_logout_redirect_uri", LogoutRedirectURL)
+		params.Add("client_id", login.OAuth2Config.ClientID)
+		if idToken != "" {
+			params.Add("id_token_hint", idToken)
+		}
+		rurl = fmt.Sprintf("%s?%s", login.Configuration.EndSessionEndpoint, params.Encode())
+	}
+	http.Redirect(w, r, rurl, http.StatusFound)
 }
 
 // oauth request handler performs reverse proxy action on incoming user request
-// the proxy redirection is based on Config.Ingress dictionary, see Configuration
+// the proxy redirection is based on Config().Ingress dictionary, see Configuration
 // struct. The only exceptions are /token and /renew end-points which used internally
 // to display or renew user tokens, respectively
 func oauthRequestHandler(w http.ResponseWriter, r *http.Request) {
@@ -405,35 +963,68 @@ func oauthRequestHandler(w http.ResponseWriter, r *http.Request) {
 	status := http.StatusOK
 	userData := make(map[string]interface{})
 	tstamp := int64(start.UnixNano() / 1000000) // use milliseconds for MONIT
-	sess := globalSessions.SessionStart(w, r)
-	oauthState := uuid.New().String()
+
+	// clients which provide access token do not need session, therefore
+	// we neither start nor save it for their requests
+	clientToken := r.Header.Get("Authorization") != ""
+	var sess session.Session
+	if clientToken {
+		sess = newUserSession(0)
+	} else {
+		sess = globalSessions.SessionStart(w, r)
+		// refresh access token of the session before it expires, users are
+		// redirected to SSO only if refresh token is expired as well
+		refreshSessionToken(sess, r)
+	}
 
 	// check userinfo in the session or if client provides valid access token.
 	sessLock.Lock()
-	sess.Set("somestate", oauthState)
-	if sess.Get("path") == nil || sess.Get("path") == "" {
-		sess.Set("path", r.URL.Path)
-	}
 	if sess.Get("accessToken") != nil && sess.Get("accessToken") != "" && r.Header.Get("Authorization") == "" {
 		r.Header.Set("Authorization", fmt.Sprintf("Bearer %s", sess.Get("accessToken")))
 	}
 	userInfo := sess.Get("userinfo")
 	sessLock.Unlock()
 
-	if Config.Verbose > 0 {
-		sessLock.Lock()
-		msg := fmt.Sprintf("oauthRequestHandler, r.URL %s, sess.Path %v", r.URL, sess.Get("path"))
-		printHTTPRequest(r, msg)
-		sessLock.Unlock()
+	if Config().Verbose > 0 {
+		printHTTPRequest(r, fmt.Sprintf("oauthRequestHandler, r.URL %s", r.URL))
 	}
 
 	attrs, err := checkAccessToken(r)
 	// add logRequest after we set cms headers in HTTP request
 	defer logRequest(w, r, start, "CERN-SSO-OAuth2-OICD", &status, tstamp)
+	if clientToken && err != nil {
+		// token of the client is rejected or can't be validated, report
+		// the reason to the client
+		log.Printf("unauthorized access to %s, %v\n", r.URL.Path, err)
+		status = http.StatusUnauthorized
+		http.Error(w, err.Error(), status)
+		return
+	}
 	if err != nil {
-		// there is no proper authentication yet, redirect users to auth callback
-		aurl := OAuth2Config.AuthCodeURL(oauthState)
-		if Config.Verbose > 0 {
+		login := requestLogin(r)
+		if login == "" && !browserRequest(r) {
+			// API clients can't choose login provider on HTML page
+			status = http.StatusUnauthorized
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "authentication required, please provide bearer token or login provider", status)
+			return
+		}
+		// there is no proper authentication yet, store original request
+		// of the user in the session and redirect user to auth callback
+		sessLock.Lock()
+		state, areq := newAuthRequest(sess, r, login)
+		serr := globalSessions.SessionSave(w, sess)
+		sessLock.Unlock()
+		if serr != nil {
+			log.Println("unable to save session", serr)
+		}
+		if areq.Provider == "" {
+			// user should choose login provider
+			loginSelectionPage(w, state)
+			return
+		}
+		aurl := loginProvider(areq.Provider).authCodeURL(state, areq.Verifier, areq.Nonce)
+		if Config().Verbose > 0 {
 			log.Printf("token attributes %+v, error %v", attrs, err)
 			log.Println("auth redirect to", aurl)
 		}
@@ -441,26 +1032,36 @@ func oauthRequestHandler(w http.ResponseWriter, r *http.Request) {
 		http.Redirect(w, r, aurl, status)
 		return
 	}
+	// save session with refreshed tokens
+	if !clientToken {
+		sessLock.Lock()
+		err = globalSessions.SessionSave(w, sess)
+		sessLock.Unlock()
+		if err != nil {
+			log.Println("unable to save session", err)
+		}
+	}
 
 	// if user wants to renew token
-	if r.URL.Path == fmt.Sprintf("%s/token/renew", Config.Base) {
+	if r.URL.Path == fmt.Sprintf("%s/token/renew", Config().Base) {
 		var token string
 		sessLock.Lock()
 		t := sess.Get("refreshToken")
+		provider, _ := sess.Get("provider").(string)
 		sessLock.Unlock()
 		if t == nil { // cli request
 			token = getToken(r)
 		} else {
 			token = t.(string)
 		}
-		tokenInfo, err := renewToken(token, r)
+		tokenInfo, err := renewToken(loginProvider(provider), token, r)
 		if err != nil {
 			msg := fmt.Sprintf("unable to refresh access token, %v", err)
 			status = http.StatusInternalServerError
 			http.Error(w, msg, status)
 			return
 		}
-		if Config.Verbose > 2 {
+		if Config().Verbose > 2 {
 			printJSON(tokenInfo, "new token info")
 		}
 		if !strings.Contains(strings.ToLower(r.Header.Get("Accept")), "json") {
@@ -478,7 +1079,7 @@ func oauthRequestHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	// if user wants to see token
-	if r.URL.Path == fmt.Sprintf("%s/token", Config.Base) {
+	if r.URL.Path == fmt.Sprintf("%s/token", Config().Base) {
 		var token, rtoken string
 		sessLock.Lock()
 		t := sess.Get("rawIDToken")
@@ -536,6 +1137,7 @@ func oauthRequestHandler(w http.ResponseWriter, r *http.Request) {
 				http.Error(w, msg, status)
 				return
 			}
+			mapUserInfo(userData, &attrs)
 		}
 	} else {
 		// in case of existing token CERN SSO or IAM we use token attributes as user data
@@ -545,20 +1147,24 @@ func oauthRequestHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	// set id in user data based on token ClientID. The id will be used by SetCMSHeadersXXX calls
 	userData["id"] = attrs.ClientID
+	if len(attrs.Groups) > 0 {
+		userData["groups"] = attrs.Groups
+	}
 
-	// set CMS headers
-	if Config.CMSHeaders {
-		if Config.Verbose > 2 {
+	// set CMS headers, CMS headers of the client are never passed to backends
+	clearCMSHeaders(r)
+	if Config().CMSHeaders {
+		if Config().Verbose > 2 {
 			if err := printJSON(userData, "user data"); err != nil {
 				log.Println("unable to print user data")
 			}
 		}
 		level := false
-		if Config.Verbose > 3 {
+		if Config().Verbose > 3 {
 			level = true
 		}
-		CMSAuth.SetCMSHeadersByKey(r, userData, CricRecords, "id", "oauth", level)
-		if Config.Verbose > 0 {
+		CMSAuth().SetCMSHeadersByKey(r, userData, CricRecordsByID, "id", "oauth", level)
+		if Config().Verbose > 0 {
 			printHTTPRequest(r, "cms headers")
 		}
 	}
@@ -573,6 +1179,16 @@ func oauthRequestHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// check authorization policy of ingress rule, for that we add CRIC
+	// information about the user to user data
+	cricUserData(userData, CricRecordsByID, attrs.ClientID)
+	if err := checkIngressPolicy(r, userData); err != nil {
+		log.Printf("forbidden access to %s, %v\n", r.URL.Path, err)
+		status = http.StatusForbidden
+		http.Error(w, "access forbidden", status)
+		return
+	}
+
 	// redirect HTTP requests
 	redirect(w, r)
 }
@@ -583,68 +1199,70 @@ func oauthRequestHandler(w http.ResponseWriter, r *http.Request) {
 // and redirects their requests to targetUrl of reverse proxy.
 // If targetUrl is empty string it will redirect all request to
 // simple hello page.
-func oauthProxyServer() {
-	// check if provided crt/key files exists
-	serverCrt := checkFile(Config.ServerCrt)
-	serverKey := checkFile(Config.ServerKey)
-
+// The oauthServeMux function initializes OAuth2 client for the listener
+// on given port and returns its HTTP handlers.
+func oauthServeMux(port int, serverCrt string) *http.ServeMux {
 	// redirectURL defines where incoming requests will be redirected for authentication
-	redirectURL := fmt.Sprintf("http://localhost:%d/callback", Config.Port)
+	redirectURL := fmt.Sprintf("http://localhost:%d/callback", port)
 	if serverCrt != "" {
-		redirectURL = fmt.Sprintf("https://localhost:%d/callback", Config.Port)
+		redirectURL = fmt.Sprintf("https://localhost:%d/callback", port)
 	}
-	if Config.RedirectURL != "" {
-		redirectURL = Config.RedirectURL
+	if Config().RedirectURL != "" {
+		redirectURL = Config().RedirectURL
 	}
 
-	// authTokenUrl defines where token can be obtained
-	AuthTokenURL = fmt.Sprintf("%s/protocol/openid-connect/token", Config.OAuthURL)
-	if Config.AuthTokenURL != "" {
-		AuthTokenURL = Config.AuthTokenURL
-	}
-
-	// Provider is a struct in oidc package that represents
-	// an OpenID Connect server's configuration.
+	// initialize login providers of browser users
 	Context = context.Background()
-	provider, err := oidc.NewProvider(Context, Config.OAuthURL)
+	logins, err := initLogins(*Config(), redirectURL)
 	if err != nil {
 		log.Fatal(err)
 	}
+	OAuthLogins = logins
 
-	// configure an OpenID Connect aware OAuth2 client
-	OAuth2Config = oauth2.Config{
-		ClientID:     Config.ClientID,
-		ClientSecret: Config.ClientSecret,
-		RedirectURL:  redirectURL,
-		Endpoint:     provider.Endpoint(),
-		Scopes:       []string{oidc.ScopeOpenID, "profile", "email"},
+	// logoutRedirectURL defines where users are redirected after logout,
+	// by default it is base path of the server
+	LogoutRedirectURL = Config().LogoutRedirectURL
+	if LogoutRedirectURL == "" {
+		if rurl, err := url.Parse(redirectURL); err == nil {
+			LogoutRedirectURL = fmt.Sprintf("%s://%s%s/", rurl.Scheme, rurl.Host, Config().Base)
+		}
 	}
 
-	// define token ID verifier
-	oidcConfig := &oidc.Config{ClientID: Config.ClientID}
-	Verifier = provider.Verifier(oidcConfig)
+	// initialize session store of OAuth flow
+	globalSessions, err = newSessionStore(Config().Session)
+	if err != nil {
+		log.Fatalf("unable to initialize session store, error %v\n", err)
+	}
+	go sessionsGC(globalSessions, Config().Session.TTL)
 
-	// metrics handler
-	http.HandleFunc(fmt.Sprintf("%s/metrics", Config.Base), metricsHandler)
+	mux := http.NewServeMux()
 
-	// start http server to serve metrics only
-	if Config.MetricsPort > 0 {
-		go http.ListenAndServe(fmt.Sprintf(":%d", Config.MetricsPort), nil)
-	}
+	// metrics handler
+	mux.HandleFunc(fmt.Sprintf("%s/metrics", Config().Base), metricsHandler)
 
 	// the server settings handler
-	http.HandleFunc(fmt.Sprintf("%s/server", Config.Base), settingsHandler)
+	mux.HandleFunc(fmt.Sprintf("%s/server", Config().Base), settingsHandler)
 
-	// the callback authentication handler
-	http.HandleFunc(fmt.Sprintf("%s/callback", Config.Base), oauthCallbackHandler)
+	// the callback authentication handlers, named login providers use
+	// callback path with their name
+	mux.HandleFunc(fmt.Sprintf("%s/callback", Config().Base), oauthCallbackHandler)
+	mux.HandleFunc(fmt.Sprintf("%s/callback/", Config().Base), oauthCallbackHandler)
 
-	// the request handler
-	http.HandleFunc("/", oauthRequestHandler)
+	// the login provider selection handler
+	mux.HandleFunc(fmt.Sprintf("%s/login", Config().Base), oauthLoginHandler)
 
-	// start HTTPs server
-	server, err := getServer(serverCrt, serverKey, false)
-	if err != nil {
-		log.Fatalf("unable to start oauth server, error %v\n", err)
+	// the logout handler
+	mux.HandleFunc(fmt.Sprintf("%s/logout", Config().Base), oauthLogoutHandler)
+
+	// JWKS of exchanged and internal tokens
+	internalTokenServeMux(mux)
+
+	// the token exchange handler
+	if Config().TokenExchange.Enable {
+		mux.HandleFunc(fmt.Sprintf("%s/token/exchange", Config().Base), tokenExchangeHandler)
 	}
-	log.Fatal(server.ListenAndServeTLS(serverCrt, serverKey))
+
+	// the request handler
+	mux.HandleFunc("/", oauthRequestHandler)
+	return mux
 }
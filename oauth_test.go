@@ -0,0 +1,363 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Test_refreshSessionToken function
+func Test_refreshSessionToken(t *testing.T) {
+	// token endpoint of OAuth provider
+	var refreshes int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		if r.FormValue("refresh_token") != "refresh" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		refreshes++
+		tokenInfo := TokenInfo{AccessToken: "new", AccessExpire: 300, RefreshToken: "refresh", RefreshExpire: 1800}
+		json.NewEncoder(w).Encode(tokenInfo)
+	}))
+	defer server.Close()
+	OAuthLogins = []*oauthLogin{{Name: defaultLoginName, AuthTokenURL: server.URL}}
+	defer func() { OAuthLogins = nil }()
+
+	now := time.Now().Unix()
+	r := httptest.NewRequest("GET", "/dbs", nil)
+
+	// valid access token is not refreshed
+	sess := newUserSession(defaultSessionTTL)
+	setSessionTokens(sess, TokenInfo{AccessToken: "old", AccessExpire: 300, RefreshToken: "refresh", RefreshExpire: 1800})
+	assert.Equal(t, refreshSessionToken(sess, r), true)
+	assert.Equal(t, sess.Get("accessToken"), "old")
+	assert.Equal(t, refreshes, 0)
+
+	// access token close to expiration is refreshed
+	sess.Set("accessExpireAt", now+10)
+	assert.Equal(t, refreshSessionToken(sess, r), true)
+	assert.Equal(t, sess.Get("accessToken"), "new")
+	assert.Equal(t, sess.Get("accessExpireAt").(int64) >= now+300, true)
+	assert.Equal(t, refreshes, 1)
+
+	// tokens are removed from session if refresh fails
+	sess.Set("accessExpireAt", now-10)
+	sess.Set("refreshToken", "revoked")
+	assert.Equal(t, refreshSessionToken(sess, r), false)
+	assert.Equal(t, sess.Get("accessToken"), nil)
+
+	// tokens are removed from session if refresh token is expired
+	setSessionTokens(sess, TokenInfo{AccessToken: "old", AccessExpire: -10, RefreshToken: "refresh", RefreshExpire: 1})
+	sess.Set("refreshExpireAt", now-1)
+	assert.Equal(t, refreshSessionToken(sess, r), false)
+	assert.Equal(t, sess.Get("accessToken"), nil)
+	assert.Equal(t, refreshes, 1)
+}
+
+// Test_concurrentRefresh function
+func Test_concurrentRefresh(t *testing.T) {
+	// token endpoint of OAuth provider which rotates refresh tokens
+	var mutex sync.Mutex
+	var refreshes int
+	valid := "refresh"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		mutex.Lock()
+		defer mutex.Unlock()
+		if r.FormValue("refresh_token") != valid {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		refreshes++
+		valid = fmt.Sprintf("refresh%d", refreshes)
+		time.Sleep(50 * time.Millisecond)
+		tokenInfo := TokenInfo{AccessToken: "new", AccessExpire: 300, RefreshToken: valid, RefreshExpire: 1800}
+		json.NewEncoder(w).Encode(tokenInfo)
+	}))
+	defer server.Close()
+	OAuthLogins = []*oauthLogin{{Name: defaultLoginName, AuthTokenURL: server.URL}}
+	defer func() { OAuthLogins = nil }()
+
+	// concurrent requests carry their own copies of the same session, e.g.
+	// read from session cookie, and share single refresh of its tokens
+	sid := newUserSession(defaultSessionTTL).SessionID()
+	var wg sync.WaitGroup
+	sessions := make([]*userSession, 5)
+	for i := range sessions {
+		sess := newUserSession(defaultSessionTTL)
+		sess.SID = sid
+		setSessionTokens(sess, TokenInfo{AccessToken: "old", AccessExpire: 10, RefreshToken: "refresh", RefreshExpire: 1800})
+		sessions[i] = sess
+		wg.Add(1)
+		go func(sess *userSession) {
+			defer wg.Done()
+			refreshSessionToken(sess, httptest.NewRequest("GET", "/dbs", nil))
+		}(sess)
+	}
+	wg.Wait()
+	assert.Equal(t, refreshes, 1)
+	for _, sess := range sessions {
+		assert.Equal(t, sess.Get("accessToken"), "new")
+		assert.Equal(t, sess.Get("refreshToken"), "refresh1")
+	}
+}
+
+// Test_oauthLogoutHandler function
+func Test_oauthLogoutHandler(t *testing.T) {
+	// revocation endpoint of OAuth provider
+	var revoked string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		revoked = r.FormValue("token")
+	}))
+	defer server.Close()
+	store, err := newSessionStore(SessionConfig{})
+	assert.Equal(t, err, nil)
+	globalSessions = store
+	OAuthLogins = []*oauthLogin{{
+		Name: defaultLoginName,
+		Configuration: OpenIDConfiguration{
+			RevocationEndpoint: server.URL,
+			EndSessionEndpoint: "https://sso.cern.ch/logout",
+		},
+	}}
+	LogoutRedirectURL = "https://cmsweb.cern.ch/"
+	defer func() {
+		globalSessions = nil
+		OAuthLogins = nil
+		LogoutRedirectURL = ""
+	}()
+
+	// user session with tokens
+	w := httptest.NewRecorder()
+	sess := store.SessionStart(w, httptest.NewRequest("GET", "/dbs", nil))
+	setSessionTokens(sess, TokenInfo{AccessToken: "access", AccessExpire: 300, RefreshToken: "refresh", IDToken: "id"})
+	cookie := w.Result().Cookies()[0]
+
+	// logout destroys session, revokes refresh token and redirects to provider
+	r := httptest.NewRequest("GET", "/logout", nil)
+	r.AddCookie(cookie)
+	w = httptest.NewRecorder()
+	oauthLogoutHandler(w, r)
+	assert.Equal(t, w.Code, http.StatusFound)
+	assert.Equal(t, revoked, "refresh")
+	loc, err := url.Parse(w.Header().Get("Location"))
+	assert.Equal(t, err, nil)
+	assert.Equal(t, loc.Host, "sso.cern.ch")
+	assert.Equal(t, loc.Query().Get("post_logout_redirect_uri"), LogoutRedirectURL)
+	assert.Equal(t, loc.Query().Get("id_token_hint"), "id")
+	sess = store.SessionStart(httptest.NewRecorder(), r)
+	assert.Equal(t, sess.Get("refreshToken"), nil)
+}
+
+// Test_authCodeURL function
+func Test_authCodeURL(t *testing.T) {
+	// code challenge is base64 encoded SHA256 hash of code verifier
+	verifier := "dBjftJeZ4CVP-mJ92q2Ly_ekE4WKY0eA9-ovdNd3V6Rk"
+	assert.Equal(t, codeChallenge(verifier), "Spq86souU68atmeLuPJOaIx8gD4H9o0FQEY9HmoHYAY")
+
+	login := &oauthLogin{Name: defaultLoginName}
+	login.OAuth2Config.Endpoint.AuthURL = "https://sso.cern.ch/auth"
+	loc, err := url.Parse(login.authCodeURL("state", verifier, "nonce"))
+	assert.Equal(t, err, nil)
+	assert.Equal(t, loc.Query().Get("state"), "state")
+	assert.Equal(t, loc.Query().Get("code_challenge"), codeChallenge(verifier))
+	assert.Equal(t, loc.Query().Get("code_challenge_method"), "S256")
+	assert.Equal(t, loc.Query().Get("nonce"), "nonce")
+
+	// PKCE and nonce are not used when disabled
+	loc, err = url.Parse(login.authCodeURL("state", "", ""))
+	assert.Equal(t, err, nil)
+	assert.Equal(t, loc.Query().Get("code_challenge"), "")
+	assert.Equal(t, loc.Query().Get("nonce"), "")
+}
+
+// Test_authRequests function
+func Test_authRequests(t *testing.T) {
+	store, err := newSessionStore(SessionConfig{Store: "cookie", Secret: "secret"})
+	assert.Equal(t, err, nil)
+	w := httptest.NewRecorder()
+	sess := store.SessionStart(w, httptest.NewRequest("GET", "/", nil))
+
+	// requests of concurrent browser tabs are stored under their own states
+	r1 := httptest.NewRequest("GET", "/dbs/datasets?dataset=/a/b/c", nil)
+	state1, areq := newAuthRequest(sess, r1, defaultLoginName)
+	assert.Equal(t, areq.URL, "/dbs/datasets?dataset=/a/b/c")
+	assert.NotEqual(t, areq.Verifier, "")
+	form := url.Values{"name": []string{"value"}}
+	r2 := httptest.NewRequest("POST", "/reqmgr2/data", strings.NewReader(form.Encode()))
+	r2.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r2.Header.Set("Sec-Fetch-Site", "same-origin")
+	state2, _ := newAuthRequest(sess, r2, defaultLoginName)
+	assert.Equal(t, store.SessionSave(w, sess), nil)
+
+	// forms of cross-site requests are not kept
+	for _, hdr := range []map[string]string{
+		{"Sec-Fetch-Site": "cross-site"},
+		{"Origin": "https://evil.com"},
+		{"Origin": "null"},
+		{},
+	} {
+		r3 := httptest.NewRequest("POST", "/reqmgr2/data", strings.NewReader(form.Encode()))
+		r3.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		for key, val := range hdr {
+			r3.Header.Set(key, val)
+		}
+		_, areq = newAuthRequest(newUserSession(defaultSessionTTL), r3, defaultLoginName)
+		assert.Equal(t, areq.Form, url.Values(nil), fmt.Sprintf("headers %v", hdr))
+	}
+	r3 := httptest.NewRequest("POST", "/reqmgr2/data", strings.NewReader(form.Encode()))
+	r3.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r3.Header.Set("Origin", "https://example.com")
+	_, areq = newAuthRequest(newUserSession(defaultSessionTTL), r3, defaultLoginName)
+	assert.Equal(t, areq.Form, form)
+
+	// auth requests are read from session cookie and used only once
+	r := httptest.NewRequest("GET", "/callback", nil)
+	for _, cookie := range w.Result().Cookies() {
+		r.AddCookie(cookie)
+	}
+	sess = store.SessionStart(httptest.NewRecorder(), r)
+	areq, ok := popAuthRequest(sess, state2)
+	assert.Equal(t, ok, true)
+	assert.Equal(t, areq.Method, "POST")
+	assert.Equal(t, areq.Form, form)
+
+	// replayed form is submitted by user only
+	rec := httptest.NewRecorder()
+	replayPost(rec, areq.URL, areq.Form)
+	assert.Equal(t, strings.Contains(rec.Body.String(), `name="name" value="value"`), true)
+	assert.Equal(t, strings.Contains(rec.Body.String(), "onload"), false)
+	assert.Equal(t, strings.Contains(rec.Body.String(), `type="submit"`), true)
+	_, ok = popAuthRequest(sess, state2)
+	assert.Equal(t, ok, false)
+	areq, ok = popAuthRequest(sess, state1)
+	assert.Equal(t, ok, true)
+	assert.Equal(t, areq.URL, "/dbs/datasets?dataset=/a/b/c")
+
+	// only recent auth requests are kept
+	var states []string
+	for i := 0; i < maxAuthRequests+1; i++ {
+		state, _ := newAuthRequest(sess, r1, defaultLoginName)
+		states = append(states, state)
+	}
+	_, ok = popAuthRequest(sess, states[0])
+	assert.Equal(t, ok, false)
+	_, ok = popAuthRequest(sess, states[maxAuthRequests])
+	assert.Equal(t, ok, true)
+}
+
+// Test_safeRedirectURL function
+func Test_safeRedirectURL(t *testing.T) {
+	login := &oauthLogin{Name: defaultLoginName}
+	login.OAuth2Config.RedirectURL = "https://cmsweb.cern.ch/callback"
+	OAuthLogins = []*oauthLogin{login}
+	defer func() { OAuthLogins = nil }()
+	for target, expect := range map[string]string{
+		"/dbs?dataset=/a/b/c":             "/dbs?dataset=/a/b/c",
+		"https://cmsweb.cern.ch/dbs":      "https://cmsweb.cern.ch/dbs",
+		"https://evil.com/dbs":            "/",
+		"//evil.com/dbs":                  "/",
+		"/\\evil.com":                     "/",
+		"javascript:alert(1)":             "/",
+		"https://cmsweb.cern.ch@evil.com": "/",
+	} {
+		assert.Equal(t, safeRedirectURL(target), expect, target)
+	}
+
+	// replay page escapes form values
+	w := httptest.NewRecorder()
+	replayPost(w, "/reqmgr2/data", url.Values{"name": []string{`"><script>`}})
+	assert.Equal(t, strings.Contains(w.Body.String(), "<script>"), false)
+	assert.Equal(t, strings.Contains(w.Body.String(), `action="/reqmgr2/data"`), true)
+}
+
+// Test_claimsAttributes function
+func Test_claimsAttributes(t *testing.T) {
+	defer func() { Config().Claims = ClaimsConfig{} }()
+
+	// default CERN SSO claims
+	claims := map[string]interface{}{
+		"cern_upn":       "user",
+		"cern_person_id": float64(1234567),
+		"email":          "user@cern.ch",
+		"cern_roles":     []interface{}{"admin", "operator"},
+		"scope":          "openid profile",
+		"groups":         []interface{}{"cms"},
+		"exp":            float64(1600000000),
+	}
+	attrs := claimsAttributes(claims)
+	assert.Equal(t, attrs.UserName, "user")
+	assert.Equal(t, attrs.ClientID, "1234567")
+	assert.Equal(t, attrs.Email, "user@cern.ch")
+	assert.Equal(t, attrs.Scope, "admin operator")
+	assert.Equal(t, len(attrs.Groups), 0)
+	assert.Equal(t, attrs.Expiration, int64(1600000000))
+
+	// claims of Dex provider
+	Config().Claims = ClaimsConfig{Username: []string{"name"}, ID: []string{"sub"}, Roles: []string{"scope"}, Groups: []string{"groups"}}
+	claims = map[string]interface{}{
+		"name":   "user",
+		"sub":    "CiQwOGE4Njg0Yi1kYjg4",
+		"scope":  "openid profile",
+		"groups": []interface{}{"cms", "admins"},
+	}
+	attrs = claimsAttributes(claims)
+	assert.Equal(t, attrs.UserName, "user")
+	assert.Equal(t, attrs.ClientID, "CiQwOGE4Njg0Yi1kYjg4")
+	assert.Equal(t, attrs.Scope, "openid profile")
+	assert.Equal(t, attrs.Groups, []string{"cms", "admins"})
+}
+
+// Test_mapUserInfo function
+func Test_mapUserInfo(t *testing.T) {
+	Config().Claims = ClaimsConfig{Username: []string{"preferred_username"}, ID: []string{"sub"}, Groups: []string{"groups"}}
+	defer func() { Config().Claims = ClaimsConfig{} }()
+
+	// userinfo claims of the session are mapped as claims of access token
+	userData := map[string]interface{}{
+		"name":               "Test User",
+		"preferred_username": "user",
+		"sub":                "1234",
+		"email":              "user@example.com",
+		"groups":             []interface{}{"cms"},
+	}
+	var attrs TokenAttributes
+	mapUserInfo(userData, &attrs)
+	assert.Equal(t, userData["name"], "user")
+	assert.Equal(t, userData["email"], "user@example.com")
+	assert.Equal(t, attrs.ClientID, "1234")
+	assert.Equal(t, attrs.Groups, []string{"cms"})
+
+	// attributes of access token take precedence
+	attrs = TokenAttributes{ClientID: "5678", Groups: []string{"admins"}}
+	mapUserInfo(userData, &attrs)
+	assert.Equal(t, attrs.ClientID, "5678")
+	assert.Equal(t, attrs.Groups, []string{"admins"})
+}
+
+// Test_bearerRequestSession function
+func Test_bearerRequestSession(t *testing.T) {
+	store, err := newSessionStore(SessionConfig{})
+	assert.Equal(t, err, nil)
+	globalSessions = store
+	defer func() { globalSessions = nil }()
+
+	// requests with access token of the client do not start sessions
+	r := httptest.NewRequest("GET", "/dbs", nil)
+	r.Header.Set("Authorization", "Bearer token")
+	w := httptest.NewRecorder()
+	oauthRequestHandler(w, r)
+	assert.Equal(t, w.Code, http.StatusUnauthorized)
+	assert.Equal(t, len(w.Result().Cookies()), 0)
+	assert.Equal(t, len(store.(*memorySessions).sessions), 0)
+}
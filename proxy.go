@@ -0,0 +1,148 @@
+package main
+
+// proxy module provides reverse proxies of ingress backends
+//
+// Copyright (c) 2020 - Valentin Kuznetsov <vkuznet@gmail.com>
+//
+
+/*
+Reverse proxies are created once per backend when ingress rules are
+initialized (at startup and on every configuration reload) and all of them
+share single http.Transport configured via transport section of the server
+configuration. This allows to keep connections to backends alive and avoid
+connection churn under high load.
+*/
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"time"
+)
+
+// default values of proxy transport
+const (
+	defaultMaxIdleConns        = 1000 // max number of idle connections across all backends
+	defaultMaxIdleConnsPerHost = 100  // max number of idle connections per backend
+	defaultIdleConnTimeout     = 90   // idle connection timeout in seconds
+	defaultDialTimeout         = 30   // dial timeout in seconds
+	defaultKeepAlive           = 30   // keep-alive period in seconds
+	defaultTLSHandshakeTimeout = 10   // TLS handshake timeout in seconds
+)
+
+// proxyContextKey represents type of context keys used by reverse proxy
+type proxyContextKey int
+
+// proxyStartKey is context key of request start time
+const proxyStartKey proxyContextKey = 0
+
+// helper function to create transport for reverse proxies based on
+// transport section of server configuration
+func newTransport(cfg TransportConfig) *http.Transport {
+	maxIdleConns := cfg.MaxIdleConns
+	if maxIdleConns == 0 {
+		maxIdleConns = defaultMaxIdleConns
+	}
+	maxIdleConnsPerHost := cfg.MaxIdleConnsPerHost
+	if maxIdleConnsPerHost == 0 {
+		maxIdleConnsPerHost = defaultMaxIdleConnsPerHost
+	}
+	idleConnTimeout := cfg.IdleConnTimeout
+	if idleConnTimeout == 0 {
+		idleConnTimeout = defaultIdleConnTimeout
+	}
+	dialTimeout := cfg.DialTimeout
+	if dialTimeout == 0 {
+		dialTimeout = defaultDialTimeout
+	}
+	keepAlive := cfg.KeepAlive
+	if keepAlive == 0 {
+		keepAlive = defaultKeepAlive
+	}
+	tlsHandshakeTimeout := cfg.TLSHandshakeTimeout
+	if tlsHandshakeTimeout == 0 {
+		tlsHandshakeTimeout = defaultTLSHandshakeTimeout
+	}
+	dialer := &net.Dialer{
+		Timeout:   time.Duration(dialTimeout) * time.Second,
+		KeepAlive: time.Duration(keepAlive) * time.Second,
+	}
+	return &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           dialer.DialContext,
+		ForceAttemptHTTP2:     cfg.HTTP2,
+		MaxIdleConns:          maxIdleConns,
+		MaxIdleConnsPerHost:   maxIdleConnsPerHost,
+		MaxConnsPerHost:       cfg.MaxConnsPerHost,
+		IdleConnTimeout:       time.Duration(idleConnTimeout) * time.Second,
+		TLSHandshakeTimeout:   time.Duration(tlsHandshakeTimeout) * time.Second,
+		ResponseHeaderTimeout: time.Duration(cfg.ResponseHeaderTimeout) * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+}
+
+// helper function to get request start time from request context
+func proxyStartTime(r *http.Request) time.Time {
+	if start, ok := r.Context().Value(proxyStartKey).(time.Time); ok {
+		return start
+	}
+	return time.Now()
+}
+
+// helper function to create reverse proxy for given backend
+func newReverseProxy(backend *Backend, transport http.RoundTripper) *httputil.ReverseProxy {
+	proxy := httputil.NewSingleHostReverseProxy(backend.URL)
+	if transport != nil {
+		proxy.Transport = transport
+	}
+
+	// use custom modify response function to setup response headers
+	proxy.ModifyResponse = func(resp *http.Response) error {
+		if Config().Verbose > 0 {
+			log.Println("proxy ModifyResponse")
+		}
+		start := proxyStartTime(resp.Request)
+		// record backend status for passive health checks
+		if resp.StatusCode >= http.StatusInternalServerError {
+			backend.failure()
+		} else {
+			backend.success()
+		}
+		if Config().XContentTypeOptions != "" {
+			resp.Header.Set("X-Content-Type-Options", Config().XContentTypeOptions)
+		}
+		resp.Header.Set("Response-Status", resp.Status)
+		resp.Header.Set("Response-Status-Code", fmt.Sprintf("%d", resp.StatusCode))
+		resp.Header.Set("Response-Proto", resp.Proto)
+		resp.Header.Set("Response-Time", time.Since(start).String())
+		resp.Header.Set("Response-Time-Seconds", fmt.Sprintf("%v", time.Since(start).Seconds()))
+		return nil
+	}
+	proxy.ErrorHandler = func(rw http.ResponseWriter, r *http.Request, err error) {
+		if Config().Verbose > 0 {
+			log.Printf("proxy ErrorHandler error was: %+v", err)
+		}
+		start := proxyStartTime(r)
+		// requests cancelled by clients do not indicate backend failure
+		if !errors.Is(err, context.Canceled) && r.Context().Err() == nil {
+			backend.failure()
+		}
+		header := rw.Header()
+		header.Set("Response-Status", fmt.Sprintf("%d", http.StatusBadGateway))
+		header.Set("Response-Status-Code", fmt.Sprintf("%d", http.StatusBadGateway))
+		header.Set("Response-Time", time.Since(start).String())
+		header.Set("Response-Time-Seconds", fmt.Sprintf("%v", time.Since(start).Seconds()))
+		rw.WriteHeader(http.StatusInternalServerError)
+		rw.Write([]byte(err.Error()))
+	}
+	return proxy
+}
+
+// helper function to attach request start time to the request context
+func withProxyStart(r *http.Request, start time.Time) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), proxyStartKey, start))
+}
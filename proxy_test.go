@@ -0,0 +1,73 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httputil"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Test_newTransport function
+func Test_newTransport(t *testing.T) {
+	// default options
+	tr := newTransport(TransportConfig{})
+	assert.Equal(t, tr.MaxIdleConns, defaultMaxIdleConns)
+	assert.Equal(t, tr.MaxIdleConnsPerHost, defaultMaxIdleConnsPerHost)
+	assert.Equal(t, tr.IdleConnTimeout, defaultIdleConnTimeout*time.Second)
+	assert.Equal(t, tr.TLSHandshakeTimeout, defaultTLSHandshakeTimeout*time.Second)
+	assert.Equal(t, tr.ResponseHeaderTimeout, time.Duration(0))
+	assert.Equal(t, tr.ForceAttemptHTTP2, false)
+
+	// options from configuration
+	tr = newTransport(TransportConfig{
+		MaxIdleConns:          10,
+		MaxIdleConnsPerHost:   2,
+		MaxConnsPerHost:       5,
+		IdleConnTimeout:       30,
+		TLSHandshakeTimeout:   3,
+		ResponseHeaderTimeout: 60,
+		HTTP2:                 true,
+	})
+	assert.Equal(t, tr.MaxIdleConns, 10)
+	assert.Equal(t, tr.MaxIdleConnsPerHost, 2)
+	assert.Equal(t, tr.MaxConnsPerHost, 5)
+	assert.Equal(t, tr.IdleConnTimeout, 30*time.Second)
+	assert.Equal(t, tr.TLSHandshakeTimeout, 3*time.Second)
+	assert.Equal(t, tr.ResponseHeaderTimeout, 60*time.Second)
+	assert.Equal(t, tr.ForceAttemptHTTP2, true)
+}
+
+// Test_sharedTransport function
+func Test_sharedTransport(t *testing.T) {
+	cfg := Configuration{
+		TargetURL: "http://localhost:8080",
+		Ingress: []Ingress{
+			{Path: "/dbs", ServiceURL: "http://dbs1:8250,http://dbs2:8250"},
+			{Path: "/phedex", ServiceURL: "http://phedex:8260"},
+		},
+	}
+	reg, err := newIngressRegistry(cfg)
+	assert.Equal(t, err, nil)
+	backends := reg.Target.Backends
+	for _, rule := range reg.Rules {
+		backends = append(backends, rule.Pool.Backends...)
+	}
+	assert.Equal(t, len(backends), 4)
+
+	// all backend proxies use transport of the registry
+	proxies := make(map[*Backend]*httputil.ReverseProxy)
+	for _, b := range backends {
+		assert.NotEqual(t, b.proxy, nil)
+		assert.True(t, b.proxy.Transport == http.RoundTripper(reg.Transport))
+		proxies[b] = b.proxy
+	}
+
+	// proxies are built once per backend and reused by requests
+	pool := reg.Rules[0].Pool
+	for i := 0; i < 4; i++ {
+		b := pool.Next()
+		assert.True(t, b.proxy == proxies[b])
+	}
+}
@@ -0,0 +1,220 @@
+package main
+
+// reload module provides hot reload of server configuration
+//
+// Copyright (c) 2020 - Valentin Kuznetsov <vkuznet@gmail.com>
+//
+
+/*
+The server watches its configuration file (by checking its modification
+time every reload_interval seconds) and reloads it on change or upon
+SIGHUP signal. The new configuration is validated first, i.e. it should be
+parsed successfully and its ingress rules and providers should be
+initialized, otherwise it is rejected and server keeps previous one. The
+providers are contacted before the reload takes configuration lock, and when
+reloads overlap only the latest one is applied.
+On successful reload the server atomically swaps its whole state in single
+step: configuration (including CRIC and scitokens settings), CMS
+authentication with re-read secret files (including hmac), providers, cache
+of validated tokens and ingress rules (along with their backend pools and
+transport).
+The in-flight requests complete with ingress rules they started with.
+New server read/write timeouts are applied to new connections, while
+in-flight requests complete with previous ones.
+The port, listeners, session store, login providers and server
+certificates are applied at startup and require server restart.
+*/
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/dmwm/cmsauth"
+)
+
+// default interval (in sec) to check configuration file for changes
+const defaultReloadInterval = 10
+
+// configLock protects configuration reloads
+var configLock sync.Mutex
+
+// reloadGeneration counts started configuration reloads
+var reloadGeneration uint64
+
+// appliedGeneration holds generation of applied configuration reload, it
+// should be accessed under configLock
+var appliedGeneration uint64
+
+// serverState represents runtime state of the server which is replaced as a
+// whole on configuration reload, handlers obtain it via currentState (or
+// Config, CMSAuth, OAuthProviders, AccessTokens and currentIngress functions)
+// and never modify it
+type serverState struct {
+	Config       *Configuration       // server configuration
+	CMSAuth      *cmsauth.CMSAuth     // CMS authentication headers
+	Providers    map[string]*Provider // participated OAuth providers
+	AccessTokens *tokenCache          // cache of validated access tokens
+	Ingress      *IngressRegistry     // ingress rules of the server
+}
+
+// runtimeState holds current serverState of the server
+var runtimeState atomic.Value
+
+// stateLock serializes updates of server state
+var stateLock sync.Mutex
+
+func init() {
+	runtimeState.Store(&serverState{
+		Config:  &Configuration{},
+		CMSAuth: &cmsauth.CMSAuth{},
+		Ingress: &IngressRegistry{},
+	})
+}
+
+// helper function to get current state of the server
+func currentState() *serverState {
+	return runtimeState.Load().(*serverState)
+}
+
+// helper function to update state of the server, given function modifies
+// copy of current state which then atomically replaces it
+func updateState(fn func(st *serverState)) {
+	stateLock.Lock()
+	defer stateLock.Unlock()
+	st := *currentState()
+	fn(&st)
+	runtimeState.Store(&st)
+}
+
+// helper function to reload server configuration from given file
+func reloadConfig(configFile string) error {
+	// new configuration is validated and its providers are contacted outside
+	// of the lock, while overlapping reloads apply only the latest one
+	gen := atomic.AddUint64(&reloadGeneration, 1)
+	cfg, err := loadConfig(configFile)
+	if err != nil {
+		log.Printf("reject configuration %s, error %v\n", configFile, err)
+		return err
+	}
+	reg, err := newIngressRegistry(cfg)
+	if err != nil {
+		log.Printf("reject configuration %s, error %v\n", configFile, err)
+		return err
+	}
+	providers, err := initProviders(cfg)
+	if err != nil {
+		log.Printf("reject configuration %s, error %v\n", configFile, err)
+		return err
+	}
+	configLock.Lock()
+	defer configLock.Unlock()
+	if gen < appliedGeneration {
+		log.Printf("skip configuration %s, it is replaced by newer reload\n", configFile)
+		return nil
+	}
+	appliedGeneration = gen
+	if listenersChanged(Config().Listeners, cfg.Listeners) {
+		log.Println("server listeners were changed, new ports, auth methods and certificates require server restart")
+	}
+	if !reflect.DeepEqual(cfg.Session, Config().Session) {
+		log.Println("session store configuration was changed, it requires server restart")
+	}
+	if !reflect.DeepEqual(cfg.LoginProviders, Config().LoginProviders) {
+		log.Println("login providers were changed, it requires server restart")
+	}
+	if cfg.TokenExchange.Enable != Config().TokenExchange.Enable || cfg.InternalToken.Enable != Config().InternalToken.Enable {
+		log.Println("token exchange or internal tokens were enabled or disabled, it requires server restart")
+	}
+	cricChanged := cfg.CricURL != Config().CricURL || cfg.CricFile != Config().CricFile || cfg.UpdateCricInterval != Config().UpdateCricInterval || cfg.CricOffline != Config().CricOffline ||
+		cfg.CricMaxDrop != Config().CricMaxDrop || cfg.CricDropConfirm != Config().CricDropConfirm
+
+	auth := &cmsauth.CMSAuth{}
+	auth.Init(cfg.Hmac)
+
+	// swap server state in single step
+	reg.Start()
+	var old *IngressRegistry
+	updateState(func(st *serverState) {
+		old = st.Ingress
+		st.Config = &cfg
+		st.CMSAuth = auth
+		st.Providers = providers
+		// cached token attributes depend on providers and claims configuration
+		st.AccessTokens = newTokenCache(cfg.TokenCache.Size)
+		st.Ingress = reg
+	})
+	if old.Transport != nil {
+		old.Stop()
+	}
+	updateServerTimeouts(cfg)
+	// re-read public JWKS of server tokens
+	issuerCache.Store(newIssuerRecord(cfg.Scitokens))
+	if cricChanged {
+		select {
+		case cricUpdate <- struct{}{}:
+		default:
+		}
+	}
+	log.Printf("reloaded configuration %s with %d ingress rules\n", configFile, len(reg.Rules))
+	return nil
+}
+
+// helper function to check if listeners ports, auth methods or certificates
+// were changed
+func listenersChanged(old, listeners []Listener) bool {
+	if len(old) != len(listeners) {
+		return true
+	}
+	for idx, l := range listeners {
+		o := old[idx]
+		if o.Port != l.Port || o.Auth != l.Auth || o.ServerCrt != l.ServerCrt || o.ServerKey != l.ServerKey {
+			return true
+		}
+	}
+	return false
+}
+
+// helper function to get modification time of given file
+func modTime(fname string) time.Time {
+	if fi, err := os.Stat(filepath.Clean(fname)); err == nil {
+		return fi.ModTime()
+	}
+	return time.Time{}
+}
+
+// helper function to watch configuration file and reload it on its changes
+// or SIGHUP signal, should be run as goroutine
+func watchConfig(configFile string) {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGHUP)
+	lastMod := modTime(configFile)
+	for {
+		interval := Config().ReloadInterval
+		if interval == 0 {
+			interval = defaultReloadInterval
+		}
+		var tick <-chan time.Time
+		if interval > 0 {
+			tick = time.After(time.Duration(interval) * time.Second)
+		}
+		select {
+		case <-sig:
+			log.Println("received SIGHUP, reload configuration", configFile)
+		case <-tick:
+			mod := modTime(configFile)
+			if mod.IsZero() || mod.Equal(lastMod) {
+				continue
+			}
+			log.Println("configuration file was changed, reload configuration", configFile)
+		}
+		lastMod = modTime(configFile)
+		reloadConfig(configFile)
+	}
+}
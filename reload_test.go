@@ -0,0 +1,54 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Test_concurrentReload function should be run with -race flag
+func Test_concurrentReload(t *testing.T) {
+	tmp, err := ioutil.TempFile("", "config*.json")
+	assert.Equal(t, err, nil)
+	defer os.Remove(tmp.Name())
+	_, err = tmp.WriteString(`{"client_id": "id", "client_secret": "secret", "reload_interval": -1,
+		"ingress": [{"path": "/dbs", "service_url": "http://dbs:8250"}]}`)
+	assert.Equal(t, err, nil)
+	tmp.Close()
+	old := currentState()
+	defer updateState(func(st *serverState) {
+		*st = *old
+	})
+
+	// handlers read server state while it is reloaded
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				r := httptest.NewRequest("GET", "/dbs", nil)
+				_ = Config().ClientSecret
+				_ = CMSAuth()
+				_ = findIngressRule(currentIngress().Rules, r)
+			}
+		}()
+	}
+	for i := 0; i < 10; i++ {
+		err := reloadConfig(tmp.Name())
+		assert.Equal(t, err, nil)
+	}
+	close(done)
+	wg.Wait()
+	assert.Equal(t, len(currentIngress().Rules), 1)
+}
@@ -31,6 +31,7 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	// jwt "github.com/cristalhq/jwt/v3"
@@ -44,7 +45,7 @@ var publicKey *rsa.PublicKey
 
 // PublicJWKS represents public structure of jwks keys
 type PublicJWKS struct {
-	Keys []PublicJWKSKey
+	Keys []PublicJWKSKey `json:"keys"`
 }
 
 // PublicJWKSKey represents public jwks key
@@ -52,6 +53,7 @@ type PublicJWKSKey struct {
 	Alg string `json:"alg"`
 	E   string `json:"e"`
 	Kid string `json:"kid"`
+	Kty string `json:"kty"`
 	N   string `json:"n"`
 	Use string `json:"use"`
 }
@@ -93,7 +95,7 @@ func getScopes(r *http.Request, userData map[string]interface{}) []string {
 	}
 
 	// loop over scitokens rules and construct user's scopes
-	for _, rule := range Config.Scitokens.Rules {
+	for _, rule := range Config().Scitokens.Rules {
 		var rulesScopes []string
 		if strings.HasPrefix(rule.Match, "fqan:/cms") {
 			rulesScopes = rule.Scopes
@@ -116,9 +118,40 @@ func getScopes(r *http.Request, userData map[string]interface{}) []string {
 	return scopes
 }
 
-// helper function to get issuer
+// issuerRecord represents issuer and key id of tokens signed by the server
+// obtained from given scitokens configuration
+type issuerRecord struct {
+	Issuer     string // scitokens issuer of configuration
+	PublicJWKS string // public JWKS file of configuration
+	Name       string // issuer of tokens
+	Kid        string // key id of tokens
+}
+
+// issuerCache holds issuerRecord of current configuration such that public
+// JWKS file is not read on every request
+var issuerCache atomic.Value
+
+// helper function to get issuer and key id of tokens signed by the server,
+// they are obtained once per configuration
 func getIssuer(r *http.Request) (string, string) {
-	issuer := Config.Scitokens.Issuer
+	cfg := Config().Scitokens
+	if rec, ok := issuerCache.Load().(issuerRecord); ok && rec.Issuer == cfg.Issuer && rec.PublicJWKS == cfg.PublicJWKS {
+		return rec.Name, rec.Kid
+	}
+	rec := newIssuerRecord(cfg)
+	issuerCache.Store(rec)
+	return rec.Name, rec.Kid
+}
+
+// helper function to create issuer record of given scitokens configuration
+func newIssuerRecord(cfg ScitokensConfig) issuerRecord {
+	issuer, kid := loadIssuer(cfg)
+	return issuerRecord{Issuer: cfg.Issuer, PublicJWKS: cfg.PublicJWKS, Name: issuer, Kid: kid}
+}
+
+// helper function to load issuer and key id from scitokens configuration
+func loadIssuer(cfg ScitokensConfig) (string, string) {
+	issuer := cfg.Issuer
 	if issuer == "" {
 		hostname, err := os.Hostname()
 		if err != nil {
@@ -129,7 +162,7 @@ func getIssuer(r *http.Request) (string, string) {
 	}
 	// read kid from issuer_public.jwks file
 	kid := ""
-	rec, err := readPublicJWKS(Config.Scitokens.PublicJWKS)
+	rec, err := readPublicJWKS(cfg.PublicJWKS)
 	if err == nil {
 		kid = rec.Kid
 	}
@@ -195,7 +228,7 @@ func scitokensHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// generate new token and return it back to user
-	expires := time.Now().Add(time.Minute * time.Duration(Config.Scitokens.Lifetime)).Unix()
+	expires := time.Now().Add(time.Minute * time.Duration(Config().Scitokens.Lifetime)).Unix()
 	token, err := getSciToken(issuer, kid, jti, sub, strings.Join(scopes, " "))
 	if err != nil {
 		w.Write([]byte(fmt.Sprintf("unable to get token, error=%v", err)))
@@ -262,12 +295,12 @@ func getRSAKey(fname string) (*rsa.PrivateKey, error) {
 // helper function to get scitoken
 func getSciToken(issuer, kid, jti, sub, scopes string) (string, error) {
 	// Create a new token object, specifying signing method and the claims
-	expires := time.Now().Add(time.Minute * time.Duration(Config.Scitokens.Lifetime)).Unix()
+	expires := time.Now().Add(time.Minute * time.Duration(Config().Scitokens.Lifetime)).Unix()
 	now := time.Now().Unix()
 	iat := now
 	version := "scitoken:2.0"
-	if Config.Scitokens.Version != "" {
-		version = Config.Scitokens.Version
+	if Config().Scitokens.Version != "" {
+		version = Config().Scitokens.Version
 	}
 	// for definitions see
 	// https://godoc.org/github.com/dgrijalva/jwt-go#StandardClaims
@@ -283,14 +316,17 @@ func getSciToken(issuer, kid, jti, sub, scopes string) (string, error) {
 			NotBefore: now,     // nbf
 		},
 	}
+	return signClaims(claims, kid)
+}
+
+// helper function to sign given claims with server private key, empty kid
+// refers to default key-rs256 key id
+func signClaims(claims jwt.Claims, kid string) (string, error) {
 	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
-	if _, ok := token.Header["kid"]; !ok {
-		if kid == "" {
-			token.Header["kid"] = "key-rs256"
-		} else {
-			token.Header["kid"] = kid
-		}
+	if kid == "" {
+		kid = "key-rs256"
 	}
+	token.Header["kid"] = kid
 	tokenString, err := token.SignedString(privateKey)
 	return tokenString, err
 }
@@ -325,11 +361,21 @@ func validateJWT(w http.ResponseWriter, r *http.Request) (jwt.Claims, error) {
 	if err != nil {
 		return jwtClaims, fmt.Errorf("unable to parse JWT token, error: %v", err)
 	}
-	tokenClaims, ok := token.Claims.(jwt.Claims)
+	tokenClaims, ok := token.Claims.(*ScitokensClaims)
 
-	if !ok && !token.Valid {
+	if !ok || !token.Valid {
 		return jwtClaims, errors.New("invalid token")
 	}
+	// the server key signs exchanged and internal tokens of backends as well,
+	// they carry audience of the backend and no scitoken version and should
+	// not be accepted as scitokens
+	if tokenClaims.Audience != "" {
+		msg := fmt.Sprintf("token of audience '%s' is not a scitoken", tokenClaims.Audience)
+		return jwtClaims, errors.New(msg)
+	}
+	if tokenClaims.Version == "" {
+		return jwtClaims, errors.New("token without version is not a scitoken")
+	}
 	return tokenClaims, nil
 }
 
@@ -347,51 +393,60 @@ func validateHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-// helper function to start scitokens server
-func scitokensServer() {
-	// check if provided crt/key files exists
-	serverCrt := checkFile(Config.ServerCrt)
-	serverKey := checkFile(Config.ServerKey)
-
-	// initialize server private/public RSA keys to be used for signing
-	fname := Config.Scitokens.PrivateKey
+// helper function to initialize server private/public RSA keys to be used
+// for signing and validation of scitokens
+func initScitokensKeys() error {
+	// keys are shared by all server listeners
+	if privateKey != nil {
+		return nil
+	}
+	fname := Config().Scitokens.PrivateKey
 	key, err := getRSAKey(fname)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 	privateKey = key
 	publicKey = &privateKey.PublicKey
 
 	// read jwks record
-	publicJWKSkey, err = readPublicJWKS(Config.Scitokens.PublicJWKS)
+	if Config().Scitokens.PublicJWKS != "" {
+		publicJWKSkey, err = readPublicJWKS(Config().Scitokens.PublicJWKS)
+	}
+	return nil
+}
+
+// helper function to setup HTTP handlers of scitokens server
+func scitokensServeMux() *http.ServeMux {
+	if err := initScitokensKeys(); err != nil {
+		log.Fatal(err)
+	}
+
+	mux := http.NewServeMux()
 
 	// the server settings handler
-	base := Config.Base
-	http.HandleFunc(fmt.Sprintf("%s/server", base), settingsHandler)
+	base := Config().Base
+	mux.HandleFunc(fmt.Sprintf("%s/server", base), settingsHandler)
 	// metrics handler
-	http.HandleFunc(fmt.Sprintf("%s/metrics", base), metricsHandler)
+	mux.HandleFunc(fmt.Sprintf("%s/metrics", base), metricsHandler)
 	// static content
-	http.Handle(fmt.Sprintf("%s/.well-known/", base), http.StripPrefix(base+"/.well-known/", http.FileServer(http.Dir(Config.WellKnown))))
+	mux.Handle(fmt.Sprintf("%s/.well-known/", base), http.StripPrefix(base+"/.well-known/", http.FileServer(http.Dir(Config().WellKnown))))
+	internalTokenServeMux(mux)
 
 	// the HTTP handlers
-	http.HandleFunc(fmt.Sprintf("%s/token/validate", base), validateHandler)
-	http.HandleFunc(fmt.Sprintf("%s/token", base), scitokensHandler)
+	mux.HandleFunc(fmt.Sprintf("%s/token/validate", base), validateHandler)
+	mux.HandleFunc(fmt.Sprintf("%s/token", base), scitokensHandler)
 	if base == "" {
 		base = "/"
 	}
-	http.HandleFunc(base, func(w http.ResponseWriter, r *http.Request) {
+	mux.HandleFunc(base, func(w http.ResponseWriter, r *http.Request) {
 		_, err := validateJWT(w, r)
 		if err != nil {
 			handleError(w, r, fmt.Sprintf("%v", err), http.StatusForbidden)
 			return
 		}
+		// CMS headers of the client are never passed to backends
+		clearCMSHeaders(r)
 		redirect(w, r)
 	})
-
-	// start HTTPS server
-	server, err := getServer(serverCrt, serverKey, true)
-	if err != nil {
-		log.Fatalf("unable to start scitokens server, error %v\n", err)
-	}
-	log.Fatal(server.ListenAndServeTLS(serverCrt, serverKey))
+	return mux
 }
@@ -0,0 +1,605 @@
+package main
+
+// session module provides session stores of OAuth server
+//
+// Copyright (c) 2020 - Valentin Kuznetsov <vkuznet@gmail.com>
+//
+
+/*
+The OAuth server keeps user tokens, original request path and OAuth state in
+user sessions. The sessions can be kept in one of the following stores
+(session.store configuration parameter):
+- memory (default) sessions are kept in server memory and lost on restart
+- file             sessions are kept in BoltDB file (session.file) and
+                   survive server restarts, the file is locked by single
+                   process, therefore it can't be shared by server replicas
+                   and it is released to new process upon SIGUSR2 restart
+- cookie           sessions are kept in client cookies encrypted by AES-GCM
+                   with key derived from session.secret, they survive server
+                   restarts and are shared by all server replicas which use
+                   the same secret
+The cookie sessions hold user token bundle (access, refresh and ID tokens,
+their expiration and userinfo claims), therefore the encrypted cookie is
+split into chunks (gosessionid, gosessionid_1, ...) to fit browser limits.
+AES-GCM authenticates the cookies, i.e. modified cookies are rejected.
+The session.secret can be rotated by moving it to session.old_secrets list:
+new cookies are encrypted with session.secret while cookies encrypted with
+old secrets are still accepted until they expire.
+Sessions expire after session.ttl seconds (default 3600) of inactivity.
+The sessions are saved only if their values were changed or if less than
+half of their lifetime is left, i.e. requests of authenticated users do not
+write into session store.
+*/
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/thomasdarimont/go-kc-example/session"
+	bolt "go.etcd.io/bbolt"
+)
+
+// default values of session configuration
+const (
+	defaultSessionTTL    = 3600          // session lifetime in seconds
+	defaultSessionCookie = "gosessionid" // name of session cookie
+	cookieChunkSize      = 3800          // max size of session cookie chunk, browsers limit cookies to 4096 bytes
+	maxCookieChunks      = 10            // max number of session cookie chunks
+)
+
+// sessionsBucket defines name of BoltDB bucket with sessions
+var sessionsBucket = []byte("sessions")
+
+func init() {
+	// register types of session values which are not gob basic types
+	gob.Register(new(json.RawMessage))
+	gob.Register(map[string]AuthRequest{})
+}
+
+// SessionStore represents store of user sessions
+type SessionStore interface {
+	SessionStart(w http.ResponseWriter, r *http.Request) session.Session // read existing or start new session
+	SessionSave(w http.ResponseWriter, sess session.Session) error       // save session values
+	SessionDestroy(w http.ResponseWriter, r *http.Request)               // destroy session
+	SessionGC()                                                          // remove expired sessions
+}
+
+// sessionRecord represents serializable user session
+type sessionRecord struct {
+	SID    string                 // session id
+	Values map[string]interface{} // session values
+	Expire int64                  // unix time of session expiration
+}
+
+// userSession represents user session, it implements session.Session interface
+type userSession struct {
+	sessionRecord
+	chunks   int  // number of cookie chunks the session was read from
+	modified bool // session values were changed since session was read
+}
+
+// Set sets session value
+func (s *userSession) Set(key, value interface{}) error {
+	s.Values[fmt.Sprintf("%v", key)] = value
+	s.modified = true
+	return nil
+}
+
+// Get returns session value
+func (s *userSession) Get(key interface{}) interface{} {
+	if v, ok := s.Values[fmt.Sprintf("%v", key)]; ok {
+		return v
+	}
+	return nil
+}
+
+// Delete deletes session value
+func (s *userSession) Delete(key interface{}) error {
+	k := fmt.Sprintf("%v", key)
+	if _, ok := s.Values[k]; ok {
+		delete(s.Values, k)
+		s.modified = true
+	}
+	return nil
+}
+
+// SessionID returns session id
+func (s *userSession) SessionID() string {
+	return s.SID
+}
+
+// helper function to check if session is expired
+func (s *userSession) expired() bool {
+	return s.Expire < time.Now().Unix()
+}
+
+// helper function to check if session should be saved, i.e. its values were
+// changed or its expiration should be extended
+func (s *userSession) changed(ttl int64) bool {
+	return s.modified || s.Expire-time.Now().Unix() < ttl/2
+}
+
+// helper function to create new user session with random id
+func newUserSession(ttl int64) *userSession {
+	b := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, b); err != nil {
+		log.Println("unable to generate session id", err)
+	}
+	rec := sessionRecord{
+		SID:    base64.URLEncoding.EncodeToString(b),
+		Values: make(map[string]interface{}),
+		Expire: time.Now().Unix() + ttl,
+	}
+	return &userSession{sessionRecord: rec}
+}
+
+// helper function to encode user session
+func encodeSession(s *userSession) ([]byte, error) {
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(s.sessionRecord)
+	return buf.Bytes(), err
+}
+
+// helper function to decode user session
+func decodeSession(data []byte) (*userSession, error) {
+	var rec sessionRecord
+	err := gob.NewDecoder(bytes.NewReader(data)).Decode(&rec)
+	if rec.Values == nil {
+		rec.Values = make(map[string]interface{})
+	}
+	return &userSession{sessionRecord: rec}, err
+}
+
+// helper function to get session cookie value
+func sessionCookie(r *http.Request, name string) string {
+	cookie, err := r.Cookie(name)
+	if err != nil || cookie.Value == "" {
+		return ""
+	}
+	val, err := url.QueryUnescape(cookie.Value)
+	if err != nil {
+		return ""
+	}
+	return val
+}
+
+// helper function to set session cookie
+func setSessionCookie(w http.ResponseWriter, name, value string, ttl int64) {
+	cookie := http.Cookie{
+		Name:     name,
+		Value:    url.QueryEscape(value),
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteLaxMode,
+		MaxAge:   int(ttl),
+	}
+	if ttl < 0 {
+		cookie.Expires = time.Unix(0, 0)
+	}
+	http.SetCookie(w, &cookie)
+}
+
+// memorySessions keeps user sessions in memory
+type memorySessions struct {
+	TTL      int64                   // session lifetime in seconds
+	Cookie   string                  // name of session cookie
+	mu       sync.Mutex              // lock for sessions map
+	sessions map[string]*userSession // user sessions
+}
+
+// SessionStart reads existing or starts new session
+func (m *memorySessions) SessionStart(w http.ResponseWriter, r *http.Request) session.Session {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if s, ok := m.sessions[sessionCookie(r, m.Cookie)]; ok && !s.expired() {
+		s.Expire = time.Now().Unix() + m.TTL
+		return s
+	}
+	s := newUserSession(m.TTL)
+	m.sessions[s.SID] = s
+	setSessionCookie(w, m.Cookie, s.SID, m.TTL)
+	return s
+}
+
+// SessionSave saves session values, memory sessions are updated in place
+func (m *memorySessions) SessionSave(w http.ResponseWriter, sess session.Session) error {
+	return nil
+}
+
+// SessionDestroy destroys session
+func (m *memorySessions) SessionDestroy(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.sessions, sessionCookie(r, m.Cookie))
+	setSessionCookie(w, m.Cookie, "", -1)
+}
+
+// SessionGC removes expired sessions
+func (m *memorySessions) SessionGC() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for sid, s := range m.sessions {
+		if s.expired() {
+			delete(m.sessions, sid)
+		}
+	}
+}
+
+// fileSessions keeps user sessions in BoltDB file
+type fileSessions struct {
+	TTL    int64        // session lifetime in seconds
+	Cookie string       // name of session cookie
+	File   string       // name of BoltDB file
+	db     *bolt.DB     // BoltDB database, nil if the file is released
+	mutex  sync.RWMutex // protects BoltDB database
+}
+
+// errSessionsReleased is returned by file sessions when BoltDB file is
+// released to another server process
+var errSessionsReleased = errors.New("session file is released to another server process")
+
+// helper function to open BoltDB file of sessions, BoltDB locks the file
+// such that it can be opened by single process only
+func openSessionsDB(fname string) (*bolt.DB, error) {
+	db, err := bolt.Open(filepath.Clean(fname), 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(sessionsBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// helper function to run view transaction of BoltDB database
+func (f *fileSessions) view(fn func(*bolt.Tx) error) error {
+	f.mutex.RLock()
+	defer f.mutex.RUnlock()
+	if f.db == nil {
+		return errSessionsReleased
+	}
+	return f.db.View(fn)
+}
+
+// helper function to run update transaction of BoltDB database
+func (f *fileSessions) update(fn func(*bolt.Tx) error) error {
+	f.mutex.RLock()
+	defer f.mutex.RUnlock()
+	if f.db == nil {
+		return errSessionsReleased
+	}
+	return f.db.Update(fn)
+}
+
+// Release closes BoltDB file such that another server process can open it,
+// the sessions can't be read or saved until Reopen call
+func (f *fileSessions) Release() error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.db == nil {
+		return nil
+	}
+	err := f.db.Close()
+	f.db = nil
+	return err
+}
+
+// Reopen opens released BoltDB file again
+func (f *fileSessions) Reopen() error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.db != nil {
+		return nil
+	}
+	db, err := openSessionsDB(f.File)
+	if err != nil {
+		return err
+	}
+	f.db = db
+	return nil
+}
+
+// SessionStart reads existing or starts new session
+func (f *fileSessions) SessionStart(w http.ResponseWriter, r *http.Request) session.Session {
+	sid := sessionCookie(r, f.Cookie)
+	var data []byte
+	if sid != "" {
+		err := f.view(func(tx *bolt.Tx) error {
+			if v := tx.Bucket(sessionsBucket).Get([]byte(sid)); v != nil {
+				data = append(data, v...)
+			}
+			return nil
+		})
+		if err == errSessionsReleased {
+			// keep session cookie of the user, the session is served by
+			// another server process
+			s := newUserSession(f.TTL)
+			s.SID = sid
+			return s
+		}
+	}
+	if data != nil {
+		s, err := decodeSession(data)
+		if err == nil && !s.expired() {
+			return s
+		}
+		if err != nil {
+			log.Printf("unable to decode session %s, error %v\n", sid, err)
+		}
+	}
+	s := newUserSession(f.TTL)
+	setSessionCookie(w, f.Cookie, s.SID, f.TTL)
+	return s
+}
+
+// SessionSave saves session values if they were changed
+func (f *fileSessions) SessionSave(w http.ResponseWriter, sess session.Session) error {
+	s, ok := sess.(*userSession)
+	if !ok {
+		return errors.New("unsupported session type")
+	}
+	if !s.changed(f.TTL) {
+		return nil
+	}
+	expire := s.Expire
+	s.Expire = time.Now().Unix() + f.TTL
+	data, err := encodeSession(s)
+	if err != nil {
+		return err
+	}
+	err = f.update(func(tx *bolt.Tx) error {
+		return tx.Bucket(sessionsBucket).Put([]byte(s.SID), data)
+	})
+	if err != nil {
+		s.Expire = expire
+		return err
+	}
+	s.modified = false
+	return nil
+}
+
+// SessionDestroy destroys session
+func (f *fileSessions) SessionDestroy(w http.ResponseWriter, r *http.Request) {
+	if sid := sessionCookie(r, f.Cookie); sid != "" {
+		f.update(func(tx *bolt.Tx) error {
+			return tx.Bucket(sessionsBucket).Delete([]byte(sid))
+		})
+	}
+	setSessionCookie(w, f.Cookie, "", -1)
+}
+
+// SessionGC removes expired sessions
+func (f *fileSessions) SessionGC() {
+	err := f.update(func(tx *bolt.Tx) error {
+		c := tx.Bucket(sessionsBucket).Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			if s, err := decodeSession(v); err != nil || s.expired() {
+				if err := c.Delete(); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil && err != errSessionsReleased {
+		log.Println("unable to remove expired sessions", err)
+	}
+}
+
+// cookieSessions keeps user sessions in encrypted client cookies
+type cookieSessions struct {
+	TTL    int64         // session lifetime in seconds
+	Cookie string        // name of session cookie
+	aeads  []cipher.AEAD // ciphers of session secrets, the first one encrypts cookies
+}
+
+// helper function to create AES-GCM cipher with key derived from given secret
+func newSessionCipher(secret string) (cipher.AEAD, error) {
+	key := sha256.Sum256([]byte(secret))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// helper function to get name of session cookie chunk, the first chunk
+// uses session cookie name and others have their index as suffix
+func chunkName(cookie string, idx int) string {
+	if idx == 0 {
+		return cookie
+	}
+	return fmt.Sprintf("%s_%d", cookie, idx)
+}
+
+// helper function to read session cookie chunks
+func (c *cookieSessions) chunks(r *http.Request) []string {
+	var chunks []string
+	for idx := 0; idx < maxCookieChunks; idx++ {
+		val := sessionCookie(r, chunkName(c.Cookie, idx))
+		if val == "" {
+			break
+		}
+		chunks = append(chunks, val)
+	}
+	return chunks
+}
+
+// SessionStart reads existing or starts new session
+func (c *cookieSessions) SessionStart(w http.ResponseWriter, r *http.Request) session.Session {
+	chunks := c.chunks(r)
+	if len(chunks) > 0 {
+		s, err := c.decrypt(strings.Join(chunks, ""))
+		if err == nil && !s.expired() {
+			s.chunks = len(chunks)
+			return s
+		}
+		if err != nil && Config().Verbose > 0 {
+			log.Println("unable to decrypt session cookie", err)
+		}
+	}
+	s := newUserSession(c.TTL)
+	s.chunks = len(chunks)
+	return s
+}
+
+// helper function to decrypt session cookie, it tries all session secrets
+// to accept cookies encrypted before secret rotation
+func (c *cookieSessions) decrypt(val string) (*userSession, error) {
+	data, err := base64.RawURLEncoding.DecodeString(val)
+	if err != nil {
+		return nil, err
+	}
+	for _, aead := range c.aeads {
+		size := aead.NonceSize()
+		if len(data) < size {
+			return nil, errors.New("invalid session cookie")
+		}
+		plain, err := aead.Open(nil, data[:size], data[size:], []byte(c.Cookie))
+		if err == nil {
+			return decodeSession(plain)
+		}
+	}
+	return nil, errors.New("unable to authenticate session cookie with any session secret")
+}
+
+// SessionSave saves changed session values into encrypted session cookie,
+// the cookie is split into chunks to fit browser limits
+func (c *cookieSessions) SessionSave(w http.ResponseWriter, sess session.Session) error {
+	s, ok := sess.(*userSession)
+	if !ok {
+		return errors.New("unsupported session type")
+	}
+	if !s.changed(c.TTL) {
+		return nil
+	}
+	s.Expire = time.Now().Unix() + c.TTL
+	data, err := encodeSession(s)
+	if err != nil {
+		return err
+	}
+	aead := c.aeads[0]
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return err
+	}
+	data = aead.Seal(nonce, nonce, data, []byte(c.Cookie))
+	val := base64.RawURLEncoding.EncodeToString(data)
+	if len(val) > maxCookieChunks*cookieChunkSize {
+		msg := fmt.Sprintf("session cookie size %d exceeds %d bytes", len(val), maxCookieChunks*cookieChunkSize)
+		return errors.New(msg)
+	}
+	idx := 0
+	for ; len(val) > 0; idx++ {
+		size := cookieChunkSize
+		if len(val) < size {
+			size = len(val)
+		}
+		setSessionCookie(w, chunkName(c.Cookie, idx), val[:size], c.TTL)
+		val = val[size:]
+	}
+	// expire chunks left from previous larger session cookie
+	chunks := idx
+	for ; idx < s.chunks; idx++ {
+		setSessionCookie(w, chunkName(c.Cookie, idx), "", -1)
+	}
+	s.chunks = chunks
+	s.modified = false
+	return nil
+}
+
+// SessionDestroy destroys session
+func (c *cookieSessions) SessionDestroy(w http.ResponseWriter, r *http.Request) {
+	for idx := range c.chunks(r) {
+		setSessionCookie(w, chunkName(c.Cookie, idx), "", -1)
+	}
+}
+
+// SessionGC removes expired sessions, cookie sessions are expired by clients
+func (c *cookieSessions) SessionGC() {
+}
+
+// helper function to create session store for given configuration
+func newSessionStore(cfg SessionConfig) (SessionStore, error) {
+	ttl := int64(cfg.TTL)
+	if ttl == 0 {
+		ttl = defaultSessionTTL
+	}
+	cookie := cfg.Cookie
+	if cookie == "" {
+		cookie = defaultSessionCookie
+	}
+	switch cfg.Store {
+	case "", "memory":
+		return &memorySessions{TTL: ttl, Cookie: cookie, sessions: make(map[string]*userSession)}, nil
+	case "file":
+		db, err := openSessionsDB(cfg.File)
+		if err != nil {
+			return nil, err
+		}
+		return &fileSessions{TTL: ttl, Cookie: cookie, File: cfg.File, db: db}, nil
+	case "cookie":
+		var aeads []cipher.AEAD
+		for _, secret := range append([]string{cfg.Secret}, cfg.OldSecrets...) {
+			aead, err := newSessionCipher(secret)
+			if err != nil {
+				return nil, err
+			}
+			aeads = append(aeads, aead)
+		}
+		return &cookieSessions{TTL: ttl, Cookie: cookie, aeads: aeads}, nil
+	}
+	msg := fmt.Sprintf("unsupported session store '%s'", cfg.Store)
+	return nil, errors.New(msg)
+}
+
+// helper function to release session store to new server process upon
+// restart, only file store holds resources (lock of BoltDB file)
+func releaseSessionStore(store SessionStore) error {
+	if f, ok := store.(*fileSessions); ok {
+		return f.Release()
+	}
+	return nil
+}
+
+// helper function to reopen session store released by failed restart
+func reopenSessionStore(store SessionStore) error {
+	if f, ok := store.(*fileSessions); ok {
+		return f.Reopen()
+	}
+	return nil
+}
+
+// helper function to periodically remove expired sessions of given store
+// should be run as goroutine
+func sessionsGC(store SessionStore, ttl int) {
+	if ttl == 0 {
+		ttl = defaultSessionTTL
+	}
+	for {
+		time.Sleep(time.Duration(ttl) * time.Second)
+		store.SessionGC()
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Test_sessionStores function
+func Test_sessionStores(t *testing.T) {
+	dir := t.TempDir()
+	configs := []SessionConfig{
+		{Store: "memory"},
+		{Store: "file", File: filepath.Join(dir, "sessions.db")},
+		{Store: "cookie", Secret: "secret"},
+	}
+	userInfo := json.RawMessage(`{"name":"test"}`)
+	for _, cfg := range configs {
+		store, err := newSessionStore(cfg)
+		assert.Equal(t, err, nil)
+
+		// new session is saved and its cookie is returned to client
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/dbs", nil)
+		sess := store.SessionStart(w, r)
+		sess.Set("path", "/dbs")
+		sess.Set("accessExpire", int64(10))
+		sess.Set("userinfo", &userInfo)
+		err = store.SessionSave(w, sess)
+		assert.Equal(t, err, nil)
+		cookies := w.Result().Cookies()
+		assert.Equal(t, len(cookies), 1)
+
+		// next request of the client reads session values
+		r = httptest.NewRequest("GET", "/dbs", nil)
+		r.AddCookie(cookies[0])
+		sess = store.SessionStart(httptest.NewRecorder(), r)
+		msg := fmt.Sprintf("%s session store", cfg.Store)
+		assert.Equal(t, sess.Get("path"), "/dbs", msg)
+		assert.Equal(t, sess.Get("accessExpire"), int64(10), msg)
+		assert.Equal(t, sess.Get("userinfo"), &userInfo, msg)
+
+		// destroyed session is not available anymore
+		store.SessionDestroy(httptest.NewRecorder(), r)
+		store.SessionGC()
+		if cfg.Store != "cookie" {
+			sess = store.SessionStart(httptest.NewRecorder(), r)
+			assert.Equal(t, sess.Get("path"), nil, msg)
+		}
+	}
+
+	// cookie encrypted with another secret is rejected
+	store, err := newSessionStore(SessionConfig{Store: "cookie", Secret: "secret"})
+	assert.Equal(t, err, nil)
+	w := httptest.NewRecorder()
+	sess := store.SessionStart(w, httptest.NewRequest("GET", "/", nil))
+	sess.Set("path", "/dbs")
+	assert.Equal(t, store.SessionSave(w, sess), nil)
+	store, err = newSessionStore(SessionConfig{Store: "cookie", Secret: "another"})
+	assert.Equal(t, err, nil)
+	r := httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(w.Result().Cookies()[0])
+	sess = store.SessionStart(httptest.NewRecorder(), r)
+	assert.Equal(t, sess.Get("path"), nil)
+}
+
+// Test_cookieSessions function
+func Test_cookieSessions(t *testing.T) {
+	store, err := newSessionStore(SessionConfig{Store: "cookie", Secret: "old"})
+	assert.Equal(t, err, nil)
+
+	// large token bundle is split into several cookie chunks
+	token := strings.Repeat("x", 2*cookieChunkSize)
+	w := httptest.NewRecorder()
+	sess := store.SessionStart(w, httptest.NewRequest("GET", "/", nil))
+	sess.Set("accessToken", token)
+	assert.Equal(t, store.SessionSave(w, sess), nil)
+	cookies := w.Result().Cookies()
+	assert.Equal(t, len(cookies), 3)
+	assert.Equal(t, cookies[1].Name, "gosessionid_1")
+
+	// session encrypted with old secret is read after secret rotation
+	store, err = newSessionStore(SessionConfig{Store: "cookie", Secret: "new", OldSecrets: []string{"old"}})
+	assert.Equal(t, err, nil)
+	r := httptest.NewRequest("GET", "/", nil)
+	for _, cookie := range cookies {
+		r.AddCookie(cookie)
+	}
+	sess = store.SessionStart(httptest.NewRecorder(), r)
+	assert.Equal(t, sess.Get("accessToken"), token)
+
+	// unchanged session does not set cookies
+	w = httptest.NewRecorder()
+	assert.Equal(t, store.SessionSave(w, sess), nil)
+	assert.Equal(t, len(w.Result().Cookies()), 0)
+
+	// smaller session expires stale chunks
+	sess.Set("accessToken", "token")
+	w = httptest.NewRecorder()
+	assert.Equal(t, store.SessionSave(w, sess), nil)
+	cookies = w.Result().Cookies()
+	assert.Equal(t, len(cookies), 3)
+	assert.Equal(t, cookies[1].MaxAge, -1)
+	assert.Equal(t, cookies[2].MaxAge, -1)
+
+	// modified cookie is rejected
+	val := []byte(cookies[0].Value)
+	val[len(val)/2] ^= 1
+	r = httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(&http.Cookie{Name: cookies[0].Name, Value: string(val)})
+	sess = store.SessionStart(httptest.NewRecorder(), r)
+	assert.Equal(t, sess.Get("accessToken"), nil)
+}
+
+// Test_releaseFileSessions function
+func Test_releaseFileSessions(t *testing.T) {
+	cfg := SessionConfig{Store: "file", File: filepath.Join(t.TempDir(), "sessions.db")}
+	store, err := newSessionStore(cfg)
+	assert.Equal(t, err, nil)
+
+	// released session file is opened by new server process
+	assert.Equal(t, releaseSessionStore(store), nil)
+	next, err := newSessionStore(cfg)
+	assert.Equal(t, err, nil)
+	w := httptest.NewRecorder()
+	sess := next.SessionStart(w, httptest.NewRequest("GET", "/dbs", nil))
+	sess.Set("path", "/dbs")
+	assert.Equal(t, next.SessionSave(w, sess), nil)
+	cookie := w.Result().Cookies()[0]
+
+	// released store keeps session cookie of the user and can't save sessions
+	r := httptest.NewRequest("GET", "/dbs", nil)
+	r.AddCookie(cookie)
+	w = httptest.NewRecorder()
+	sess = store.SessionStart(w, r)
+	assert.Equal(t, sess.SessionID(), sessionCookie(r, defaultSessionCookie))
+	assert.Equal(t, len(w.Result().Cookies()), 0)
+	sess.Set("path", "/dbs")
+	assert.Equal(t, store.SessionSave(w, sess), errSessionsReleased)
+
+	// session file is reopened when new process releases it
+	assert.Equal(t, releaseSessionStore(next), nil)
+	assert.Equal(t, reopenSessionStore(store), nil)
+	sess = store.SessionStart(httptest.NewRecorder(), r)
+	assert.Equal(t, sess.Get("path"), "/dbs")
+	assert.Equal(t, releaseSessionStore(store), nil)
+}
+
+// Test_sessionChanges function
+func Test_sessionChanges(t *testing.T) {
+	store, err := newSessionStore(SessionConfig{Store: "file", File: filepath.Join(t.TempDir(), "sessions.db")})
+	assert.Equal(t, err, nil)
+	defer releaseSessionStore(store)
+
+	// session without values is not saved
+	w := httptest.NewRecorder()
+	sess := store.SessionStart(w, httptest.NewRequest("GET", "/dbs", nil))
+	assert.Equal(t, store.SessionSave(w, sess), nil)
+	r := httptest.NewRequest("GET", "/dbs", nil)
+	r.AddCookie(w.Result().Cookies()[0])
+	assert.NotEqual(t, store.SessionStart(httptest.NewRecorder(), r).SessionID(), sess.SessionID())
+
+	// changed session is saved while unchanged one keeps its expiration
+	w = httptest.NewRecorder()
+	sess = store.SessionStart(w, httptest.NewRequest("GET", "/dbs", nil))
+	sess.Set("path", "/dbs")
+	assert.Equal(t, store.SessionSave(w, sess), nil)
+	r = httptest.NewRequest("GET", "/dbs", nil)
+	r.AddCookie(w.Result().Cookies()[0])
+	sess = store.SessionStart(httptest.NewRecorder(), r)
+	assert.Equal(t, sess.Get("path"), "/dbs")
+	expire := sess.(*userSession).Expire
+	sess.(*userSession).Expire = expire + 10
+	assert.Equal(t, store.SessionSave(w, sess), nil)
+	sess = store.SessionStart(httptest.NewRecorder(), r)
+	assert.Equal(t, sess.(*userSession).Expire, expire)
+
+	// expiration of session is extended when half of its lifetime is left
+	sess.(*userSession).Expire = time.Now().Unix() + 10
+	assert.Equal(t, store.SessionSave(w, sess), nil)
+	sess = store.SessionStart(httptest.NewRecorder(), r)
+	assert.Equal(t, sess.(*userSession).Expire >= time.Now().Unix()+defaultSessionTTL-1, true)
+}
@@ -0,0 +1,417 @@
+package main
+
+// shutdown module provides graceful shutdown and restart of the server
+//
+// Copyright (c) 2020 - Valentin Kuznetsov <vkuznet@gmail.com>
+//
+
+/*
+Upon SIGTERM or SIGINT signal the server stops accepting new connections,
+waits for in-flight requests to complete for up to shutdown_timeout seconds
+(by default equal to write_timeout), stops CRIC updates and health checks
+of ingress backends, flushes logs and exits.
+
+Upon SIGUSR2 signal the server hands off its listening sockets to a new
+process started from (possibly upgraded) server executable with the same
+command line arguments, and then gracefully shuts down itself. The new
+process accepts connections on inherited sockets right away, therefore
+there is no downtime during binary upgrades. The sockets are passed as
+extra files of the new process and described via AUTH_PROXY_LISTENER_FDS
+environment variable, e.g. "8181:3,9090:4" (port:file descriptor). The file
+session store is released before the hand off since BoltDB file is locked by
+single process.
+
+The listening sockets are served by HTTP servers via connections listener,
+such that on configuration reload with new read or write timeouts the HTTP
+servers are replaced by new ones on the same sockets, while old servers
+drain their in-flight requests.
+*/
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// listenerFDsEnv defines environment variable which describes listening
+// sockets inherited from parent process
+const listenerFDsEnv = "AUTH_PROXY_LISTENER_FDS"
+
+// inheritedListeners holds listening sockets inherited from parent process
+var inheritedListeners map[int]net.Listener
+
+// inheritOnce allows to read inherited sockets only once
+var inheritOnce sync.Once
+
+// runningServers holds servers started by serve function
+var runningServers []*runningServer
+
+// runningServersLock protects access to running servers
+var runningServersLock sync.Mutex
+
+// errListenerClosed is returned by connections listener of stopped server
+var errListenerClosed = errors.New("listener is closed")
+
+// connListener passes connections accepted on listening socket to HTTP
+// server, such that HTTP server can be replaced without closing the socket
+type connListener struct {
+	net.Listener               // listening socket
+	conns        chan net.Conn // connections accepted on listening socket
+	done         chan struct{} // closed when HTTP server is stopped
+	once         sync.Once     // allows to close listener only once
+}
+
+// Accept provides next connection accepted on listening socket
+func (l *connListener) Accept() (net.Conn, error) {
+	// stopped server should not get new connections
+	select {
+	case <-l.done:
+		return nil, errListenerClosed
+	default:
+	}
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, errListenerClosed
+	}
+}
+
+// Close stops passing connections to HTTP server, the listening socket
+// stays open
+func (l *connListener) Close() error {
+	l.once.Do(func() { close(l.done) })
+	return nil
+}
+
+// runningServer represents HTTP server along with its listening socket
+type runningServer struct {
+	Port      int            // port of the server
+	Server    *http.Server   // HTTP server
+	Listener  net.Listener   // listening socket of the server
+	ServerCrt string         // server certificate file of HTTPs server
+	ServerKey string         // server key file of HTTPs server
+	Timeouts  bool           // HTTP server uses read/write timeouts of configuration
+	template  http.Server    // settings of HTTP server used to create new ones
+	conns     chan net.Conn  // connections accepted on listening socket
+	stop      chan struct{}  // closed when running server is stopped
+	errs      chan<- error   // errors of the server
+	mutex     sync.Mutex     // protects replacement of HTTP server
+	draining  sync.WaitGroup // replaced HTTP servers which drain requests
+}
+
+// helper function to start running server, it accepts connections on
+// listening socket and passes them to HTTP server
+func (srv *runningServer) start(errs chan<- error) {
+	// HTTP server modifies its settings when it starts serving, therefore
+	// we keep copy of them before
+	srv.template = http.Server{
+		Addr:           srv.Server.Addr,
+		Handler:        srv.Server.Handler,
+		ReadTimeout:    srv.Server.ReadTimeout,
+		WriteTimeout:   srv.Server.WriteTimeout,
+		MaxHeaderBytes: srv.Server.MaxHeaderBytes,
+		ErrorLog:       srv.Server.ErrorLog,
+	}
+	if srv.Server.TLSConfig != nil {
+		srv.template.TLSConfig = srv.Server.TLSConfig.Clone()
+	}
+	srv.conns = make(chan net.Conn)
+	srv.stop = make(chan struct{})
+	srv.errs = errs
+	go srv.accept()
+	srv.serve(srv.current())
+}
+
+// helper function to get current HTTP server of running server
+func (srv *runningServer) current() *http.Server {
+	srv.mutex.Lock()
+	defer srv.mutex.Unlock()
+	return srv.Server
+}
+
+// helper function to accept connections on listening socket until it is
+// closed, temporary errors are retried with delay as in http.Server
+func (srv *runningServer) accept() {
+	var delay time.Duration
+	for {
+		conn, err := srv.Listener.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				if delay == 0 {
+					delay = 5 * time.Millisecond
+				} else if delay *= 2; delay > time.Second {
+					delay = time.Second
+				}
+				log.Printf("accept error on port %d: %v; retrying in %v\n", srv.Port, err, delay)
+				time.Sleep(delay)
+				continue
+			}
+			if !errors.Is(err, net.ErrClosed) {
+				srv.errs <- fmt.Errorf("server on port %d: %v", srv.Port, err)
+			}
+			return
+		}
+		delay = 0
+		select {
+		case srv.conns <- conn:
+		case <-srv.stop:
+			conn.Close()
+			return
+		}
+	}
+}
+
+// helper function to serve requests of given HTTP server
+func (srv *runningServer) serve(server *http.Server) {
+	ln := &connListener{Listener: srv.Listener, conns: srv.conns, done: make(chan struct{})}
+	go func() {
+		var err error
+		if server.TLSConfig != nil {
+			err = server.ServeTLS(ln, srv.ServerCrt, srv.ServerKey)
+		} else {
+			err = server.Serve(ln)
+		}
+		if err != http.ErrServerClosed {
+			srv.errs <- fmt.Errorf("server on port %d: %v", srv.Port, err)
+		}
+	}()
+}
+
+// helper function to replace HTTP server of running server with given one,
+// new connections are served by new server while old one drains its
+// in-flight requests for up to shutdown timeout
+func (srv *runningServer) replace(server *http.Server) {
+	srv.mutex.Lock()
+	old := srv.Server
+	srv.Server = server
+	srv.mutex.Unlock()
+	srv.serve(server)
+	srv.draining.Add(1)
+	go func() {
+		defer srv.draining.Done()
+		drain(old, srv.Port)
+	}()
+}
+
+// helper function to drain in-flight requests of HTTP server for up to
+// shutdown timeout
+func drain(server *http.Server, port int) {
+	timeout := time.Duration(Config().ShutdownTimeout) * time.Second
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		log.Printf("unable to drain server on port %d, error %v\n", port, err)
+		server.Close()
+	}
+}
+
+// helper function to apply read and write timeouts of given configuration
+// to running servers, their HTTP servers are replaced by new ones which
+// use the same listening sockets
+func updateServerTimeouts(cfg Configuration) {
+	readTimeout := time.Duration(cfg.ReadTimeout) * time.Second
+	writeTimeout := time.Duration(cfg.WriteTimeout) * time.Second
+	runningServersLock.Lock()
+	defer runningServersLock.Unlock()
+	for _, srv := range runningServers {
+		tmpl := &srv.template
+		if !srv.Timeouts || (tmpl.ReadTimeout == readTimeout && tmpl.WriteTimeout == writeTimeout) {
+			continue
+		}
+		tmpl.ReadTimeout = readTimeout
+		tmpl.WriteTimeout = writeTimeout
+		server := &http.Server{
+			Addr:           tmpl.Addr,
+			Handler:        tmpl.Handler,
+			ReadTimeout:    readTimeout,
+			WriteTimeout:   writeTimeout,
+			MaxHeaderBytes: tmpl.MaxHeaderBytes,
+			ErrorLog:       tmpl.ErrorLog,
+		}
+		if tmpl.TLSConfig != nil {
+			server.TLSConfig = tmpl.TLSConfig.Clone()
+		}
+		log.Printf("apply read timeout %v and write timeout %v to server on port %d\n", readTimeout, writeTimeout, srv.Port)
+		srv.replace(server)
+	}
+}
+
+// helper function to parse sockets inherited from parent process
+func parseInheritedListeners(fds string) (map[int]net.Listener, error) {
+	listeners := make(map[int]net.Listener)
+	if fds == "" {
+		return listeners, nil
+	}
+	for _, item := range strings.Split(fds, ",") {
+		arr := strings.Split(item, ":")
+		if len(arr) != 2 {
+			msg := fmt.Sprintf("invalid listener file descriptor '%s'", item)
+			return listeners, errors.New(msg)
+		}
+		port, err := strconv.Atoi(arr[0])
+		if err != nil {
+			return listeners, err
+		}
+		fd, err := strconv.Atoi(arr[1])
+		if err != nil {
+			return listeners, err
+		}
+		file := os.NewFile(uintptr(fd), fmt.Sprintf("listener-%d", port))
+		ln, err := net.FileListener(file)
+		file.Close()
+		if err != nil {
+			return listeners, err
+		}
+		listeners[port] = ln
+	}
+	return listeners, nil
+}
+
+// helper function to create listening socket on given port, it reuses
+// socket inherited from parent process if it exists
+func listen(port int) (net.Listener, error) {
+	inheritOnce.Do(func() {
+		fds := os.Getenv(listenerFDsEnv)
+		os.Unsetenv(listenerFDsEnv)
+		listeners, err := parseInheritedListeners(fds)
+		if err != nil {
+			log.Printf("unable to use inherited listeners '%s', error %v\n", fds, err)
+		}
+		inheritedListeners = listeners
+	})
+	if ln, ok := inheritedListeners[port]; ok {
+		log.Printf("use inherited listener on port %d\n", port)
+		delete(inheritedListeners, port)
+		return ln, nil
+	}
+	return net.Listen("tcp", fmt.Sprintf(":%d", port))
+}
+
+// helper function to start new server process with sockets of running
+// servers
+func handoff(servers []*runningServer) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	var files []*os.File
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	var fds []string
+	for _, srv := range servers {
+		ln, ok := srv.Listener.(*net.TCPListener)
+		if !ok {
+			msg := fmt.Sprintf("unable to hand off listener on port %d", srv.Port)
+			return errors.New(msg)
+		}
+		file, err := ln.File()
+		if err != nil {
+			return err
+		}
+		// extra files of new process start from file descriptor 3
+		fds = append(fds, fmt.Sprintf("%d:%d", srv.Port, 3+len(files)))
+		files = append(files, file)
+	}
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Env = append(os.Environ(), fmt.Sprintf("%s=%s", listenerFDsEnv, strings.Join(fds, ",")))
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = files
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	log.Printf("started new server process %d with listeners %s\n", cmd.Process.Pid, strings.Join(fds, ","))
+	return nil
+}
+
+// helper function to gracefully shutdown running servers, it drains
+// in-flight requests for up to shutdown timeout
+func shutdown(servers []*runningServer) {
+	timeout := time.Duration(Config().ShutdownTimeout) * time.Second
+	log.Printf("shutdown server, drain in-flight requests for up to %v\n", timeout)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	var wg sync.WaitGroup
+	for _, srv := range servers {
+		// stop accepting new connections
+		srv.Listener.Close()
+		close(srv.stop)
+		wg.Add(1)
+		go func(srv *runningServer) {
+			defer wg.Done()
+			server := srv.current()
+			if err := server.Shutdown(ctx); err != nil {
+				log.Printf("unable to drain server on port %d, error %v\n", srv.Port, err)
+				server.Close()
+			}
+			// wait for servers replaced on configuration reload
+			srv.draining.Wait()
+		}(srv)
+	}
+	wg.Wait()
+
+	// stop background goroutines
+	stopCricUpdates()
+	if reg := currentIngress(); reg.Transport != nil {
+		reg.Stop()
+	}
+	log.Println("server is stopped")
+
+	// flush logs
+	if w, ok := log.Writer().(rotateLogWriter); ok {
+		w.RotateLogs.Close()
+	}
+	os.Stdout.Sync()
+}
+
+// helper function to serve running servers and handle shutdown and
+// restart signals, it blocks until servers are stopped
+func serve(servers []*runningServer) {
+	errs := make(chan error, len(servers))
+	runningServersLock.Lock()
+	for _, srv := range servers {
+		srv.start(errs)
+	}
+	runningServers = servers
+	runningServersLock.Unlock()
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGTERM, syscall.SIGINT, syscall.SIGUSR2)
+	for {
+		select {
+		case err := <-errs:
+			log.Fatal(err)
+		case s := <-sig:
+			log.Printf("received %v signal\n", s)
+			if s == syscall.SIGUSR2 {
+				// new process should be able to open session file
+				if err := releaseSessionStore(globalSessions); err != nil {
+					log.Printf("unable to release session store, error %v\n", err)
+				}
+				if err := handoff(servers); err != nil {
+					log.Printf("unable to hand off listeners to new process, error %v\n", err)
+					if err := reopenSessionStore(globalSessions); err != nil {
+						log.Fatalf("unable to reopen session store, error %v\n", err)
+					}
+					continue
+				}
+			}
+			shutdown(servers)
+			return
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Test_parseInheritedListeners function
+func Test_parseInheritedListeners(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Equal(t, err, nil)
+	defer ln.Close()
+	file, err := ln.(*net.TCPListener).File()
+	assert.Equal(t, err, nil)
+	port := ln.Addr().(*net.TCPAddr).Port
+
+	listeners, err := parseInheritedListeners(fmt.Sprintf("%d:%d", port, file.Fd()))
+	assert.Equal(t, err, nil)
+	assert.Equal(t, len(listeners), 1)
+	assert.Equal(t, listeners[port].Addr().String(), ln.Addr().String())
+	listeners[port].Close()
+
+	_, err = parseInheritedListeners("8181")
+	assert.NotEqual(t, err, nil)
+}
+
+// Test_shutdown function
+func Test_shutdown(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Equal(t, err, nil)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+		w.Write([]byte("done"))
+	})
+	srv := &runningServer{Server: &http.Server{Handler: handler}, Listener: ln}
+	srv.start(make(chan error, 1))
+	Config().ShutdownTimeout = 5
+	defer func() { Config().ShutdownTimeout = 0 }()
+
+	// in-flight request completes during shutdown
+	body := make(chan string, 1)
+	go func() {
+		resp, err := http.Get(fmt.Sprintf("http://%s/", ln.Addr()))
+		if err != nil {
+			body <- err.Error()
+			return
+		}
+		defer resp.Body.Close()
+		data, _ := ioutil.ReadAll(resp.Body)
+		body <- string(data)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	shutdown([]*runningServer{srv})
+	assert.Equal(t, <-body, "done")
+
+	// new connections are refused
+	_, err = http.Get(fmt.Sprintf("http://%s/", ln.Addr()))
+	assert.NotEqual(t, err, nil)
+}
+
+// helper function to get body of given url
+func testGetBody(url string, body chan<- string) {
+	resp, err := http.Get(url)
+	if err != nil {
+		body <- err.Error()
+		return
+	}
+	defer resp.Body.Close()
+	data, _ := ioutil.ReadAll(resp.Body)
+	body <- string(data)
+}
+
+// Test_updateServerTimeouts function
+func Test_updateServerTimeouts(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Equal(t, err, nil)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+		w.Write([]byte("done"))
+	})
+	server := &http.Server{Handler: handler, ReadTimeout: time.Second, WriteTimeout: time.Second}
+	srv := &runningServer{Server: server, Listener: ln, Timeouts: true}
+	errs := make(chan error, 1)
+	srv.start(errs)
+	runningServersLock.Lock()
+	runningServers = []*runningServer{srv}
+	runningServersLock.Unlock()
+	Config().ShutdownTimeout = 5
+	defer func() {
+		Config().ShutdownTimeout = 0
+		runningServersLock.Lock()
+		runningServers = nil
+		runningServersLock.Unlock()
+	}()
+	url := fmt.Sprintf("http://%s/", ln.Addr())
+
+	// in-flight request completes on replaced server
+	body := make(chan string, 1)
+	go testGetBody(url, body)
+	time.Sleep(50 * time.Millisecond)
+	updateServerTimeouts(Configuration{ReadTimeout: 10, WriteTimeout: 20})
+	assert.Equal(t, <-body, "done")
+	assert.True(t, srv.current() != server)
+	assert.Equal(t, srv.current().ReadTimeout, 10*time.Second)
+	assert.Equal(t, srv.current().WriteTimeout, 20*time.Second)
+
+	// new requests are served by new server on the same socket
+	go testGetBody(url, body)
+	assert.Equal(t, <-body, "done")
+
+	// the same timeouts do not replace the server
+	server = srv.current()
+	updateServerTimeouts(Configuration{ReadTimeout: 10, WriteTimeout: 20})
+	assert.True(t, srv.current() == server)
+
+	shutdown([]*runningServer{srv})
+	select {
+	case err := <-errs:
+		t.Fatal(err)
+	default:
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+// tokencache module provides cache of validated access tokens
+//
+// Copyright (c) 2020 - Valentin Kuznetsov <vkuznet@gmail.com>
+//
+
+/*
+The OAuth server validates access tokens of clients with public keys of
+participated providers or via introspection request to the OAuth provider.
+Clients usually send the same token with many requests, therefore validated
+tokens are kept in bounded LRU cache keyed by SHA256 hash of the token until
+token expiration, while invalid tokens are kept for token_cache.negative_ttl
+seconds. Tokens which can't be validated due to provider errors are not
+cached.
+*/
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// defaultTokenCacheSize defines default number of tokens in cache
+const defaultTokenCacheSize = 10000
+
+// defaultTokenCacheNegativeTTL defines default time (in sec) to keep invalid
+// tokens in cache
+const defaultTokenCacheNegativeTTL = 30
+
+// TotalTokenCacheHits counts total number of tokens found in token cache
+var TotalTokenCacheHits uint64
+
+// TotalTokenCacheMisses counts total number of tokens not found in token cache
+var TotalTokenCacheMisses uint64
+
+// tokenEntry represents cached result of token validation
+type tokenEntry struct {
+	Key    string          // SHA256 hash of the token
+	Attrs  TokenAttributes // attributes of valid token
+	Err    error           // validation error of invalid token
+	Expire time.Time       // expiration time of cache entry
+}
+
+// tokenCache represents LRU cache of validated tokens
+type tokenCache struct {
+	Size    int                      // maximum number of cached tokens
+	entries map[string]*list.Element // cache entries
+	order   *list.List               // entries ordered by their usage
+	mutex   sync.Mutex               // protects cache entries
+}
+
+// newTokenCache creates token cache of given size
+func newTokenCache(size int) *tokenCache {
+	return &tokenCache{
+		Size:    size,
+		entries: make(map[string]*list.Element),
+		order:   list.New(),
+	}
+}
+
+// helper function to get cache key of given token
+func tokenKey(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
+
+// Get returns cached validation result of given token
+func (c *tokenCache) Get(token string) (tokenEntry, bool) {
+	if c == nil || c.Size <= 0 {
+		return tokenEntry{}, false
+	}
+	key := tokenKey(token)
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	elem, ok := c.entries[key]
+	if !ok {
+		atomic.AddUint64(&TotalTokenCacheMisses, 1)
+		return tokenEntry{}, false
+	}
+	entry := elem.Value.(*tokenEntry)
+	if time.Now().After(entry.Expire) {
+		c.order.Remove(elem)
+		delete(c.entries, key)
+		atomic.AddUint64(&TotalTokenCacheMisses, 1)
+		return tokenEntry{}, false
+	}
+	c.order.MoveToFront(elem)
+	atomic.AddUint64(&TotalTokenCacheHits, 1)
+	return *entry, true
+}
+
+// Add stores validation result of given token, valid tokens are kept until
+// their expiration and invalid ones for given negative ttl
+func (c *tokenCache) Add(token string, attrs TokenAttributes, err error, negativeTTL time.Duration) {
+	if c == nil || c.Size <= 0 {
+		return
+	}
+	expire := time.Now().Add(negativeTTL)
+	if err == nil {
+		if attrs.Expiration == 0 {
+			// we can't tell how long token is valid
+			return
+		}
+		expire = time.Unix(attrs.Expiration, 0)
+	}
+	if !expire.After(time.Now()) {
+		return
+	}
+	entry := &tokenEntry{Key: tokenKey(token), Attrs: attrs, Err: err, Expire: expire}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if elem, ok := c.entries[entry.Key]; ok {
+		elem.Value = entry
+		c.order.MoveToFront(elem)
+		return
+	}
+	c.entries[entry.Key] = c.order.PushFront(entry)
+	for c.order.Len() > c.Size {
+		elem := c.order.Back()
+		c.order.Remove(elem)
+		delete(c.entries, elem.Value.(*tokenEntry).Key)
+	}
+}
+
+// Len returns number of cached tokens
+func (c *tokenCache) Len() int {
+	if c == nil {
+		return 0
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.order.Len()
+}
+
+// AccessTokens function provides cache of validated access tokens of the server
+func AccessTokens() *tokenCache {
+	return currentState().AccessTokens
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Test_tokenCache function
+func Test_tokenCache(t *testing.T) {
+	cache := newTokenCache(2)
+	exp := time.Now().Add(time.Minute).Unix()
+
+	// valid tokens are kept until their expiration
+	cache.Add("token1", TokenAttributes{UserName: "user1", Expiration: exp}, nil, time.Minute)
+	entry, ok := cache.Get("token1")
+	assert.Equal(t, ok, true)
+	assert.Equal(t, entry.Attrs.UserName, "user1")
+	cache.Add("expired", TokenAttributes{Expiration: time.Now().Unix() - 1}, nil, time.Minute)
+	_, ok = cache.Get("expired")
+	assert.Equal(t, ok, false)
+
+	// invalid tokens are kept for negative ttl
+	cache.Add("invalid", TokenAttributes{}, errors.New("invalid token"), time.Minute)
+	entry, ok = cache.Get("invalid")
+	assert.Equal(t, ok, true)
+	assert.NotEqual(t, entry.Err, nil)
+
+	// least recently used token is evicted
+	cache.Get("token1")
+	cache.Add("token2", TokenAttributes{UserName: "user2", Expiration: exp}, nil, time.Minute)
+	assert.Equal(t, cache.Len(), 2)
+	_, ok = cache.Get("invalid")
+	assert.Equal(t, ok, false)
+	_, ok = cache.Get("token1")
+	assert.Equal(t, ok, true)
+}
+
+// Test_verifyAccessToken function
+func Test_verifyAccessToken(t *testing.T) {
+	// introspection endpoint of OAuth provider
+	var calls int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		r.ParseForm()
+		attrs := TokenAttributes{Active: r.FormValue("token") == "valid", UserName: "user", Expiration: time.Now().Add(time.Minute).Unix()}
+		json.NewEncoder(w).Encode(attrs)
+	}))
+	defer server.Close()
+	OAuthLogins = []*oauthLogin{{Name: defaultLoginName, AuthTokenURL: server.URL}}
+	updateState(func(st *serverState) {
+		st.AccessTokens = newTokenCache(defaultTokenCacheSize)
+	})
+	Config().TokenCache.NegativeTTL = defaultTokenCacheNegativeTTL
+	defer func() {
+		OAuthLogins = nil
+		updateState(func(st *serverState) {
+			st.AccessTokens = nil
+		})
+		Config().TokenCache = TokenCacheConfig{}
+	}()
+
+	// provider is contacted only once per token
+	hits := atomic.LoadUint64(&TotalTokenCacheHits)
+	for i := 0; i < 3; i++ {
+		attrs, err := verifyAccessToken("valid")
+		assert.Equal(t, err, nil)
+		assert.Equal(t, attrs.UserName, "user")
+		_, err = verifyAccessToken("invalid")
+		assert.NotEqual(t, err, nil)
+	}
+	assert.Equal(t, calls, 2)
+	assert.Equal(t, atomic.LoadUint64(&TotalTokenCacheHits)-hits, uint64(4))
+
+	// provider errors are not cached
+	server.Close()
+	_, err := verifyAccessToken("other")
+	assert.NotEqual(t, err, nil)
+	_, ok := AccessTokens().Get("other")
+	assert.Equal(t, ok, false)
+}
@@ -64,53 +64,36 @@ func printHTTPRequest(r *http.Request, msg string) {
 }
 
 // helper function to construct http server with TLS
-func getServer(serverCrt, serverKey string, customVerify bool) (*http.Server, error) {
+func getServer(port int, serverCrt, serverKey string, customVerify bool) (*http.Server, error) {
 	// start HTTP or HTTPs server based on provided configuration
 	rootCAs := x509.NewCertPool()
-	files, err := ioutil.ReadDir(Config.RootCAs)
+	files, err := ioutil.ReadDir(Config().RootCAs)
 	if err != nil {
-		log.Printf("Unable to list files in '%s', error: %v\n", Config.RootCAs, err)
+		log.Printf("Unable to list files in '%s', error: %v\n", Config().RootCAs, err)
 		return nil, err
 	}
 	for _, finfo := range files {
-		fname := fmt.Sprintf("%s/%s", Config.RootCAs, finfo.Name())
+		fname := fmt.Sprintf("%s/%s", Config().RootCAs, finfo.Name())
 		caCert, err := ioutil.ReadFile(filepath.Clean(fname))
 		if err != nil {
-			if Config.Verbose > 1 {
+			if Config().Verbose > 1 {
 				log.Printf("Unable to read %s\n", fname)
 			}
 		}
 		if ok := rootCAs.AppendCertsFromPEM(caCert); !ok {
-			if Config.Verbose > 1 {
+			if Config().Verbose > 1 {
 				log.Printf("invalid PEM format while importing trust-chain: %q", fname)
 			}
 		}
-		if Config.Verbose > 1 {
+		if Config().Verbose > 1 {
 			log.Println("Load CA file", fname)
 		}
 	}
 
 	var tlsConfig *tls.Config
-	// see go doc tls.VersionTLS13 for different versions
-	var minVer, maxVer int
-	if Config.MinTLSVersion == "tls10" {
-		minVer = tls.VersionTLS10
-	} else if Config.MinTLSVersion == "tls11" {
-		minVer = tls.VersionTLS11
-	} else if Config.MinTLSVersion == "tls12" {
-		minVer = tls.VersionTLS12
-	} else if Config.MinTLSVersion == "tls13" {
-		minVer = tls.VersionTLS13
-	}
-	if Config.MaxTLSVersion == "tls10" {
-		maxVer = tls.VersionTLS10
-	} else if Config.MaxTLSVersion == "tls11" {
-		maxVer = tls.VersionTLS11
-	} else if Config.MaxTLSVersion == "tls12" {
-		maxVer = tls.VersionTLS12
-	} else if Config.MaxTLSVersion == "tls13" {
-		maxVer = tls.VersionTLS13
-	}
+	// TLS versions are validated when configuration is loaded
+	minVer, _ := tlsVersion(Config().MinTLSVersion)
+	maxVer, _ := tlsVersion(Config().MaxTLSVersion)
 	log.Println("set tlsConfig with min version", minVer)
 	// if we do not require custom verification we'll load server crt/key and present to client
 	if customVerify == false {
@@ -120,8 +103,8 @@ func getServer(serverCrt, serverKey string, customVerify bool) (*http.Server, er
 
 		}
 		tlsConfig = &tls.Config{
-			MinVersion:   uint16(minVer),
-			MaxVersion:   uint16(maxVer),
+			MinVersion:   minVer,
+			MaxVersion:   maxVer,
 			RootCAs:      rootCAs,
 			Certificates: []tls.Certificate{cert},
 		}
@@ -129,8 +112,8 @@ func getServer(serverCrt, serverKey string, customVerify bool) (*http.Server, er
 		tlsConfig = &tls.Config{
 			// Set InsecureSkipVerify to skip the default validation we are
 			// replacing. This will not disable VerifyPeerCertificate.
-			MinVersion:         uint16(minVer),
-			MaxVersion:         uint16(maxVer),
+			MinVersion:         minVer,
+			MaxVersion:         maxVer,
 			InsecureSkipVerify: true,
 			ClientAuth:         tls.RequestClientCert,
 			RootCAs:            rootCAs,
@@ -140,7 +123,7 @@ func getServer(serverCrt, serverKey string, customVerify bool) (*http.Server, er
 		// https://www.example-code.com/golang/cert.asp
 		// https://golang.org/pkg/crypto/x509/pkix/#Extension
 		tlsConfig.VerifyPeerCertificate = func(certificates [][]byte, _ [][]*x509.Certificate) error {
-			if Config.Verbose > 1 {
+			if Config().Verbose > 1 {
 				log.Println("call custom tlsConfig.VerifyPeerCertificate")
 			}
 			certs := make([]*x509.Certificate, len(certificates))
@@ -149,7 +132,7 @@ func getServer(serverCrt, serverKey string, customVerify bool) (*http.Server, er
 				if err != nil {
 					return errors.New("tls: failed to parse certificate from server: " + err.Error())
 				}
-				if Config.Verbose > 1 {
+				if Config().Verbose > 1 {
 					log.Println("Issuer", cert.Issuer)
 					log.Println("Subject", cert.Subject)
 					log.Println("emails", cert.EmailAddresses)
@@ -162,7 +145,7 @@ func getServer(serverCrt, serverKey string, customVerify bool) (*http.Server, er
 				}
 				// dump cert UnhandledCriticalExtensions
 				for _, ext := range cert.UnhandledCriticalExtensions {
-					if Config.Verbose > 1 {
+					if Config().Verbose > 1 {
 						log.Printf("Cetificate extension: %+v\n", ext)
 					}
 					continue
@@ -171,7 +154,7 @@ func getServer(serverCrt, serverKey string, customVerify bool) (*http.Server, er
 					certs[i] = cert
 				}
 			}
-			if Config.Verbose > 1 {
+			if Config().Verbose > 1 {
 				log.Println("### number of certs", len(certs))
 				for _, cert := range certs {
 					if cert != nil {
@@ -203,12 +186,12 @@ func getServer(serverCrt, serverKey string, customVerify bool) (*http.Server, er
 			return nil
 		}
 	}
-	addr := fmt.Sprintf(":%d", Config.Port)
+	addr := fmt.Sprintf(":%d", port)
 	server := &http.Server{
 		Addr:           addr,
 		TLSConfig:      tlsConfig,
-		ReadTimeout:    time.Duration(Config.ReadTimeout) * time.Second,
-		WriteTimeout:   time.Duration(Config.WriteTimeout) * time.Second,
+		ReadTimeout:    time.Duration(Config().ReadTimeout) * time.Second,
+		WriteTimeout:   time.Duration(Config().WriteTimeout) * time.Second,
 		MaxHeaderBytes: 1 << 20,
 	}
 	log.Printf("Starting HTTPs server on %s", addr)
@@ -273,13 +256,13 @@ func getUserData(r *http.Request) map[string]interface{} {
 			if strings.Contains(s, "ROOT") && strings.Contains(s, "CERN") || strings.Contains(s, "Grid") {
 				continue
 			}
-			if Config.Verbose > 2 {
+			if Config().Verbose > 2 {
 				log.Println("cert subject", s)
 			}
 			subjects = append(subjects, s)
 		}
 		rec, err := findUser(subjects)
-		if Config.Verbose > 0 {
+		if Config().Verbose > 0 {
 			log.Printf("found user %+v error=%v elapsed time %v\n", rec, err, time.Since(start))
 		}
 		if err == nil {
@@ -293,6 +276,7 @@ func getUserData(r *http.Request) map[string]interface{} {
 			userData["email"] = cert.EmailAddresses
 			userData["roles"] = rec.Roles
 			userData["dn"] = rec.DN
+			userData["dns"] = rec.DNs
 			break
 		} else {
 			log.Println(err)
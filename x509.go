@@ -38,18 +38,20 @@ func x509RequestHandler(w http.ResponseWriter, r *http.Request) {
 	status := http.StatusOK
 	tstamp := int64(start.UnixNano() / 1000000) // use milliseconds for MONIT
 	userData := getUserData(r)
-	// set CMS headers based on provided user certificate
+	// set CMS headers based on provided user certificate, CMS headers of the
+	// client are never passed to backends
+	clearCMSHeaders(r)
 	level := false
-	if Config.Verbose > 3 {
+	if Config().Verbose > 3 {
 		level = true
 	}
-	CMSAuth.SetCMSHeaders(r, userData, CricRecords, level)
+	CMSAuth().SetCMSHeaders(r, userData, CricRecords, level)
 	if r.Header.Get("Cms-Auth-Cert") == "" {
 		if dn, ok := userData["dn"]; ok {
 			r.Header.Set("Cms-Auth-Cert", dn.(string))
 		}
 	}
-	if Config.Verbose > 0 {
+	if Config().Verbose > 0 {
 		printHTTPRequest(r, "cms headers")
 	}
 	// add logRequest after we set cms headers in HTTP request
@@ -62,11 +64,18 @@ func x509RequestHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// check CMS headers
-	authStatus := CMSAuth.CheckAuthnAuthz(r.Header)
-	if Config.Verbose > 0 {
+	authStatus := CMSAuth().CheckAuthnAuthz(r.Header)
+	if Config().Verbose > 0 {
 		log.Println("x509RequestHandler", r.Header, authStatus)
 	}
 	if authStatus {
+		// check authorization policy of ingress rule
+		if err := checkIngressPolicy(r, userData); err != nil {
+			log.Printf("forbidden access to %s, %v\n", r.URL.Path, err)
+			status = http.StatusForbidden
+			w.WriteHeader(status)
+			return
+		}
 		redirect(w, r)
 		return
 	}
@@ -74,30 +83,20 @@ func x509RequestHandler(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(status)
 }
 
-// helper function to start x509 proxy server
-func x509ProxyServer() {
-	// check if provided crt/key files exists
-	serverCrt := checkFile(Config.ServerCrt)
-	serverKey := checkFile(Config.ServerKey)
+// helper function to setup HTTP handlers of x509 proxy server
+func x509ServeMux() *http.ServeMux {
+	mux := http.NewServeMux()
 
 	// metrics handler
-	http.HandleFunc(fmt.Sprintf("%s/metrics", Config.Base), metricsHandler)
-
-	// start http server to serve metrics only
-	if Config.MetricsPort > 0 {
-		go http.ListenAndServe(fmt.Sprintf(":%d", Config.MetricsPort), nil)
-	}
+	mux.HandleFunc(fmt.Sprintf("%s/metrics", Config().Base), metricsHandler)
 
 	// the server settings handler
-	http.HandleFunc(fmt.Sprintf("%s/server", Config.Base), settingsHandler)
+	mux.HandleFunc(fmt.Sprintf("%s/server", Config().Base), settingsHandler)
 
-	// the request handler
-	http.HandleFunc("/", x509RequestHandler)
+	// JWKS of internal tokens passed to backends
+	internalTokenServeMux(mux)
 
-	// start HTTPS server
-	server, err := getServer(serverCrt, serverKey, true)
-	if err != nil {
-		log.Fatalf("unable to start x509 server, error %v\n", err)
-	}
-	log.Fatal(server.ListenAndServeTLS(serverCrt, serverKey))
+	// the request handler
+	mux.HandleFunc("/", x509RequestHandler)
+	return mux
 }